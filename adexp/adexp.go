@@ -0,0 +1,226 @@
+/*
+Package adexp implements parsing and generation of ADEXP (ATS Data Exchange Presentation) messages,
+as carried in FMTP Operational messages.
+
+An ADEXP message is a sequence of fields, each introduced by a hyphen and a keyword:
+
+	-TITLE ACT -REFDATA -SENDER -FAC E -RECVR -FAC L -SEQNUM 005 -ARCID BAW123
+	-BEGIN RTEPTS -PT -PTID ABNUR -FL F350 -PT -PTID GEN -FL F350 -END RTEPTS
+
+A field is either basic (a keyword and a value, such as "-ARCID BAW123"), structured (a keyword followed by its subfields,
+such as "-REFDATA -SENDER -FAC E ..."), or a list ("-BEGIN NAME ... -END NAME").
+As the syntax doesn't distinguish structured fields from empty basic fields, structured fields are recognised using a dictionary,
+which can be extended with RegisterStructured.
+
+Messages can be handled as a generic tree (Message), or mapped to and from structs (Marshal and Unmarshal).
+*/
+package adexp
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// structured is the dictionary of structured fields, mapping them to their subfields
+var structured = map[string]map[string]bool{}
+
+func init() {
+	RegisterStructured("REFDATA", "SENDER", "RECVR", "SEQNUM")
+	RegisterStructured("SENDER", "FAC")
+	RegisterStructured("RECVR", "FAC")
+	RegisterStructured("ORIGIN", "NETWORKTYPE", "FAC")
+	RegisterStructured("PT", "PTID", "FL", "ETO", "SFL", "TO", "CTO", "PTSPEED", "PTRFL")
+	RegisterStructured("ESTDATA", "PTID", "ETO", "FL", "SFL")
+}
+
+// RegisterStructured registers a structured field, along with the keywords of its subfields
+// It should be called during initialisation, as it isn't safe for use concurrently with parsing.
+func RegisterStructured(name string, subfields ...string) {
+	subs := structured[name]
+	if subs == nil {
+		subs = make(map[string]bool, len(subfields))
+		structured[name] = subs
+	}
+	for _, sub := range subfields {
+		subs[sub] = true
+	}
+}
+
+// Field is an ADEXP field
+type Field struct {
+	// Name is the field's keyword, such as "ARCID"
+	Name string
+
+	// Value is the value of a basic field
+	Value string
+
+	// Fields are the subfields of a structured field, or the elements of a list
+	Fields Fields
+
+	// List is true if the field is a list ("-BEGIN NAME ... -END NAME")
+	List bool
+}
+
+// Int returns the value of a basic field as an integer
+func (f *Field) Int() (int, error) {
+	i, err := strconv.Atoi(f.Value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "field %s", f.Name)
+	}
+	return i, nil
+}
+
+// Time returns the value of a basic field as a date and time, see ParseTime
+func (f *Field) Time() (time.Time, error) {
+	t, err := ParseTime(f.Value)
+	if err != nil {
+		return t, errors.Wrapf(err, "field %s", f.Name)
+	}
+	return t, nil
+}
+
+// Fields is a sequence of fields
+type Fields []*Field
+
+// Get returns the first field with the given keyword, nil if there is none
+func (fs Fields) Get(name string) *Field {
+	for _, f := range fs {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// Value returns the value of the first field with the given keyword, empty if there is none
+func (fs Fields) Value(name string) string {
+	if f := fs.Get(name); f != nil {
+		return f.Value
+	}
+	return ""
+}
+
+// All returns every field with the given keyword
+func (fs Fields) All(name string) Fields {
+	var all Fields
+	for _, f := range fs {
+		if f.Name == name {
+			all = append(all, f)
+		}
+	}
+	return all
+}
+
+// Message is an ADEXP message
+type Message struct {
+	Fields Fields
+}
+
+// Title returns the message title (TITLE), such as "ACT"
+func (m *Message) Title() string {
+	return m.Fields.Value("TITLE")
+}
+
+// ARCID returns the aircraft identification (ARCID)
+func (m *Message) ARCID() string {
+	return m.Fields.Value("ARCID")
+}
+
+// SSRCode returns the SSR mode and code (SSRCODE), such as "A4401"
+func (m *Message) SSRCode() string {
+	return m.Fields.Value("SSRCODE")
+}
+
+// ARCTYP returns the ICAO aircraft type designator (ARCTYP)
+func (m *Message) ARCTYP() string {
+	return m.Fields.Value("ARCTYP")
+}
+
+// ADEP returns the departure aerodrome (ADEP)
+func (m *Message) ADEP() string {
+	return m.Fields.Value("ADEP")
+}
+
+// ADES returns the destination aerodrome (ADES)
+func (m *Message) ADES() string {
+	return m.Fields.Value("ADES")
+}
+
+// COP returns the coordination point (COP)
+func (m *Message) COP() string {
+	return m.Fields.Value("COP")
+}
+
+// CFL returns the cleared flight level (CFL), such as "F350"
+func (m *Message) CFL() string {
+	return m.Fields.Value("CFL")
+}
+
+// RefData is the reference data of a message (REFDATA)
+type RefData struct {
+	// Sender is the sending unit (SENDER FAC)
+	Sender string
+
+	// Receiver is the receiving unit (RECVR FAC)
+	Receiver string
+
+	// SeqNum is the message's sequence number (SEQNUM)
+	SeqNum int
+}
+
+// RefData returns the message's reference data (REFDATA)
+func (m *Message) RefData() (RefData, error) {
+	var rd RefData
+	f := m.Fields.Get("REFDATA")
+	if f == nil {
+		return rd, errors.New("no REFDATA field")
+	}
+	if sender := f.Fields.Get("SENDER"); sender != nil {
+		rd.Sender = sender.Fields.Value("FAC")
+	}
+	if recvr := f.Fields.Get("RECVR"); recvr != nil {
+		rd.Receiver = recvr.Fields.Value("FAC")
+	}
+	if seq := f.Fields.Get("SEQNUM"); seq != nil {
+		var err error
+		rd.SeqNum, err = seq.Int()
+		if err != nil {
+			return rd, err
+		}
+	}
+	return rd, nil
+}
+
+// RoutePoints returns the route points (the PT elements of the RTEPTS list)
+func (m *Message) RoutePoints() Fields {
+	if f := m.Fields.Get("RTEPTS"); f != nil && f.List {
+		return f.Fields.All("PT")
+	}
+	return nil
+}
+
+// These are the layouts of ADEXP dates and times
+const (
+	timeLayout        = "0601021504"
+	timeLayoutSeconds = "060102150405"
+)
+
+// ParseTime parses an ADEXP date and time, as YYMMDDHHMM or YYMMDDHHMMSS in UTC
+func ParseTime(s string) (time.Time, error) {
+	layout := timeLayout
+	if len(s) == len(timeLayoutSeconds) {
+		layout = timeLayoutSeconds
+	}
+	return time.Parse(layout, s)
+}
+
+// FormatTime formats an ADEXP date and time, with seconds only if they are non-zero
+func FormatTime(t time.Time) string {
+	t = t.UTC()
+	if t.Second() != 0 {
+		return t.Format(timeLayoutSeconds)
+	}
+	return t.Format(timeLayout)
+}
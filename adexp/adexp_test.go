@@ -0,0 +1,258 @@
+package adexp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aabizri/fmtp"
+)
+
+// sample is an ACT message in ADEXP format
+const sample = "-TITLE ACT -REFDATA -SENDER -FAC E -RECVR -FAC L -SEQNUM 005 -ARCID BAW123 -SSRCODE A4401 " +
+	"-ADEP EGLL -ADES LIRF -ARCTYP B738 " +
+	"-BEGIN RTEPTS -PT -PTID ABNUR -FL F350 -ETO 2610161412 -PT -PTID GEN -FL F350 -ETO 2610161440 -END RTEPTS " +
+	"-COP ABNUR -CFL F350 -RFL"
+
+// sampleTree is the tree of sample
+var sampleTree = &Message{Fields: Fields{
+	{Name: "TITLE", Value: "ACT"},
+	{Name: "REFDATA", Fields: Fields{
+		{Name: "SENDER", Fields: Fields{{Name: "FAC", Value: "E"}}},
+		{Name: "RECVR", Fields: Fields{{Name: "FAC", Value: "L"}}},
+		{Name: "SEQNUM", Value: "005"},
+	}},
+	{Name: "ARCID", Value: "BAW123"},
+	{Name: "SSRCODE", Value: "A4401"},
+	{Name: "ADEP", Value: "EGLL"},
+	{Name: "ADES", Value: "LIRF"},
+	{Name: "ARCTYP", Value: "B738"},
+	{Name: "RTEPTS", List: true, Fields: Fields{
+		{Name: "PT", Fields: Fields{{Name: "PTID", Value: "ABNUR"}, {Name: "FL", Value: "F350"}, {Name: "ETO", Value: "2610161412"}}},
+		{Name: "PT", Fields: Fields{{Name: "PTID", Value: "GEN"}, {Name: "FL", Value: "F350"}, {Name: "ETO", Value: "2610161440"}}},
+	}},
+	{Name: "COP", Value: "ABNUR"},
+	{Name: "CFL", Value: "F350"},
+	{Name: "RFL"},
+}}
+
+func TestRoundTrip(t *testing.T) {
+	m, err := Parse([]byte(sample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, sampleTree) {
+		t.Errorf("Parse: got %+v, expected %+v", m, sampleTree)
+	}
+
+	b, err := m.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != sample {
+		t.Errorf("MarshalText:\ngot      %q\nexpected %q", b, sample)
+	}
+}
+
+func TestParseLayout(t *testing.T) {
+	// Line breaks & indentation, hyphens which don't introduce a keyword
+	text := "\r\n -TITLE  ACT\r\n -ARCID BAW123\r\n\t-RMK SEE-ALSO  NOTE -1\r\n"
+	m, err := Parse([]byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Title() != "ACT" || m.ARCID() != "BAW123" {
+		t.Errorf("unexpected fields %+v", m.Fields)
+	}
+	if rmk := m.Fields.Value("RMK"); rmk != "SEE-ALSO NOTE -1" {
+		t.Errorf("unexpected RMK %q", rmk)
+	}
+}
+
+func TestAccessors(t *testing.T) {
+	m, err := Parse([]byte(sample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Title() != "ACT" || m.ARCID() != "BAW123" || m.SSRCode() != "A4401" || m.ARCTYP() != "B738" ||
+		m.ADEP() != "EGLL" || m.ADES() != "LIRF" || m.COP() != "ABNUR" || m.CFL() != "F350" {
+		t.Errorf("unexpected basic fields")
+	}
+
+	rd, err := m.RefData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (RefData{"E", "L", 5}); rd != expected {
+		t.Errorf("RefData: got %+v, expected %+v", rd, expected)
+	}
+
+	pts := m.RoutePoints()
+	if len(pts) != 2 {
+		t.Fatalf("expected 2 route points, got %d", len(pts))
+	}
+	eto, err := pts[1].Fields.Get("ETO").Time()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := time.Date(2026, 10, 16, 14, 40, 0, 0, time.UTC); !eto.Equal(expected) {
+		t.Errorf("ETO: got %s, expected %s", eto, expected)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+	}{
+		{"empty", " \r\n"},
+		{"no keyword", "TITLE ACT"},
+		{"invalid keyword", "-TITLE ACT -AR.CID BAW123"},
+		{"unterminated list", "-TITLE ACT -BEGIN RTEPTS -PT -PTID ABNUR"},
+		{"mismatched list", "-TITLE ACT -BEGIN RTEPTS -PT -PTID ABNUR -END ADDR"},
+		{"END without BEGIN", "-TITLE ACT -END RTEPTS"},
+		{"BEGIN without name", "-TITLE ACT -BEGIN -END"},
+		{"invalid character", "-TITLE ACT\x00"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if m, err := Parse([]byte(test.text)); err == nil {
+				t.Errorf("expected an error, got %+v", m)
+			}
+		})
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  *Message
+	}{
+		{"invalid keyword", &Message{Fields: Fields{{Name: "arcid", Value: "BAW123"}}}},
+		{"keyword in value", &Message{Fields: Fields{{Name: "RMK", Value: "FOO -BAR"}}}},
+		{"structured field with value", &Message{Fields: Fields{{Name: "REFDATA", Value: "FOO", Fields: Fields{{Name: "SEQNUM", Value: "1"}}}}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if b, err := test.msg.MarshalText(); err == nil {
+				t.Errorf("expected an error, got %q", b)
+			}
+		})
+	}
+}
+
+// point is a route point
+type point struct {
+	ID    string    `adexp:"PTID"`
+	Level string    `adexp:"FL"`
+	ETO   time.Time `adexp:"ETO"`
+}
+
+// act holds the fields of an ACT message we are interested in
+type act struct {
+	Title   string `adexp:"TITLE"`
+	RefData struct {
+		Sender struct {
+			FAC string
+		}
+		Receiver struct {
+			FAC string
+		} `adexp:"RECVR"`
+		SeqNum int
+	}
+	ARCID   string
+	ADEP    string
+	ADES    string
+	Points  []point `adexp:"RTEPTS,elem=PT"`
+	CFL     string
+	Ignored string `adexp:"-"`
+}
+
+func TestStruct(t *testing.T) {
+	var a act
+	if err := Unmarshal([]byte(sample), &a); err != nil {
+		t.Fatal(err)
+	}
+
+	var expected act
+	expected.Title = "ACT"
+	expected.RefData.Sender.FAC = "E"
+	expected.RefData.Receiver.FAC = "L"
+	expected.RefData.SeqNum = 5
+	expected.ARCID, expected.ADEP, expected.ADES, expected.CFL = "BAW123", "EGLL", "LIRF", "F350"
+	expected.Points = []point{
+		{"ABNUR", "F350", time.Date(2026, 10, 16, 14, 12, 0, 0, time.UTC)},
+		{"GEN", "F350", time.Date(2026, 10, 16, 14, 40, 0, 0, time.UTC)},
+	}
+	if !reflect.DeepEqual(a, expected) {
+		t.Fatalf("Unmarshal: got %+v, expected %+v", a, expected)
+	}
+
+	// Marshal it back, only the mapped fields remain
+	b, err := Marshal(&a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const text = "-TITLE ACT -REFDATA -SENDER -FAC E -RECVR -FAC L -SEQNUM 5 -ARCID BAW123 -ADEP EGLL -ADES LIRF " +
+		"-BEGIN RTEPTS -PT -PTID ABNUR -FL F350 -ETO 2610161412 -PT -PTID GEN -FL F350 -ETO 2610161440 -END RTEPTS -CFL F350"
+	if string(b) != text {
+		t.Errorf("Marshal:\ngot      %q\nexpected %q", b, text)
+	}
+}
+
+func TestStructRepeated(t *testing.T) {
+	var v struct {
+		Addr []string `adexp:"FAC"`
+	}
+	if err := Unmarshal([]byte("-TITLE ACK -FAC LFPO -FAC EGLL"), &v); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"LFPO", "EGLL"}; !reflect.DeepEqual(v.Addr, expected) {
+		t.Errorf("got %v, expected %v", v.Addr, expected)
+	}
+}
+
+func TestStructErrors(t *testing.T) {
+	var v struct {
+		SeqNum int
+	}
+	if err := Unmarshal([]byte("-SEQNUM ABC"), &v); err == nil {
+		t.Error("expected an error for an invalid integer")
+	}
+	if err := Unmarshal([]byte("-SEQNUM 1"), v); err == nil {
+		t.Error("expected an error when decoding into a non-pointer")
+	}
+	if _, err := Marshal(struct{ F float64 }{1.5}); err == nil {
+		t.Error("expected an error for an unsupported type")
+	}
+}
+
+func TestHandlerFunc(t *testing.T) {
+	msg, err := NewOperationalMessage(sampleTree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Go through the wire format
+	var buf bytes.Buffer
+	if _, err := msg.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	received := &fmtp.Message{}
+	if _, err := received.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var got *Message
+	h := HandlerFunc(func(conn *fmtp.Conn, m *Message, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		got = m
+	})
+	h.ServeFMTP(nil, received)
+	if !reflect.DeepEqual(got, sampleTree) {
+		t.Errorf("got %+v, expected %+v", got, sampleTree)
+	}
+}
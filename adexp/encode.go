@@ -0,0 +1,103 @@
+package adexp
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+)
+
+// checkName checks that a keyword is valid
+func checkName(name string) error {
+	if name == "" || name[0] < 'A' || name[0] > 'Z' {
+		return errors.Errorf("invalid keyword %q", name)
+	}
+	for i := 1; i < len(name); i++ {
+		if !isKeywordChar(name[i]) {
+			return errors.Errorf("invalid keyword %q", name)
+		}
+	}
+	return nil
+}
+
+// checkValue checks that a value can be serialised without being mistaken for keywords
+func checkValue(name, value string) error {
+	b := []byte(value)
+	for i, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return errors.Errorf("field %s: invalid character %q in value", name, c)
+		}
+		if c == '-' && (i == 0 || isSpace(b[i-1])) && i+1 < len(b) && b[i+1] >= 'A' && b[i+1] <= 'Z' {
+			return errors.Errorf("field %s: value %q contains a keyword", name, value)
+		}
+	}
+	return nil
+}
+
+// encode writes a field
+func (f *Field) encode(buf *bytes.Buffer) error {
+	if err := checkName(f.Name); err != nil {
+		return err
+	}
+
+	// A list
+	if f.List {
+		if f.Value != "" {
+			return errors.Errorf("list %s has a value", f.Name)
+		}
+		buf.WriteString(" -BEGIN " + f.Name)
+		if err := f.Fields.encode(buf); err != nil {
+			return err
+		}
+		buf.WriteString(" -END " + f.Name)
+		return nil
+	}
+
+	// A structured field
+	if len(f.Fields) != 0 {
+		if f.Value != "" {
+			return errors.Errorf("structured field %s has a value", f.Name)
+		}
+		buf.WriteString(" -" + f.Name)
+		return f.Fields.encode(buf)
+	}
+
+	// A basic field
+	if err := checkValue(f.Name, f.Value); err != nil {
+		return err
+	}
+	buf.WriteString(" -" + f.Name)
+	if f.Value != "" {
+		buf.WriteString(" " + f.Value)
+	}
+	return nil
+}
+
+// encode writes a sequence of fields
+func (fs Fields) encode(buf *bytes.Buffer) error {
+	for _, f := range fs {
+		if err := f.encode(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarshalText returns the message in ADEXP format
+func (m *Message) MarshalText() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := m.Fields.encode(&buf); err != nil {
+		return nil, errors.Wrap(err, "adexp")
+	}
+	// Remove the leading space
+	return bytes.TrimPrefix(buf.Bytes(), []byte{' '}), nil
+}
+
+// UnmarshalText parses a message in ADEXP format
+func (m *Message) UnmarshalText(b []byte) error {
+	parsed, err := Parse(b)
+	if err != nil {
+		return err
+	}
+	*m = *parsed
+	return nil
+}
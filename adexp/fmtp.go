@@ -0,0 +1,62 @@
+package adexp
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	"github.com/aabizri/fmtp"
+	"github.com/pkg/errors"
+)
+
+// NewOperationalMessage returns an FMTP Operational message carrying the ADEXP encoding of v, see Marshal
+func NewOperationalMessage(v interface{}) (*fmtp.Message, error) {
+	b, err := Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return fmtp.NewOperationalMessage(bytes.NewReader(b))
+}
+
+// ReadMessage parses the ADEXP message carried by an FMTP message, consuming its body
+func ReadMessage(msg *fmtp.Message) (*Message, error) {
+	if msg.Typ() != fmtp.Operational {
+		return nil, errors.Errorf("ReadMessage: expected an Operational message, got %s", msg.Typ())
+	}
+	defer msg.Body.Close()
+	b, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(b)
+}
+
+// The HandlerFunc type is an adapter to allow the use of ordinary functions as FMTP handlers working on ADEXP messages.
+// The message carried by each received FMTP message is parsed and passed to the function,
+// if it can't be parsed, or if the message isn't Operational, the function is called with a nil message and the error.
+type HandlerFunc func(conn *fmtp.Conn, msg *Message, err error)
+
+// ServeFMTP calls hf with the parsed ADEXP message
+func (hf HandlerFunc) ServeFMTP(conn *fmtp.Conn, msg *fmtp.Message) {
+	m, err := ReadMessage(msg)
+	hf(conn, m, err)
+}
+
+// MatchTitle matches the FMTP Operational messages carrying an ADEXP message with one of the given titles, see fmtp.ServeMux
+func MatchTitle(titles ...string) fmtp.Matcher {
+	pred := func(b []byte) bool {
+		m, err := Parse(b)
+		if err != nil {
+			return false
+		}
+		title := m.Title()
+		for _, t := range titles {
+			if title == t {
+				return true
+			}
+		}
+		return false
+	}
+	return func(conn *fmtp.Conn, msg *fmtp.Message) bool {
+		return msg.Typ() == fmtp.Operational && fmtp.MatchPayload(pred)(conn, msg)
+	}
+}
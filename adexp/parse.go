@@ -0,0 +1,162 @@
+package adexp
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+)
+
+// item is a keyword along with its value, as found in the text
+type item struct {
+	name   string
+	value  string
+	offset int
+}
+
+// isKeywordChar reports whether c can be part of a keyword
+func isKeywordChar(c byte) bool {
+	return (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// isSpace reports whether c is whitespace
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// startsKeyword reports whether a keyword starts at position i of b
+// A keyword is a hyphen followed by an uppercase letter, at the beginning of the text or after whitespace.
+func startsKeyword(b []byte, i int) bool {
+	if b[i] != '-' || i+1 == len(b) || b[i+1] < 'A' || b[i+1] > 'Z' {
+		return false
+	}
+	return i == 0 || isSpace(b[i-1])
+}
+
+// tokenize splits the text into keywords and their values
+func tokenize(b []byte) ([]item, error) {
+	var (
+		items []item
+		pos   int
+	)
+
+	// Skip the leading whitespace, the text must then begin with a keyword
+	for pos < len(b) && isSpace(b[pos]) {
+		pos++
+	}
+	if pos < len(b) && !startsKeyword(b, pos) {
+		return nil, errors.Errorf("expected a keyword at offset %d", pos)
+	}
+
+	for pos < len(b) {
+		// Read the keyword
+		it := item{offset: pos}
+		pos++
+		start := pos
+		for pos < len(b) && isKeywordChar(b[pos]) {
+			pos++
+		}
+		it.name = string(b[start:pos])
+		if pos < len(b) && !isSpace(b[pos]) {
+			return nil, errors.Errorf("invalid character %q in keyword at offset %d", b[pos], pos)
+		}
+
+		// Read the value, up to the next keyword, collapsing whitespace
+		var value bytes.Buffer
+		for ; pos < len(b) && !startsKeyword(b, pos); pos++ {
+			c := b[pos]
+			switch {
+			case isSpace(c):
+				c = ' '
+			case c < 0x20 || c > 0x7e:
+				return nil, errors.Errorf("invalid character %q at offset %d", c, pos)
+			}
+			if c == ' ' && (value.Len() == 0 || value.Bytes()[value.Len()-1] == ' ') {
+				continue
+			}
+			value.WriteByte(c)
+		}
+		it.value = string(bytes.TrimRight(value.Bytes(), " "))
+		items = append(items, it)
+	}
+	return items, nil
+}
+
+// parser builds the field tree from the items
+type parser struct {
+	items []item
+	pos   int
+}
+
+// field parses the field starting at the current item
+func (p *parser) field() (*Field, error) {
+	it := p.items[p.pos]
+	p.pos++
+
+	switch {
+	// A list, parse up to the matching END
+	case it.name == "BEGIN":
+		if it.value == "" {
+			return nil, errors.Errorf("BEGIN without a list name at offset %d", it.offset)
+		}
+		f := &Field{Name: it.value, List: true}
+		for {
+			if p.pos == len(p.items) {
+				return nil, errors.Errorf("unterminated list %s opened at offset %d", it.value, it.offset)
+			}
+			if end := p.items[p.pos]; end.name == "END" {
+				if end.value != it.value {
+					return nil, errors.Errorf("END %s at offset %d doesn't match BEGIN %s", end.value, end.offset, it.value)
+				}
+				p.pos++
+				return f, nil
+			}
+			child, err := p.field()
+			if err != nil {
+				return nil, err
+			}
+			f.Fields = append(f.Fields, child)
+		}
+
+	case it.name == "END":
+		return nil, errors.Errorf("END %s at offset %d without a matching BEGIN", it.value, it.offset)
+
+	// A structured field, its subfields follow
+	case it.value == "" && structured[it.name] != nil:
+		f := &Field{Name: it.name}
+		subs := structured[it.name]
+		for p.pos < len(p.items) && subs[p.items[p.pos].name] {
+			child, err := p.field()
+			if err != nil {
+				return nil, err
+			}
+			f.Fields = append(f.Fields, child)
+		}
+		return f, nil
+
+	// A basic field
+	default:
+		return &Field{Name: it.name, Value: it.value}, nil
+	}
+}
+
+// Parse parses an ADEXP message
+func Parse(b []byte) (*Message, error) {
+	items, err := tokenize(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "adexp: invalid syntax")
+	}
+	if len(items) == 0 {
+		return nil, errors.New("adexp: empty message")
+	}
+
+	p := &parser{items: items}
+	m := &Message{}
+	for p.pos < len(p.items) {
+		f, err := p.field()
+		if err != nil {
+			return nil, errors.Wrap(err, "adexp: invalid syntax")
+		}
+		m.Fields = append(m.Fields, f)
+	}
+	return m, nil
+}
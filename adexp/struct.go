@@ -0,0 +1,240 @@
+package adexp
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// fieldInfo describes how a struct field maps to an ADEXP field
+type fieldInfo struct {
+	index int
+
+	// name is the ADEXP keyword
+	name string
+
+	// elem is the keyword of the elements of a list, if the field maps to a list
+	elem string
+}
+
+// structFields returns the mapping of a struct type's fields
+//
+// The mapping is given by the "adexp" struct tag, formatted as "NAME" or "NAME,elem=ELEM".
+// A field without a tag maps to its name in uppercase, a field tagged "-" is ignored.
+// A slice field with an elem option maps to the list NAME, whose elements are the ELEM fields.
+// A slice field without one maps to the repeated NAME fields.
+func structFields(t reflect.Type) []fieldInfo {
+	infos := make([]fieldInfo, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" { // unexported
+			continue
+		}
+		tag := sf.Tag.Get("adexp")
+		if tag == "-" {
+			continue
+		}
+		info := fieldInfo{index: i}
+		parts := strings.Split(tag, ",")
+		info.name = parts[0]
+		if info.name == "" {
+			info.name = strings.ToUpper(sf.Name)
+		}
+		for _, opt := range parts[1:] {
+			if strings.HasPrefix(opt, "elem=") {
+				info.elem = strings.TrimPrefix(opt, "elem=")
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// Marshal returns the ADEXP encoding of v, which must be a struct, a pointer to a struct, or a *Message
+//
+// Struct fields are mapped as described in structFields. Strings, integers, time.Time (see FormatTime) map to basic fields,
+// structs to structured fields. Zero values are omitted.
+func Marshal(v interface{}) ([]byte, error) {
+	if m, ok := v.(*Message); ok {
+		return m.MarshalText()
+	}
+	m, err := Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return m.MarshalText()
+}
+
+// Encode returns the message corresponding to v, see Marshal
+func Encode(v interface{}) (*Message, error) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return nil, errors.Errorf("adexp: cannot encode %T, expected a struct", v)
+	}
+	fields, err := encodeStruct(rv)
+	if err != nil {
+		return nil, errors.Wrap(err, "adexp")
+	}
+	return &Message{Fields: fields}, nil
+}
+
+// encodeStruct returns the fields corresponding to a struct
+func encodeStruct(rv reflect.Value) (Fields, error) {
+	var fields Fields
+	for _, info := range structFields(rv.Type()) {
+		fv := rv.Field(info.index)
+		if fv.IsZero() {
+			continue
+		}
+
+		// Slices map to a list or to repeated fields
+		if fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() != reflect.Uint8 {
+			var elems Fields
+			name := info.name
+			if info.elem != "" {
+				name = info.elem
+			}
+			for i := 0; i < fv.Len(); i++ {
+				f, err := encodeValue(name, fv.Index(i))
+				if err != nil {
+					return nil, err
+				}
+				elems = append(elems, f)
+			}
+			if info.elem != "" {
+				fields = append(fields, &Field{Name: info.name, Fields: elems, List: true})
+			} else {
+				fields = append(fields, elems...)
+			}
+			continue
+		}
+
+		f, err := encodeValue(info.name, fv)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// encodeValue returns the field with the given name holding the value
+func encodeValue(name string, v reflect.Value) (*Field, error) {
+	f := &Field{Name: name}
+	switch {
+	case v.Type() == timeType:
+		f.Value = FormatTime(v.Interface().(time.Time))
+	case v.Kind() == reflect.String:
+		f.Value = v.String()
+	case v.Kind() >= reflect.Int && v.Kind() <= reflect.Int64:
+		f.Value = strconv.FormatInt(v.Int(), 10)
+	case v.Kind() >= reflect.Uint && v.Kind() <= reflect.Uint64:
+		f.Value = strconv.FormatUint(v.Uint(), 10)
+	case v.Kind() == reflect.Struct:
+		fields, err := encodeStruct(v)
+		if err != nil {
+			return nil, err
+		}
+		f.Fields = fields
+	default:
+		return nil, errors.Errorf("field %s: unsupported type %s", name, v.Type())
+	}
+	return f, nil
+}
+
+// Unmarshal parses an ADEXP message and stores the result in the struct pointed to by v, see Marshal for the mapping
+// Fields of the message with no corresponding struct field are ignored.
+func Unmarshal(b []byte, v interface{}) error {
+	m, err := Parse(b)
+	if err != nil {
+		return err
+	}
+	return m.Decode(v)
+}
+
+// Decode stores the message's fields in the struct pointed to by v, see Unmarshal
+func (m *Message) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return errors.Errorf("adexp: cannot decode into %T, expected a pointer to a struct", v)
+	}
+	return errors.Wrap(decodeStruct(m.Fields, rv.Elem()), "adexp")
+}
+
+// decodeStruct stores the fields in a struct
+func decodeStruct(fields Fields, rv reflect.Value) error {
+	for _, info := range structFields(rv.Type()) {
+		fv := rv.Field(info.index)
+
+		// Slices map to a list or to repeated fields
+		if fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() != reflect.Uint8 {
+			elems := fields.All(info.name)
+			if info.elem != "" {
+				list := fields.Get(info.name)
+				if list == nil {
+					continue
+				}
+				if !list.List {
+					return errors.Errorf("field %s: expected a list", info.name)
+				}
+				elems = list.Fields.All(info.elem)
+			}
+			if len(elems) == 0 {
+				continue
+			}
+			slice := reflect.MakeSlice(fv.Type(), len(elems), len(elems))
+			for i, f := range elems {
+				if err := decodeValue(f, slice.Index(i)); err != nil {
+					return err
+				}
+			}
+			fv.Set(slice)
+			continue
+		}
+
+		f := fields.Get(info.name)
+		if f == nil {
+			continue
+		}
+		if err := decodeValue(f, fv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeValue stores a field's content in a value
+func decodeValue(f *Field, v reflect.Value) error {
+	switch {
+	case v.Type() == timeType:
+		t, err := f.Time()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(t))
+	case v.Kind() == reflect.String:
+		v.SetString(f.Value)
+	case v.Kind() >= reflect.Int && v.Kind() <= reflect.Int64:
+		i, err := strconv.ParseInt(f.Value, 10, v.Type().Bits())
+		if err != nil {
+			return errors.Wrapf(err, "field %s", f.Name)
+		}
+		v.SetInt(i)
+	case v.Kind() >= reflect.Uint && v.Kind() <= reflect.Uint64:
+		u, err := strconv.ParseUint(f.Value, 10, v.Type().Bits())
+		if err != nil {
+			return errors.Wrapf(err, "field %s", f.Name)
+		}
+		v.SetUint(u)
+	case v.Kind() == reflect.Struct:
+		return decodeStruct(f.Fields, v)
+	default:
+		return errors.Errorf("field %s: unsupported type %s", f.Name, v.Type())
+	}
+	return nil
+}
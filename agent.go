@@ -2,11 +2,9 @@ package fmtp
 
 import (
 	"context"
-	"fmt"
-	"io/ioutil"
 	"time"
 
-	"github.com/pkg/errors"
+	"github.com/aabizri/fmtp/clock"
 )
 
 // a command is what can be asked of the agent
@@ -26,24 +24,41 @@ const (
 
 // an order is what's given to the agent to execute commands/send messages
 type order struct {
-	command command
-	ctx     context.Context
-	done    chan error
-	msg     *Message
+	command  command
+	ctx      context.Context
+	done     chan error
+	msg      *Message
+	priority Priority
 }
 
 // order the agent to execute some command
 // this is synchroneous
-func (conn *Conn) order(ctx context.Context, command command) error {
-	done := make(chan error)
-	go func() {
-		conn.orders <- order{
-			command: command,
-			ctx:     ctx,
-			done:    done,
-		}
-	}()
+func (conn *Conn) order(ctx context.Context, command command, msg *Message) error {
+	return conn.orderPriority(ctx, command, msg, PriorityNormal)
+}
+
+// orderPriority is order, with the priority of the message to send
+func (conn *Conn) orderPriority(ctx context.Context, command command, msg *Message, priority Priority) error {
+	// The done channel is buffered, so that the agent never blocks on a caller that has given up
+	done := make(chan error, 1)
+	o := order{
+		command:  command,
+		ctx:      ctx,
+		done:     done,
+		msg:      msg,
+		priority: priority,
+	}
+
+	// Hand the order to the agent
+	select {
+	case conn.orders <- o:
+	case <-conn.closed:
+		return ErrConnectionClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 
+	// Wait for the result
 	select {
 	case err := <-done:
 		return err
@@ -53,8 +68,10 @@ func (conn *Conn) order(ctx context.Context, command command) error {
 }
 
 func handleSys(msg *Message) (ss *systemSig, err error) {
-	// Write to buffer
-	b, err := ioutil.ReadAll(msg.Body)
+	defer msg.release()
+
+	// Get the body
+	b, err := msg.Payload()
 	if err != nil {
 		return nil, err
 	}
@@ -65,151 +82,247 @@ func handleSys(msg *Message) (ss *systemSig, err error) {
 	return ss, err
 }
 
-// agent is the manager of a connection, it should implement a state machine with 6 states.
-// the states are
-// 	- idle (awaiting further instructions)
-// 	- connPending (connection pending)
-// 	- idPending (waiting for ID)
-// 	- ready (connection established)
-// 	- assPending (sent started, waiting for response)
-// 	- dataReady (association established, ready to send data)
+// stopTimer stops a timer and drains its channel, so that it can be safely reset
+func stopTimer(t clock.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C():
+		default:
+		}
+	}
+}
+
+// resetTimer (re)starts a timer with the given duration
+func resetTimer(t clock.Timer, d time.Duration) {
+	stopTimer(t)
+	t.Reset(d)
+}
+
+// agent is the manager of a connection, it drives the state machine once the connection is established.
+// See State for the states a connection can be in.
 //
-// TODO: Create a state machine with state functions
+// Once associated, two timers are running:
+//   - ts, after which a HEARTBEAT is sent, it is reset every time we send a message
+//   - tr, after which the association is shut down, it is reset every time we receive a message
 func (conn *Conn) agent() {
-	var (
-		// whether the connection is associated
-		associated bool
-		// Create the ts timer for heartbeats
-		ts = &time.Timer{}
-	)
+	// Create the ts timer for heartbeats and the tr timer for reception, both stopped until we associate
+	ts := conn.client.clock.NewTimer(conn.Ts)
+	stopTimer(ts)
+	tr := conn.client.clock.NewTimer(conn.Tr)
+	stopTimer(tr)
 
 	// Create the global context
 	ctx := context.Background()
 
 	// Launch the listener
 	inDone := make(chan struct{})
-	msgChan, errChan := inAgent(conn.tcp, inDone, 3)
+	msgChan, errChan := inAgent(conn.dec, inDone, 3, conn.received)
+
+	// Create the dispatcher handing the received messages to the handler
+	d := conn.client.newDispatcher(conn)
+
+	// Once associated, the timers are started and the queued messages are sent
+	onAssociated := func() {
+		resetTimer(tr, conn.Tr)
+		resetTimer(ts, conn.Ts)
+		err := conn.flushQueue()
+		if err != nil {
+			conn.log().Errorf("error while flushing queue: %v", err)
+			conn.handleErr(err)
+		}
+	}
+
+	// Whatever the reason we stop, the connection is released, cause being the reason if it isn't a local request
+	var cause error
+	defer func() {
+		stopTimer(ts)
+		stopTimer(tr)
+		conn.transitionCause(disconnectEvt, cause)
+		conn.disconnect(ctx)
+		conn.client.unregisterConn(conn)
+		d.close()
+		conn.stopWriter()
+		close(inDone)
+		close(conn.closed)
+	}()
 
 	// Event loop, checking for arrival & new orders
 	for {
 		select {
 		// If we received a message, we handle it
 		case msg := <-msgChan:
-			switch msg.header.typ {
+			// Any message received over the association resets tr, but those of a type it doesn't carry
+			typ := msg.header.typ
+			if conn.State() == DataReady && (typ == system || typ == Operator || typ == Operational) {
+				resetTimer(tr, conn.Tr)
+			}
+
+			switch typ {
 			// If it is a system message, we handle it
 			case system:
 				// Unmarshal
 				ss, err := handleSys(msg)
-				_ = err
+				if err != nil {
+					conn.log().Errorf("invalid system message received: %v", err)
+					conn.handleErr(err)
+					break
+				}
 
 				// Compare
 				switch {
 				case ss.equals(startup):
+					// If we are already associated, there is nothing to do
+					if conn.State() == DataReady {
+						break
+					}
 					err := conn.recvAssociate(ctx)
 					conn.handleErr(err)
-					associated = true
-					ts = time.NewTimer(conn.Tr)
+					if err == nil {
+						onAssociated()
+					}
 				case ss.equals(heartbeat):
-					// do something
+					if conn.transition(heartbeatRecvEvt) != nil {
+						conn.undefined("HEARTBEAT")
+						break
+					}
+					conn.client.metrics.HeartbeatReceived(conn.remote)
 				case ss.equals(shutdown):
-					associated = false
-					ts.Stop()
+					if conn.transition(shutdownRecvEvt) != nil {
+						conn.undefined("SHUTDOWN")
+						break
+					}
+					stopTimer(ts)
+					stopTimer(tr)
+					if conn.ShutdownNotify != nil {
+						conn.ShutdownNotify()
+					}
 				}
 			// If it is intended for the user, we pass it on
 			case Operator, Operational:
-				if !associated {
-					conn.Close()
-					return
-				}
-				if conn.Handler != nil {
-					conn.Handler.ServeFMTP(conn, msg)
+				// Data is only defined over an association
+				if conn.transition(dataRecvEvt) != nil {
+					conn.undefined(typ.String() + " message")
+					msg.release()
+					break
 				}
+				d.dispatch(msg)
+
+			// Anything else, such as a message of an unknown type, is discarded
+			default:
+				conn.log().With(Fields{FieldMsgType: typ.String()}).Warnf("unexpected message discarded")
+				msg.release()
 			}
 
 		// If we received an error, we evaluate it
 		case err := <-errChan:
-			conn.client.logger.Errorf("error in reception: %v", err)
+			conn.log().Errorf("error in reception: %v", err)
 			conn.handleErr(err)
-			conn.Close()
+			cause = err
 			return
 
 		// In case we get got an order, we process it
 		case o := <-conn.orders:
-			conn.client.logger.Debug("received new order")
+			conn.log().Debugf("received new order")
 			switch o.command {
 			case disconnectCmd:
+				conn.transition(disconnectEvt)
 				err := conn.disconnect(o.ctx)
 				o.done <- err
-				return // By returning we call cancel()
+				return
 			case associateCmd:
+				// If we are already associated, for example because the remote party's STARTUP crossed ours, there is nothing to do
+				if conn.State() == DataReady {
+					o.done <- nil
+					break
+				}
 				err := conn.initAssociate(o.ctx, msgChan)
 				if err == nil {
-					associated = true
-					ts = time.NewTimer(conn.Tr)
+					onAssociated()
 				}
 				o.done <- err
 			case deassociateCmd:
 				err := conn.deassociate(o.ctx)
 				if err == nil {
-					associated = false
+					stopTimer(ts)
+					stopTimer(tr)
 				}
 				o.done <- err
 			case sendCmd:
 				// If we're not associated, we do so
-				if !associated {
+				if conn.State() != DataReady {
 					err := conn.initAssociate(o.ctx, msgChan)
-					if err == nil {
-						associated = true
-						ts = time.NewTimer(conn.Tr)
+					if err != nil {
+						o.done <- err
+						break
 					}
+					onAssociated()
 				}
-				// We send
-				err := conn.send(o.ctx, o.msg)
-				// We send the result back
-				o.done <- err
-				// We reset ts
-				ts.Reset(conn.Ts)
+				// We reset ts, before handing the message over so that it is done once Send returns
+				resetTimer(ts, conn.Ts)
+				// We hand it to the writer, which reports the result back once written
+				conn.post(o.ctx, o.msg, o.priority, o.done)
 			}
 
 		// In case it's time to do a heartbeat, do it
-		case <-ts.C:
-			// If not associated, that's illegal
-			if !associated {
-				panic("HEARTBEAT TIMER ACTIVE EVEN THOUGH WE'RE NOT ASSOCIATED")
+		case <-ts.C():
+			// A HEARTBEAT is only due while associated, a stale expiry is ignored
+			if conn.State() != DataReady {
+				conn.log().Debugf("ts expired while not associated, ignoring")
+				break
 			}
+			conn.client.metrics.TimerExpired(conn.remote, TimerTs)
 
 			// Create a HEARTBEAT request
 			msg, err := newSystemMessage(heartbeat)
 			if err != nil {
-				fmt.Println(errors.Wrap(err, "Associate: error while creating system message"))
+				conn.log().Errorf("error while creating HEARTBEAT: %v", err)
+				conn.handleErr(err)
 				break
 			}
 
-			// Send it
-			err = conn.send(ctx, msg)
+			// Hand it to the writer without waiting for it to be written, the writer records the outcome
+			conn.post(ctx, msg, PriorityHigh, make(chan error, 1))
+
+			// Reset timer
+			ts.Reset(conn.Ts)
+
+		// In case nothing has been received for tr, the association is shut down
+		case <-tr.C():
+			err := conn.transition(trTimeoutEvt)
 			if err != nil {
-				fmt.Println(err)
 				break
 			}
+			conn.client.metrics.TimerExpired(conn.remote, TimerTr)
+			conn.log().Errorf("nothing received for %s, shutting down the association", conn.Tr)
+			stopTimer(ts)
 
-			// Reset timer
-			ts.Reset(conn.Ts)
+			// Send a SHUTDOWN to the remote party, as a courtesy, without waiting for it to be written
+			msg, err := newSystemMessage(shutdown)
+			if err == nil {
+				conn.post(ctx, msg, PriorityHigh, make(chan error, 1))
+			} else {
+				conn.log().Errorf("error while creating SHUTDOWN: %v", err)
+			}
+
+			// Report it to the user
+			conn.handleErr(ErrAssociationTimeoutExceeded)
 
-		// If we get a done signal, we close, but not before emptying the orders channel
+		// If we get a done signal, we stop, the pending orders will be notified that the connection is closed
 		case <-conn.done:
-			for {
-				select {
-				case o := <-conn.orders:
-					o.done <- errors.New("connection is closing")
-				default:
-					inDone <- struct{}{}
-					close(conn.orders)
-					return
-				}
-			}
+			return
 		}
 	}
 }
 
+// undefined logs the reception of a message that the state tables don't define in the current state.
+// As specified for their blank cells (5.3.4), it causes no transition nor anything visible to the user.
+func (conn *Conn) undefined(what string) {
+	conn.log().With(Fields{FieldState: conn.State().String()}).Warnf("%s received in a state it isn't defined for, ignoring", what)
+}
+
 // handleErr dispatches an error in the handling to the user
-func (conn *Conn) handleErr(err error) {}
+func (conn *Conn) handleErr(err error) {
+	if err != nil && conn.ErrorNotify != nil {
+		conn.ErrorNotify(err)
+	}
+}
@@ -1,12 +1,10 @@
 package fmtp
 
 import (
-	"bytes"
 	"context"
-	"io"
+	"fmt"
 
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 )
 
 var (
@@ -18,78 +16,96 @@ var (
 // initAssociate establishes an FMTP association, without locking !
 func (conn *Conn) initAssociate(ctx context.Context, recv <-chan *Message) error {
 	// Debug
-	logger := conn.client.logger.WithFields(logrus.Fields{
-		"addr":      conn.RemoteAddr().String(),
-		"remote ID": conn.RemoteID(),
-	})
-	logger.Debug("initAssociate called")
+	logger := conn.log()
+	logger.Debugf("initAssociate called")
 
-	logger.Debug("creating STARTUP request")
+	logger.Debugf("creating STARTUP request")
 	// Create a STARTUP request
 	msg, err := newSystemMessage(startup)
 	if err != nil {
 		return errors.Wrap(err, "Associate: error while creating system message")
 	}
 
-	logger.Debug("sending STARTUP request")
-	// Send it
-	err = conn.send(ctx, msg)
+	// We are now pending association
+	err = conn.transition(startupSentEvt)
 	if err != nil {
 		return err
 	}
-	logger.Debug("send successful, waiting for response")
-
-	// Wait for a STARTUP response
-	var reply *Message
-	select {
-	case reply = <-recv:
-	case <-ctx.Done():
-		return ctx.Err()
-	}
-	logger.Debug("response retrieved")
 
-	// Unmarshal it
-	buf := &bytes.Buffer{}
-	_, err = io.Copy(buf, reply.Body)
+	logger.Debugf("sending STARTUP request")
+	// Send it
+	err = conn.send(ctx, msg)
 	if err != nil {
+		conn.transition(assFailedEvt)
 		return err
 	}
-	ss := &systemSig{}
-	err = ss.UnmarshalBinary(buf.Bytes())
-	if err != nil {
-		return err
+	logger.Debugf("send successful, waiting for response")
+
+	// Wait for a STARTUP response, for at most tr, anything else being undefined while pending association
+	tr := conn.client.clock.NewTimer(conn.Tr)
+	defer tr.Stop()
+	for {
+		var reply *Message
+		select {
+		case reply = <-recv:
+		case <-tr.C():
+			conn.client.metrics.TimerExpired(conn.remote, TimerTr)
+			conn.transition(assFailedEvt)
+			return ErrAssociationTimeoutExceeded
+		case <-ctx.Done():
+			conn.transition(assFailedEvt)
+			return ctx.Err()
+		}
+		logger.Debugf("response retrieved")
+
+		if reply.Typ() != system {
+			conn.undefined(reply.Typ().String() + " message")
+			reply.release()
+			continue
+		}
+		ss, err := handleSys(reply)
+		if err != nil {
+			conn.transition(assFailedEvt)
+			return err
+		}
+		if ss.equals(startup) {
+			break
+		}
+		conn.undefined(fmt.Sprintf("system message %q", ss[:]))
 	}
 
-	// Check if its startup
-	if !ss.equals(startup) {
-		return errors.New("system message not startup")
+	// We are now associated
+	err = conn.transition(startupRecvEvt)
+	if err != nil {
+		return err
 	}
 
-	logger.Debug("connection initiated")
+	logger.Debugf("connection initiated")
 	return nil
 }
 
 // recvAssociate establishes an association requested by the peer, after the first STARTUP has been received.
 func (conn *Conn) recvAssociate(ctx context.Context) error {
-	conn.client.logger.Debug("recvAssociate called")
-	conn.client.logger.Debug("creating STARTUP")
+	logger := conn.log()
+	logger.Debugf("recvAssociate called")
+	logger.Debugf("creating STARTUP")
 	// Create a STARTUP request
 	msg, err := newSystemMessage(startup)
 	if err != nil {
 		return errors.Wrap(err, "Associate: error while creating system message")
 	}
-	conn.client.logger.Debug("STARTUP created")
+	logger.Debugf("STARTUP created")
 
-	conn.client.logger.Debug("sending STARTUP")
+	logger.Debugf("sending STARTUP")
 	// Send it
 	err = conn.send(ctx, msg)
 	if err != nil {
 		return err
 	}
-	conn.client.logger.Debug("STARTUP sent")
+	logger.Debugf("STARTUP sent")
 
-	// OK
-	return nil
+	// We are now associated
+	return conn.transition(startupRecvEvt)
 }
 
 // deassociate is the actual action taken by an agent when deassociating
@@ -103,5 +119,11 @@ func (conn *Conn) deassociate(ctx context.Context) error {
 	}
 
 	// Send it
-	return conn.send(ctx, msg)
+	err = conn.send(ctx, msg)
+	if err != nil {
+		return err
+	}
+
+	// We are not associated anymore
+	return conn.transition(shutdownSentEvt)
 }
@@ -0,0 +1,84 @@
+package fmtp
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+// benchSizes are the body sizes benchmarked, a small OLDI message and the compatibility maximum
+var benchSizes = []int{64, CompatBodyLen}
+
+// loopReader endlessly repeats a byte slice
+type loopReader struct {
+	b   []byte
+	off int
+}
+
+func (lr *loopReader) Read(p []byte) (int, error) {
+	n := copy(p, lr.b[lr.off:])
+	lr.off = (lr.off + n) % len(lr.b)
+	return n, nil
+}
+
+func BenchmarkEncode(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			payload := bytes.Repeat([]byte{'X'}, size)
+			r := bytes.NewReader(payload)
+			msg := mustMessage(NewOperationalMessage(r))
+			enc := NewEncoder(ioutil.Discard)
+
+			b.ReportAllocs()
+			b.SetBytes(int64(headerLen + size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r.Reset(payload)
+				if err := enc.Encode(msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			wire := encode(b, mustMessage(NewOperationalMessage(bytes.NewReader(make([]byte, size)))))
+			dec := NewDecoder(&loopReader{b: wire})
+			msg := &Message{}
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(wire)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := dec.Decode(msg); err != nil {
+					b.Fatal(err)
+				}
+				msg.release()
+			}
+		})
+	}
+}
+
+func BenchmarkReadFrom(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			wire := encode(b, mustMessage(NewOperationalMessage(bytes.NewReader(make([]byte, size)))))
+			r := bytes.NewReader(wire)
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(wire)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r.Reset(wire)
+				msg := &Message{}
+				if _, err := msg.ReadFrom(r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -2,14 +2,14 @@ package fmtp
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
-	"os"
 	"sync"
 
 	"time"
 
+	"github.com/aabizri/fmtp/clock"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 )
 
 // These are the default timer durations
@@ -19,22 +19,57 @@ const (
 	DefaultTr = 120 * time.Second
 )
 
+// ErrClientClosed is returned when using a client after a call to Close
+var ErrClientClosed = errors.New("client closed")
+
+// DefaultWriteQueueSize is the default number of messages waiting to be written per connection and priority
+const DefaultWriteQueueSize = 32
+
 // Client is what allows you to do FMTP requests.
 type Client struct {
 	dialer *net.Dialer
 	id     ID
 
-	// logger is the default logger
-	logger *logrus.Logger
+	// tlsConfig is the TLS configuration used when dialing, nil if TLS isn't used
+	tlsConfig *tls.Config
+
+	// certIDCheck indicates whether remote certificates should match the remote ID
+	certIDCheck bool
+
+	// logger is the client's logger, see SetLogger
+	logger Logger
 
 	// default timer durations
 	tiDuration time.Duration
 	tsDuration time.Duration
 	trDuration time.Duration
 
-	// currentConns map IDs to ongoing connections
+	// currentConns map IDs to ongoing connections, reserved holds the IDs of the inbound connections being identified
 	currentConnsMu sync.RWMutex
 	currentConns   map[ID]*Conn
+	reserved       map[ID]struct{}
+
+	// queues are the store-and-forward queues, queueOpts is nil if they are disabled
+	queueOpts *QueueOptions
+	queuesMu  sync.Mutex
+	queues    map[ID]*queue
+
+	// dispatchOpts configures the handler dispatch, pool is the shared worker pool for DispatchPool
+	dispatchOpts DispatchOptions
+	poolOnce     sync.Once
+	pool         *workQueue
+
+	// metrics is the metrics collector, see SetMetrics
+	metrics Metrics
+
+	// eventHook is called on every connection lifecycle event, see SetEventHook
+	eventHook func(Event)
+
+	// clock is the time source of the timers, see SetClock
+	clock clock.Clock
+
+	// writeQueueSize is the number of messages waiting to be written per connection and priority, see SetWriteQueueSize
+	writeQueueSize int
 }
 
 // registerConn registers a connection in the client
@@ -50,10 +85,34 @@ func (c *Client) registerConn(conn *Conn) error {
 		return errors.New("cannot register connection: already one with this ID")
 	}
 	c.currentConns[conn.remote] = conn
+	delete(c.reserved, conn.remote)
 
 	return nil
 }
 
+// reserveID reserves a remote ID for a connection being identified, until it is registered or released.
+// It returns false if there is already a connection, established or being identified, with this remote party.
+func (c *Client) reserveID(id ID) bool {
+	c.currentConnsMu.Lock()
+	defer c.currentConnsMu.Unlock()
+
+	if _, ok := c.currentConns[id]; ok {
+		return false
+	}
+	if _, ok := c.reserved[id]; ok {
+		return false
+	}
+	c.reserved[id] = struct{}{}
+	return true
+}
+
+// releaseID releases a reservation made with reserveID
+func (c *Client) releaseID(id ID) {
+	c.currentConnsMu.Lock()
+	defer c.currentConnsMu.Unlock()
+	delete(c.reserved, id)
+}
+
 // unregisterConn unregisters a connection in the client
 func (c *Client) unregisterConn(conn *Conn) error {
 	if conn.remote == "" {
@@ -63,7 +122,7 @@ func (c *Client) unregisterConn(conn *Conn) error {
 	c.currentConnsMu.Lock()
 	defer c.currentConnsMu.Unlock()
 
-	if _, ok := c.currentConns[conn.remote]; !ok {
+	if registered, ok := c.currentConns[conn.remote]; !ok || registered != conn {
 		return errors.New("cannot unregister connection: no such connection found")
 	}
 	delete(c.currentConns, conn.remote)
@@ -82,9 +141,10 @@ func SetDialer(dialer *net.Dialer) ClientSetter {
 }
 
 // SetTimers sets the timers
-// 	ti is the connection timer, it is only used when establishing connections
-// 	ts is the ...
-// 	tr is the ...
+//
+//	ti is the connection timer, it is only used when establishing connections
+//	ts is the heartbeat timer, a HEARTBEAT is sent when nothing has been sent over an association for ts
+//	tr is the reception timer, an association is shut down when nothing has been received over it for tr
 func SetTimers(ti, ts, tr time.Duration) ClientSetter {
 	return func(c *Client) error {
 		if ti != 0 {
@@ -100,6 +160,29 @@ func SetTimers(ti, ts, tr time.Duration) ClientSetter {
 	}
 }
 
+// SetClock sets the clock used by the timers (Ti, Ts and Tr), as well as for timestamps.
+// It defaults to clock.Real, a clock.Fake allows testing timer expiries deterministically.
+func SetClock(clk clock.Clock) ClientSetter {
+	return func(c *Client) error {
+		if clk == nil {
+			return errors.New("SetClock: given clock is nil, can't set")
+		}
+		c.clock = clk
+		return nil
+	}
+}
+
+// SetWriteQueueSize sets the number of messages waiting to be written per connection and priority, beyond which sending blocks
+func SetWriteQueueSize(size int) ClientSetter {
+	return func(c *Client) error {
+		if size < 0 {
+			return errors.New("SetWriteQueueSize: negative queue size")
+		}
+		c.writeQueueSize = size
+		return nil
+	}
+}
+
 // NewClient creates a new FMTP client
 func NewClient(id ID, setters ...ClientSetter) (*Client, error) {
 	// Validate the ID
@@ -110,17 +193,17 @@ func NewClient(id ID, setters ...ClientSetter) (*Client, error) {
 
 	// Create the default client
 	c := &Client{
-		id:     id,
-		dialer: &net.Dialer{},
-		logger: &logrus.Logger{
-			Out:       os.Stderr,
-			Level:     logrus.DebugLevel,
-			Formatter: new(logrus.TextFormatter),
-		},
-		tiDuration:   DefaultTi,
-		tsDuration:   DefaultTs,
-		trDuration:   DefaultTr,
-		currentConns: map[ID]*Conn{},
+		id:             id,
+		dialer:         &net.Dialer{},
+		logger:         defaultLogger(),
+		metrics:        nopMetrics{},
+		clock:          clock.Real,
+		tiDuration:     DefaultTi,
+		tsDuration:     DefaultTs,
+		trDuration:     DefaultTr,
+		writeQueueSize: DefaultWriteQueueSize,
+		currentConns:   map[ID]*Conn{},
+		reserved:       map[ID]struct{}{},
 	}
 
 	// Now apply the setters
@@ -134,17 +217,34 @@ func NewClient(id ID, setters ...ClientSetter) (*Client, error) {
 	return c, nil
 }
 
+// Close closes every connection of the client, then the files backing its store-and-forward queues.
+// The messages still queued are kept in the files, to be sent by the next client using the same directory.
+func (c *Client) Close() error {
+	c.currentConnsMu.RLock()
+	conns := make([]*Conn, 0, len(c.currentConns))
+	for _, conn := range c.currentConns {
+		conns = append(conns, conn)
+	}
+	c.currentConnsMu.RUnlock()
+
+	// Wait for the connections to be released, so that nothing is being flushed anymore
+	for _, conn := range conns {
+		conn.Close()
+		<-conn.closed
+	}
+	return c.closeQueues()
+}
+
 // Dial Connects and Associates with a remote FMTP responder
 //
 // FMTP dialing has two steps: first connect, then associate.
 func (c *Client) Dial(ctx context.Context, address string, id ID) (*Conn, error) {
 	// Debug
-	logger := c.logger.WithFields(
-		logrus.Fields{
-			"addr": address,
-			"id":   id,
-		})
-	logger.Debug("dialing")
+	logger := c.logger.With(Fields{
+		FieldRemoteAddr: address,
+		FieldRemoteID:   string(id),
+	})
+	logger.Debugf("dialing")
 
 	// Connect
 	conn, err := c.Connect(ctx, address, id)
@@ -152,7 +252,7 @@ func (c *Client) Dial(ctx context.Context, address string, id ID) (*Conn, error)
 		logger.Errorf("Connect failed: %v", err)
 		return nil, errors.Wrap(err, "Dial: error while establishing connection")
 	}
-	logger.Debug("Connect succeeded")
+	logger.Debugf("Connect succeeded")
 
 	// Associate
 	err = conn.Associate(ctx)
@@ -160,7 +260,7 @@ func (c *Client) Dial(ctx context.Context, address string, id ID) (*Conn, error)
 		logger.Errorf("Associate failed: %v", err)
 		return nil, errors.Wrap(err, "Dial: error while establishing association ")
 	}
-	logger.Debug("Associate succeeded")
+	logger.Debugf("Associate succeeded")
 
 	return conn, nil
 }
@@ -0,0 +1,92 @@
+// Package clock provides the time source used by the FMTP timers (Ti, Ts and Tr).
+//
+// Real is backed by the time package. Fake only moves forward when told to, so that
+// timer expiries can be tested deterministically, without waiting and without shortened timers.
+package clock
+
+import (
+	"context"
+	"time"
+)
+
+// Clock is a source of time and timers
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+
+	// NewTimer creates a new Timer that will send the current time on its channel after at least d
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the equivalent of a *time.Timer, see the time package for the semantics of its methods
+type Timer interface {
+	// C returns the channel on which the time is delivered
+	C() <-chan time.Time
+
+	// Stop prevents the Timer from firing, it reports whether the timer was active
+	Stop() bool
+
+	// Reset changes the timer to expire after d, it reports whether the timer was active
+	Reset(d time.Duration) bool
+}
+
+// Real is the clock backed by the time package
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (rt realTimer) C() <-chan time.Time {
+	return rt.t.C
+}
+
+func (rt realTimer) Stop() bool {
+	return rt.t.Stop()
+}
+
+func (rt realTimer) Reset(d time.Duration) bool {
+	return rt.t.Reset(d)
+}
+
+// Since returns the time elapsed since t according to the clock
+func Since(c Clock, t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// WithTimeout is the equivalent of context.WithTimeout, with the timeout measured by the clock.
+//
+// Once the timeout expires, the context is cancelled and its Err returns context.Canceled,
+// unless the clock is Real in which case it is exactly context.WithTimeout.
+func WithTimeout(parent context.Context, c Clock, d time.Duration) (context.Context, context.CancelFunc) {
+	if c == Real {
+		return context.WithTimeout(parent, d)
+	}
+
+	// Create a cancellable context, and cancel it once the timer fires
+	ctx, cancel := context.WithCancel(parent)
+	t := c.NewTimer(d)
+	go func() {
+		select {
+		case <-t.C():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// Cancelling stops the timer right away, so that it doesn't linger
+	return ctx, func() {
+		t.Stop()
+		cancel()
+	}
+}
@@ -0,0 +1,134 @@
+package clock
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// fired reports whether the timer has fired, without blocking
+func fired(t Timer) bool {
+	select {
+	case <-t.C():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestFakeAdvance(t *testing.T) {
+	f := NewFake(epoch)
+	timer := f.NewTimer(10 * time.Second)
+
+	f.Advance(9 * time.Second)
+	if fired(timer) {
+		t.Fatal("timer fired before its deadline")
+	}
+	if got := f.Now(); !got.Equal(epoch.Add(9 * time.Second)) {
+		t.Fatalf("unexpected time %v", got)
+	}
+
+	f.Advance(time.Second)
+	select {
+	case at := <-timer.C():
+		if !at.Equal(epoch.Add(10 * time.Second)) {
+			t.Errorf("timer fired with time %v", at)
+		}
+	default:
+		t.Fatal("timer didn't fire at its deadline")
+	}
+	if n := f.Timers(); n != 0 {
+		t.Errorf("expected no active timers, got %d", n)
+	}
+}
+
+func TestFakeFiresInOrder(t *testing.T) {
+	f := NewFake(epoch)
+	late := f.NewTimer(2 * time.Minute)
+	early := f.NewTimer(time.Minute)
+
+	// A single advance fires both, each with its own deadline
+	f.Advance(time.Hour)
+	if at := <-early.C(); !at.Equal(epoch.Add(time.Minute)) {
+		t.Errorf("early timer fired with time %v", at)
+	}
+	if at := <-late.C(); !at.Equal(epoch.Add(2 * time.Minute)) {
+		t.Errorf("late timer fired with time %v", at)
+	}
+	if got := f.Now(); !got.Equal(epoch.Add(time.Hour)) {
+		t.Errorf("unexpected time %v", got)
+	}
+}
+
+func TestFakeStopReset(t *testing.T) {
+	f := NewFake(epoch)
+	timer := f.NewTimer(time.Second)
+
+	if !timer.Stop() {
+		t.Error("Stop on an active timer should report true")
+	}
+	if timer.Stop() {
+		t.Error("Stop on a stopped timer should report false")
+	}
+	f.Advance(time.Minute)
+	if fired(timer) {
+		t.Fatal("stopped timer fired")
+	}
+
+	// Reset is relative to the current time
+	if timer.Reset(time.Second) {
+		t.Error("Reset on a stopped timer should report false")
+	}
+	if !timer.Reset(2 * time.Second) {
+		t.Error("Reset on an active timer should report true")
+	}
+	f.Advance(time.Second)
+	if fired(timer) {
+		t.Fatal("reset timer fired before its new deadline")
+	}
+	f.Advance(time.Second)
+	if !fired(timer) {
+		t.Fatal("reset timer didn't fire at its new deadline")
+	}
+}
+
+func TestFakeBlockUntil(t *testing.T) {
+	f := NewFake(epoch)
+	done := make(chan struct{})
+	go func() {
+		f.BlockUntil(2)
+		close(done)
+	}()
+
+	f.NewTimer(time.Second)
+	select {
+	case <-done:
+		t.Fatal("BlockUntil returned with a single timer active")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	f.NewTimer(time.Second)
+	<-done
+}
+
+func TestWithTimeout(t *testing.T) {
+	f := NewFake(epoch)
+	ctx, cancel := WithTimeout(context.Background(), f, time.Minute)
+	defer cancel()
+
+	f.Advance(time.Minute - time.Nanosecond)
+	if ctx.Err() != nil {
+		t.Fatal("context done before its timeout")
+	}
+	f.Advance(time.Nanosecond)
+	<-ctx.Done()
+
+	// Cancelling stops the timer right away
+	_, cancel = WithTimeout(context.Background(), f, time.Minute)
+	cancel()
+	if n := f.Timers(); n != 0 {
+		t.Errorf("expected no active timers after cancel, got %d", n)
+	}
+}
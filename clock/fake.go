@@ -0,0 +1,135 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Fake is a Clock whose time only moves when Advance or Set is called.
+//
+// Timers created by a Fake fire, in order of expiry, when the time reaches their deadline.
+// As the timers are usually armed by other goroutines, BlockUntil allows waiting for them to be armed before advancing.
+// It is safe for concurrent use.
+type Fake struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers map[*fakeTimer]struct{}
+}
+
+// NewFake creates a new fake clock set at the given time
+func NewFake(now time.Time) *Fake {
+	f := &Fake{now: now, timers: map[*fakeTimer]struct{}{}}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+// Now returns the current fake time
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// NewTimer creates a new Timer firing once the fake time has advanced by d
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{f: f, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the fake time forward by d, firing the timers expiring in the meantime
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.advanceLocked(f.now.Add(d))
+}
+
+// Set moves the fake time forward to t, firing the timers expiring in the meantime.
+// If t is before the current time, nothing is done.
+func (f *Fake) Set(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if t.After(f.now) {
+		f.advanceLocked(t)
+	}
+}
+
+// Timers returns the number of timers currently active
+func (f *Fake) Timers() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.timers)
+}
+
+// BlockUntil blocks until at least n timers are active
+func (f *Fake) BlockUntil(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.timers) < n {
+		f.cond.Wait()
+	}
+}
+
+// advanceLocked fires the expired timers one by one, in order of expiry, until the time reaches target
+func (f *Fake) advanceLocked(target time.Time) {
+	for {
+		// Find the next timer to expire
+		var next *fakeTimer
+		for t := range f.timers {
+			if !t.deadline.After(target) && (next == nil || t.deadline.Before(next.deadline)) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+
+		// Fire it at its deadline
+		f.now = next.deadline
+		f.fireLocked(next)
+	}
+	f.now = target
+}
+
+// fireLocked fires a timer, deactivating it
+func (f *Fake) fireLocked(t *fakeTimer) {
+	delete(f.timers, t)
+	select {
+	case t.c <- f.now:
+	default:
+	}
+	f.cond.Broadcast()
+}
+
+type fakeTimer struct {
+	f        *Fake
+	c        chan time.Time
+	deadline time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.f.mu.Lock()
+	defer t.f.mu.Unlock()
+	_, active := t.f.timers[t]
+	delete(t.f.timers, t)
+	t.f.cond.Broadcast()
+	return active
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.f.mu.Lock()
+	defer t.f.mu.Unlock()
+	_, active := t.f.timers[t]
+	t.deadline = t.f.now.Add(d)
+	t.f.timers[t] = struct{}{}
+	if d <= 0 {
+		t.f.fireLocked(t)
+	}
+	t.f.cond.Broadcast()
+	return active
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"runtime/pprof"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/aabizri/fmtp"
 	"github.com/urfave/cli"
@@ -28,6 +32,11 @@ var flags = []cli.Flag{
 		Value: "127.0.0.1:8050",
 		Usage: "address to listen to",
 	},
+	cli.DurationFlag{
+		Name:  "grace",
+		Value: 10 * time.Second,
+		Usage: "how long to wait for connections to close when shutting down",
+	},
 }
 
 func main() {
@@ -76,7 +85,7 @@ func action(c *cli.Context) error {
 	})
 
 	// Create the server and its handlers
-	srv := client.NewServer(addr, handler)
+	srv := client.NewServer(addr, fmtp.Chain(handler, fmtp.Recover(nil)))
 	srv.AcceptTCP = func(addr net.Addr) bool {
 		fmt.Printf("Server> received new TCP connection from %s\n", addr)
 		return true
@@ -84,5 +93,23 @@ func action(c *cli.Context) error {
 	srv.NotifyConn = func(addr net.Addr, rem fmtp.ID) {
 		fmt.Printf("Server> connection established with %s (%s)", rem, addr)
 	}
-	return srv.ListenAndServe()
+
+	// Shutdown gracefully when asked to
+	grace := c.Duration("grace")
+	shutdown := make(chan error, 1)
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		fmt.Println("Server> shutting down...")
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+		shutdown <- srv.Shutdown(ctx)
+	}()
+
+	err = srv.ListenAndServe()
+	if err != fmtp.ErrServerClosed {
+		return err
+	}
+	return <-shutdown
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/aabizri/fmtp"
+	"github.com/aabizri/fmtp/fmtpsim"
+	"github.com/urfave/cli"
+)
+
+var flags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "addr",
+		Value: "127.0.0.1:" + fmtp.ListeningPort,
+		Usage: "address to dial for initiator scenarios, and to listen to for responder ones",
+	},
+	cli.StringFlag{
+		Name:  "local",
+		Usage: "ID of the simulator, overriding the scenarios'",
+	},
+	cli.StringFlag{
+		Name:  "remote",
+		Usage: "ID of the system under test, overriding the scenarios'",
+	},
+	cli.DurationFlag{
+		Name:  "timeout",
+		Value: 5 * time.Minute,
+		Usage: "maximum duration of a scenario",
+	},
+	cli.BoolFlag{
+		Name:  "verbose",
+		Usage: "log every step and every message received",
+	},
+}
+
+func main() {
+	app := cli.NewApp()
+	app.Name = "fmtpsim"
+	app.Usage = "Play FMTP peer scenarios against a system under test"
+	app.ArgsUsage = "scenario.json..."
+	app.Flags = flags
+	app.Action = action
+
+	err := app.Run(os.Args)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func action(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return fmt.Errorf("no scenario given")
+	}
+
+	// Load the scenarios
+	scenarios := make([]*fmtpsim.Scenario, 0, c.NArg())
+	for _, path := range c.Args() {
+		sc, err := fmtpsim.LoadFile(path)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if local := c.String("local"); local != "" {
+			sc.Local = fmtp.ID(local)
+		}
+		if remote := c.String("remote"); remote != "" {
+			sc.Remote = fmtp.ID(remote)
+		}
+		scenarios = append(scenarios, sc)
+	}
+
+	// Play them in order
+	var (
+		l      net.Listener
+		failed int
+	)
+	defer func() {
+		if l != nil {
+			l.Close()
+		}
+	}()
+	for _, sc := range scenarios {
+		ctx, cancel := context.WithTimeout(context.Background(), c.Duration("timeout"))
+		err := play(ctx, c, sc, &l)
+		cancel()
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL\t%s: %v\n", sc.Name, err)
+		} else {
+			fmt.Printf("PASS\t%s\n", sc.Name)
+		}
+	}
+
+	if failed != 0 {
+		return cli.NewExitError(fmt.Sprintf("%d/%d scenarios failed", failed, len(scenarios)), 1)
+	}
+	return nil
+}
+
+// play establishes the connection with the system under test according to the role, then plays the scenario
+// The listener is created the first time it is needed, and reused afterwards.
+func play(ctx context.Context, c *cli.Context, sc *fmtpsim.Scenario, l *net.Listener) error {
+	addr := c.String("addr")
+
+	// Connect
+	var (
+		conn net.Conn
+		err  error
+	)
+	switch sc.Role {
+	case fmtpsim.Initiator:
+		dialer := &net.Dialer{}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	case fmtpsim.Responder:
+		if *l == nil {
+			*l, err = net.Listen("tcp", addr)
+			if err != nil {
+				return err
+			}
+		}
+		fmt.Printf("waiting for a connection on %s...\n", addr)
+		conn, err = (*l).Accept()
+	}
+	if err != nil {
+		return err
+	}
+
+	// Play
+	var logf func(format string, args ...interface{})
+	if c.Bool("verbose") {
+		logf = func(format string, args ...interface{}) {
+			fmt.Printf("\t"+format+"\n", args...)
+		}
+	}
+	return fmtpsim.Run(ctx, sc, conn, logf)
+}
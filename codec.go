@@ -0,0 +1,255 @@
+// in codec.go are the Decoder and Encoder framing messages over a stream
+
+package fmtp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// errBodyTooLarge is returned when encoding a message whose body is larger than MaxBodyLen
+var errBodyTooLarge = errors.New("Encode: cannot write message as body is larger than MaxBodyLen")
+
+// FramingError is returned when a message cannot be extracted from a stream, which is then desynchronised
+type FramingError struct {
+	// Offset is the position in the stream of the first byte of the faulty message
+	Offset int64
+
+	// Err is the cause of the failure
+	Err error
+}
+
+func (fe *FramingError) Error() string {
+	return fmt.Sprintf("framing error in message at offset %d: %v", fe.Offset, fe.Err)
+}
+
+// Cause returns the cause of the failure, for use with errors.Cause
+func (fe *FramingError) Cause() error {
+	return fe.Err
+}
+
+// A Decoder reads messages from a stream, buffering it so that partial reads are reassembled.
+//
+// As it may read ahead, a stream must be read through a single Decoder.
+// The bodies it decodes are held in pooled buffers, closing a Body gives its buffer back.
+type Decoder struct {
+	r io.Reader
+
+	// off is the number of bytes consumed so far
+	off int64
+
+	// err is the framing error after which nothing can be decoded anymore
+	err error
+
+	// hdr holds the header being read
+	hdr [headerLen]byte
+
+	// pooled is true if the bodies are lent from the buffer pools rather than allocated
+	pooled bool
+}
+
+// NewDecoder returns a new decoder reading from r
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReaderSize(r, maxLength), pooled: true}
+}
+
+// InputOffset returns the number of bytes consumed so far, which is the offset of the next message
+func (dec *Decoder) InputOffset() int64 {
+	return dec.off
+}
+
+// Decode reads the next message into msg, reusing its header if any.
+//
+// If the stream ends cleanly between two messages, io.EOF is returned.
+// If it ends within a message, or if a header is invalid, a *FramingError is returned, as will every following call.
+func (dec *Decoder) Decode(msg *Message) error {
+	if dec.err != nil {
+		return dec.err
+	}
+	start := dec.off
+
+	// Read the header
+	n, err := io.ReadFull(dec.r, dec.hdr[:])
+	dec.off += int64(n)
+	switch {
+	case err == io.EOF:
+		return err
+	case err == io.ErrUnexpectedEOF:
+		return dec.fail(start, errors.Errorf("truncated header, %d of %d bytes read", n, headerLen))
+	case err != nil:
+		return err
+	}
+	h := msg.header
+	if h == nil {
+		h = &header{}
+	}
+	err = h.UnmarshalBinary(dec.hdr[:])
+	if err != nil {
+		return dec.fail(start, err)
+	}
+
+	// Read the body given the header-indicated size
+	var (
+		content []byte
+		body    io.ReadCloser
+	)
+	if dec.pooled {
+		lb := newLentBody(h.bodyLen())
+		content, body = lb.b, lb
+	} else {
+		content = make([]byte, h.bodyLen())
+		body = &bufferedBody{Reader: bytes.NewReader(content), b: content}
+	}
+	n, err = io.ReadFull(dec.r, content)
+	dec.off += int64(n)
+	if err != nil {
+		body.Close()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return dec.fail(start, errors.Errorf("truncated body, %d of %d bytes read", n, len(content)))
+		}
+		return err
+	}
+
+	// Assign
+	msg.header = h
+	msg.Body = body
+	return nil
+}
+
+// fail records a framing error for the message starting at the given offset
+func (dec *Decoder) fail(start int64, err error) error {
+	dec.err = &FramingError{Offset: start, Err: err}
+	return dec.err
+}
+
+// An Encoder writes messages to a stream, each with a single Write so that the messages written concurrently to the
+// same stream by several encoders aren't interleaved, nor split across TLS records.
+//
+// Over the TCP connections, the header and a body held in memory are written with a single vectored write.
+// Over any other stream, they are first copied together into a pooled buffer.
+type Encoder struct {
+	w io.Writer
+
+	// writev is set when net.Buffers writes to w with a single vectored write
+	writev bool
+
+	// hdr holds the header being written, vec and bufs the buffers of the vectored write
+	hdr  [headerLen]byte
+	vec  [2][]byte
+	bufs net.Buffers
+}
+
+// NewEncoder returns a new encoder writing to w
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w, writev: vectored(w)}
+}
+
+// vectored reports whether net.Buffers writes to w with a single writev, which only the connections of the net package support
+func vectored(w io.Writer) bool {
+	switch w.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return true
+	default:
+		return false
+	}
+}
+
+// Encode writes a message, consuming its Body
+func (enc *Encoder) Encode(msg *Message) error {
+	_, err := enc.encode(msg)
+	return err
+}
+
+// encode writes a message, returning the number of bytes written
+func (enc *Encoder) encode(msg *Message) (int64, error) {
+	// Check if message is valid
+	if msg.header == nil {
+		return 0, errors.New("Encode: cannot write message as header is nil")
+	}
+	defer msg.Body.Close()
+
+	// Get the body, directly if it is held in memory, else read into a pooled buffer right after the header.
+	// frame is the whole message, when header and body are contiguous.
+	var (
+		hdr   = enc.hdr[:]
+		body  []byte
+		frame []byte
+	)
+	switch b := msg.Body.(type) {
+	case *lentBody:
+		body = b.b[len(b.b)-b.Len():]
+	case *bufferedBody:
+		body = b.b[len(b.b)-b.Len():]
+	default:
+		buf := getBuf(maxLength)
+		defer putBuf(buf)
+		n, err := readBody(msg.Body, (*buf)[headerLen:])
+		if err != nil {
+			return 0, err
+		}
+		frame = (*buf)[:headerLen+n]
+	}
+
+	// Its length must fit in the header
+	if len(body) > MaxBodyLen {
+		return 0, errBodyTooLarge
+	}
+
+	// Without vectored writes, copy the body after the header
+	if frame == nil && !enc.writev {
+		buf := getBuf(headerLen + len(body))
+		defer putBuf(buf)
+		frame = (*buf)[:headerLen+len(body)]
+		copy(frame[headerLen:], body)
+	}
+	if frame != nil {
+		hdr, body = frame[:headerLen], frame[headerLen:]
+	}
+
+	// Set the correct body length in the header, and marshal it
+	msg.header.setBodyLen(uint16(len(body)))
+	err := msg.header.put(hdr)
+	if err != nil {
+		return 0, err
+	}
+
+	// Write both at once
+	if frame != nil {
+		n, err := enc.w.Write(frame)
+		return int64(n), err
+	}
+	enc.vec = [2][]byte{hdr, body}
+	enc.bufs = enc.vec[:]
+	if len(body) == 0 {
+		enc.bufs = enc.vec[:1]
+	}
+	n, err := enc.bufs.WriteTo(enc.w)
+	enc.vec = [2][]byte{}
+	return n, err
+}
+
+// readBody reads a body into b until EOF, failing if it is larger than MaxBodyLen
+func readBody(r io.Reader, b []byte) (int, error) {
+	n, err := io.ReadFull(r, b[:MaxBodyLen])
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		return n, nil
+	case nil:
+		// The buffer is full, the body must end here
+		var extra [1]byte
+		m, err := io.ReadFull(r, extra[:])
+		if m != 0 {
+			return n, errBodyTooLarge
+		} else if err != io.EOF {
+			return n, err
+		}
+		return n, nil
+	default:
+		return n, err
+	}
+}
@@ -0,0 +1,253 @@
+package fmtp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/pkg/errors"
+)
+
+// stream returns the wire form of an identification request, a STARTUP and an operator message, with their offsets
+func stream(t *testing.T) ([]byte, []int64) {
+	msgs := []*Message{
+		mustMessage(newIDRequestMessage("PEER", "SUT")),
+		mustMessage(newSystemMessage(startup)),
+		mustMessage(NewOperatorMessageString("hello")),
+	}
+	var (
+		b    []byte
+		offs []int64
+	)
+	for _, msg := range msgs {
+		offs = append(offs, int64(len(b)))
+		b = append(b, encode(t, msg)...)
+	}
+	return b, offs
+}
+
+// bodies decodes every message until the end of the stream, returning their bodies
+func bodies(t *testing.T, dec *Decoder) []string {
+	var out []string
+	for {
+		msg := &Message{}
+		err := dec.Decode(msg)
+		if err == io.EOF {
+			return out
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(msg.Body)
+		out = append(out, string(b))
+	}
+}
+
+func TestDecoderShortReads(t *testing.T) {
+	b, _ := stream(t)
+	readers := map[string]func(io.Reader) io.Reader{
+		"one byte": iotest.OneByteReader,
+		"half":     iotest.HalfReader,
+		"data err": iotest.DataErrReader,
+	}
+	for name, wrap := range readers {
+		t.Run(name, func(t *testing.T) {
+			dec := NewDecoder(wrap(bytes.NewReader(b)))
+			got := bodies(t, dec)
+			want := []string{"PEER-SUT", "01", "hello"}
+			if len(got) != len(want) {
+				t.Fatalf("expected %q, got %q", want, got)
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Errorf("message %d: expected %q, got %q", i, want[i], got[i])
+				}
+			}
+			if dec.InputOffset() != int64(len(b)) {
+				t.Errorf("expected offset %d, got %d", len(b), dec.InputOffset())
+			}
+		})
+	}
+}
+
+func TestReadFromShortReads(t *testing.T) {
+	b, offs := stream(t)
+	ends := append(offs[1:], int64(len(b)))
+	r := iotest.OneByteReader(bytes.NewReader(b))
+	for i, off := range offs {
+		msg := &Message{}
+		n, err := msg.ReadFrom(r)
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if n != ends[i]-off {
+			t.Errorf("message %d: expected %d bytes read, got %d", i, ends[i]-off, n)
+		}
+	}
+}
+
+func TestDecoderFramingErrors(t *testing.T) {
+	b, offs := stream(t)
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"truncated header", b[:offs[1]+3]},
+		{"truncated body", b[:offs[2]-1]},
+		{"length too small", append(b[:offs[1]:offs[1]], 2, 0, 0, 4, 4)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dec := NewDecoder(iotest.OneByteReader(bytes.NewReader(test.b)))
+			if err := dec.Decode(&Message{}); err != nil {
+				t.Fatal(err)
+			}
+			err := dec.Decode(&Message{})
+			fe, ok := err.(*FramingError)
+			if !ok {
+				t.Fatalf("expected a *FramingError, got %v", err)
+			}
+			if fe.Offset != offs[1] {
+				t.Errorf("expected offset %d, got %d", offs[1], fe.Offset)
+			}
+			if errors.Cause(err) != fe.Err {
+				t.Errorf("expected the cause to be %v, got %v", fe.Err, errors.Cause(err))
+			}
+
+			// The stream is desynchronised, the error sticks
+			if err := dec.Decode(&Message{}); err != fe {
+				t.Errorf("expected %v again, got %v", fe, err)
+			}
+		})
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+	big := bytes.Repeat([]byte{'X'}, MaxBodyLen)
+	msgs := []*Message{
+		mustMessage(newIDRequestMessage("PEER", "SUT")),
+		mustMessage(NewOperationalMessage(bytes.NewReader(big))),
+		mustMessage(NewOperatorMessage(iotest.OneByteReader(strings.NewReader("hello")))),
+	}
+	for _, msg := range msgs {
+		if err := enc.Encode(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := bodies(t, NewDecoder(iotest.OneByteReader(buf)))
+	if len(got) != 3 || got[0] != "PEER-SUT" || got[1] != string(big) || got[2] != "hello" {
+		t.Errorf("unexpected messages decoded back")
+	}
+}
+
+// writes counts the writes made to it
+type writes struct {
+	bytes.Buffer
+	n int
+}
+
+func (w *writes) Write(b []byte) (int, error) {
+	w.n++
+	return w.Buffer.Write(b)
+}
+
+// TestEncoderSingleWrite checks that a message is written with a single Write over a stream without vectored writes
+func TestEncoderSingleWrite(t *testing.T) {
+	b, _ := stream(t)
+	lent := &Message{}
+	if err := NewDecoder(bytes.NewReader(b)).Decode(lent); err != nil {
+		t.Fatal(err)
+	}
+	buffered := mustMessage(NewOperatorMessageString("buffered"))
+	buffered.Payload()
+	msgs := map[string]*Message{
+		"lent":     lent,
+		"buffered": buffered,
+		"reader":   mustMessage(NewOperatorMessage(iotest.OneByteReader(strings.NewReader("reader")))),
+		"empty":    mustMessage(NewOperatorMessageString("")),
+	}
+	for name, msg := range msgs {
+		t.Run(name, func(t *testing.T) {
+			w := &writes{}
+			if err := NewEncoder(w).Encode(msg); err != nil {
+				t.Fatal(err)
+			}
+			if w.n != 1 {
+				t.Errorf("expected a single write, got %d", w.n)
+			}
+			if got := bodies(t, NewDecoder(&w.Buffer)); len(got) != 1 {
+				t.Errorf("expected a message, got %d", len(got))
+			}
+		})
+	}
+}
+
+func TestEncoderTooLarge(t *testing.T) {
+	big := make([]byte, MaxBodyLen+1)
+	tests := []struct {
+		name string
+		body io.ReadCloser
+	}{
+		{"streamed", ioutil.NopCloser(iotest.HalfReader(bytes.NewReader(big)))},
+		{"buffered", &bufferedBody{Reader: bytes.NewReader(big), b: big}},
+		{"lent", newLentBody(len(big))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg := &Message{header: newHeader(Operator), Body: test.body}
+			buf := &bytes.Buffer{}
+			if err := NewEncoder(buf).Encode(msg); err != errBodyTooLarge {
+				t.Fatalf("expected %v, got %v", errBodyTooLarge, err)
+			}
+			if buf.Len() != 0 {
+				t.Errorf("expected nothing written, got %d bytes", buf.Len())
+			}
+		})
+	}
+}
+
+func TestPayloadTooLarge(t *testing.T) {
+	msg := mustMessage(NewOperatorMessage(iotest.HalfReader(bytes.NewReader(make([]byte, 2*MaxBodyLen)))))
+	if _, err := msg.Payload(); err == nil {
+		t.Fatal("expected an error")
+	}
+	if err := NewEncoder(ioutil.Discard).Encode(msg); err != errBodyTooLarge {
+		t.Errorf("expected %v, got %v", errBodyTooLarge, err)
+	}
+}
+
+func TestLentBody(t *testing.T) {
+	b, _ := stream(t)
+	dec := NewDecoder(bytes.NewReader(b))
+	msg := &Message{}
+	if err := dec.Decode(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msg.Body.(*lentBody); !ok {
+		t.Fatalf("expected a lent body, got %T", msg.Body)
+	}
+	if p, _ := msg.Payload(); string(p) != "PEER-SUT" {
+		t.Errorf("unexpected payload %q", p)
+	}
+
+	// Once released, the body is empty and releasing it again is harmless
+	msg.release()
+	msg.release()
+	if p, _ := msg.Payload(); len(p) != 0 {
+		t.Errorf("expected an empty payload once released, got %q", p)
+	}
+
+	// The header is reused by the next message
+	h := msg.header
+	if err := dec.Decode(msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.header != h || msg.Typ() != system {
+		t.Errorf("expected the header to be reused")
+	}
+}
@@ -0,0 +1,594 @@
+package fmtp_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aabizri/fmtp"
+	"github.com/aabizri/fmtp/clock"
+	"github.com/aabizri/fmtp/fmtpsim"
+	"github.com/aabizri/fmtp/fmtptest"
+)
+
+// The conformance suite checks the implementation against the procedures of the FMTP v2.0 specification
+// (docs/20070614-fmtp-spec-v2.0.pdf), every test naming the section it covers.
+//
+// The system under test, "SUT", is either an fmtp.Conn facing a scripted peer (see fmtpsim), or two fmtp.Clients
+// facing each other (see fmtptest), all over in-memory connections.
+var conformance = []struct {
+	section string
+	name    string
+	test    func(t *testing.T)
+}{
+	{"4.2.1", "initiator identification", testInitiatorIdentification},
+	{"4.2.1", "responder identification", testResponderIdentification},
+	{"2.2.3 a", "initiator rejects an unexpected sender", testInitiatorIDMismatch},
+	{"2.2.3 a", "responder rejects an unexpected receiver", testResponderIDMismatch},
+	{"2.2.3 b", "responder rejects a second connection", testDuplicateConnection},
+	{"2.2.3 b", "responder rejects a simultaneous connection", testSimultaneousConnection},
+	{"3.4.2", "initiator handles REJECT", testInitiatorRejected},
+	{"4.2.1 c", "Ti expiry on the initiator", testInitiatorTi},
+	{"4.2.1 b", "Ti expiry on the responder", testResponderTi},
+	{"4.3.1", "association", testAssociation},
+	{"4.3.1", "STARTUP collision", testStartupCollision},
+	{"4.5.1", "SHUTDOWN handling", testShutdown},
+	{"4.5.2", "re-association after SHUTDOWN", testReassociation},
+	{"4.6.1", "connection release", testConnectionRelease},
+	{"5.3.4", "undefined events are ignored", testUndefinedEvents},
+	{"4.8.2", "heartbeat cadence", testHeartbeatCadence},
+	{"4.8.2", "data resets Ts", testDataResetsTs},
+	{"4.8.3", "Tr expiry", testTrExpiry},
+	{"4.8.3", "HEARTBEATs reset Tr", testHeartbeatsResetTr},
+	{"3.3.4", "user data up to 10240 octets", testCompatBodyLen},
+	{"3.2.7", "maximum length", testMaxBodyLen},
+	{"3.2.7", "length smaller than the header", testShortLength},
+	{"3.2.9", "unknown message type", testUnknownTyp},
+}
+
+func TestConformance(t *testing.T) {
+	for _, c := range conformance {
+		t.Run(c.section+" "+c.name, c.test)
+	}
+}
+
+// newSUT creates the client under test, with the given setters
+func newSUT(t *testing.T, setters ...fmtp.ClientSetter) *fmtp.Client {
+	c, err := fmtp.NewClient("SUT", append([]fmtp.ClientSetter{fmtp.SetLogger(fmtp.NewNopLogger())}, setters...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// accept returns a pointer to the given ACCEPT value, for fmtpsim steps
+func accept(ok bool) *bool {
+	return &ok
+}
+
+// peerAgainstInitiator plays a scripted responder against a connection from the client under test.
+// The connection is returned before Init is called, the outcome of the script is sent on the channel.
+func peerAgainstInitiator(t *testing.T, c *fmtp.Client, steps ...fmtpsim.Step) (*fmtp.Conn, <-chan error) {
+	peer, sut := fmtptest.Pipe("peer", "sut")
+	conn := c.NewConn(nil)
+	conn.SetUnderlying(sut)
+	t.Cleanup(func() { conn.Close() })
+
+	sc := &fmtpsim.Scenario{Name: t.Name(), Role: fmtpsim.Responder, Local: "PEER", Timeout: fmtpsim.Duration(fmtptest.Timeout), Steps: steps}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- fmtpsim.Run(context.Background(), sc, peer, t.Logf)
+	}()
+	return conn, errs
+}
+
+// peerAgainstResponder plays a scripted initiator against a server of the client under test, returning the outcome of the script
+func peerAgainstResponder(t *testing.T, c *fmtp.Client, steps ...fmtpsim.Step) error {
+	l := fmtptest.NewListener()
+	srv := c.NewServer("", nil)
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	peer, err := l.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := &fmtpsim.Scenario{Name: t.Name(), Role: fmtpsim.Initiator, Local: "PEER", Remote: "SUT", Timeout: fmtpsim.Duration(fmtptest.Timeout), Steps: steps}
+	return fmtpsim.Run(context.Background(), sc, peer, t.Logf)
+}
+
+// identification are the steps of a successful identification with the client under test as the initiator
+var identification = []fmtpsim.Step{
+	{Expect: fmtpsim.KindIDRequest, Sender: "SUT", Receiver: "PEER"},
+	{Send: fmtpsim.KindIDRequest},
+	{Expect: fmtpsim.KindIDResponse, Accept: accept(true)},
+}
+
+// expectState waits for a connection to reach a state
+func expectState(t *testing.T, conn *fmtp.Conn, want fmtp.State) {
+	t.Helper()
+	deadline := time.Now().Add(fmtptest.Timeout)
+	for conn.State() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected state %s, got %s", want, conn.State())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// expectErr checks the error, failing the test otherwise
+func expectErr(t *testing.T, err, want error) {
+	t.Helper()
+	if err != want {
+		t.Fatalf("expected %v, got %v", want, err)
+	}
+}
+
+// mustSucceed fails the test if the script failed
+func mustSucceed(t *testing.T, errs <-chan error) {
+	t.Helper()
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testInitiatorIdentification(t *testing.T) {
+	conn, errs := peerAgainstInitiator(t, newSUT(t), append(identification,
+		fmtpsim.Step{Expect: fmtpsim.KindNothing, Within: fmtpsim.Duration(20 * time.Millisecond)},
+	)...)
+	expectErr(t, conn.Init(context.Background(), "", "PEER"), nil)
+	expectState(t, conn, fmtp.Ready)
+	mustSucceed(t, errs)
+}
+
+func testResponderIdentification(t *testing.T) {
+	c := newSUT(t)
+	err := peerAgainstResponder(t, c,
+		fmtpsim.Step{Send: fmtpsim.KindIDRequest},
+		fmtpsim.Step{Expect: fmtpsim.KindIDRequest, Sender: "SUT", Receiver: "PEER"},
+		fmtpsim.Step{Send: fmtpsim.KindIDResponse, Accept: accept(true)},
+		fmtpsim.Step{Expect: fmtpsim.KindNothing, Within: fmtpsim.Duration(20 * time.Millisecond)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testInitiatorIDMismatch(t *testing.T) {
+	conn, errs := peerAgainstInitiator(t, newSUT(t),
+		fmtpsim.Step{Expect: fmtpsim.KindIDRequest},
+		fmtpsim.Step{Send: fmtpsim.KindIDRequest, Sender: "IMPOSTOR"},
+		fmtpsim.Step{Expect: fmtpsim.KindIDResponse, Accept: accept(false)},
+		fmtpsim.Step{Expect: fmtpsim.KindClose},
+	)
+	expectErr(t, conn.Init(context.Background(), "", "PEER"), fmtp.ErrConnectionRejectedByLocal)
+	mustSucceed(t, errs)
+}
+
+func testResponderIDMismatch(t *testing.T) {
+	err := peerAgainstResponder(t, newSUT(t),
+		fmtpsim.Step{Send: fmtpsim.KindIDRequest, Receiver: "STRANGER"},
+		fmtpsim.Step{Expect: fmtpsim.KindIDResponse, Accept: accept(false)},
+		fmtpsim.Step{Expect: fmtpsim.KindClose},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testDuplicateConnection(t *testing.T) {
+	// PEER is already connected to SUT
+	p := fmtptest.NewPair(t, fmtptest.PairOptions{IDA: "PEER", IDB: "SUT"})
+
+	// A second connection claiming to be PEER is rejected
+	l := fmtptest.NewListener()
+	srv := p.B.NewServer("", nil)
+	go srv.Serve(l)
+	defer srv.Close()
+	peer, err := l.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := &fmtpsim.Scenario{Name: t.Name(), Role: fmtpsim.Initiator, Local: "PEER", Remote: "SUT", Steps: []fmtpsim.Step{
+		{Send: fmtpsim.KindIDRequest},
+		{Expect: fmtpsim.KindIDResponse, Accept: accept(false)},
+		{Expect: fmtpsim.KindClose},
+	}}
+	if err := fmtpsim.Run(context.Background(), sc, peer, t.Logf); err != nil {
+		t.Fatal(err)
+	}
+
+	// While the first one is unaffected
+	if st := p.ConnB.State(); st != fmtp.Ready {
+		t.Errorf("expected the first connection to be %s, got %s", fmtp.Ready, st)
+	}
+}
+
+func testSimultaneousConnection(t *testing.T) {
+	l := fmtptest.NewListener()
+	srv := newSUT(t).NewServer("", nil)
+	go srv.Serve(l)
+	defer srv.Close()
+
+	// The first connection claiming to be PEER is still being identified when the second one arrives
+	run := func(steps ...fmtpsim.Step) <-chan error {
+		errs := make(chan error, 1)
+		peer, err := l.Dial(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := &fmtpsim.Scenario{Name: t.Name(), Role: fmtpsim.Initiator, Local: "PEER", Remote: "SUT", Timeout: fmtpsim.Duration(fmtptest.Timeout), Steps: steps}
+		go func() {
+			errs <- fmtpsim.Run(context.Background(), sc, peer, t.Logf)
+		}()
+		return errs
+	}
+	first := run(
+		fmtpsim.Step{Send: fmtpsim.KindIDRequest},
+		fmtpsim.Step{Expect: fmtpsim.KindIDRequest},
+		fmtpsim.Step{Wait: fmtpsim.Duration(100 * time.Millisecond)},
+		fmtpsim.Step{Send: fmtpsim.KindIDResponse},
+		fmtpsim.Step{Expect: fmtpsim.KindNothing, Within: fmtpsim.Duration(20 * time.Millisecond)},
+	)
+	second := run(
+		fmtpsim.Step{Wait: fmtpsim.Duration(20 * time.Millisecond)},
+		fmtpsim.Step{Send: fmtpsim.KindIDRequest},
+		fmtpsim.Step{Expect: fmtpsim.KindIDResponse, Accept: accept(false)},
+		fmtpsim.Step{Expect: fmtpsim.KindClose},
+	)
+	mustSucceed(t, second)
+	mustSucceed(t, first)
+}
+
+func testInitiatorRejected(t *testing.T) {
+	conn, errs := peerAgainstInitiator(t, newSUT(t),
+		fmtpsim.Step{Expect: fmtpsim.KindIDRequest},
+		fmtpsim.Step{Send: fmtpsim.KindIDResponse, Accept: accept(false)},
+		fmtpsim.Step{Expect: fmtpsim.KindClose},
+	)
+	expectErr(t, conn.Init(context.Background(), "", "PEER"), fmtp.ErrConnectionRejectedByRemote)
+	expectState(t, conn, fmtp.Idle)
+	mustSucceed(t, errs)
+}
+
+func testInitiatorTi(t *testing.T) {
+	fc := clock.NewFake(time.Now())
+	conn, errs := peerAgainstInitiator(t, newSUT(t, fmtp.SetClock(fc)),
+		fmtpsim.Step{Expect: fmtpsim.KindIDRequest},
+		fmtpsim.Step{Expect: fmtpsim.KindClose},
+	)
+
+	// The peer never replies, once Ti has elapsed the connection is released
+	initErr := make(chan error, 1)
+	go func() {
+		initErr <- conn.Init(context.Background(), "", "PEER")
+	}()
+	fc.BlockUntil(1)
+	fc.Advance(fmtp.DefaultTi)
+	expectErr(t, <-initErr, fmtp.ErrConnectionDeadlineExceeded)
+	mustSucceed(t, errs)
+}
+
+func testResponderTi(t *testing.T) {
+	fc := clock.NewFake(time.Now())
+	c := newSUT(t, fmtp.SetClock(fc))
+
+	// The peer connects but never identifies, once Ti has elapsed the connection is released
+	go func() {
+		fc.BlockUntil(1)
+		fc.Advance(fmtp.DefaultTi)
+	}()
+	err := peerAgainstResponder(t, c, fmtpsim.Step{Expect: fmtpsim.KindClose})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testAssociation(t *testing.T) {
+	conn, errs := peerAgainstInitiator(t, newSUT(t), append(identification,
+		fmtpsim.Step{Expect: fmtpsim.KindStartup},
+		fmtpsim.Step{Send: fmtpsim.KindStartup},
+		fmtpsim.Step{Send: fmtpsim.KindOperator, Text: "associated"},
+		fmtpsim.Step{Expect: fmtpsim.KindNothing, Within: fmtpsim.Duration(20 * time.Millisecond)},
+	)...)
+	rec := &fmtptest.Recorder{}
+	conn.SetHandler(rec)
+	expectErr(t, conn.Init(context.Background(), "", "PEER"), nil)
+	expectErr(t, conn.Associate(context.Background()), nil)
+	rec.ExpectBodies(t, "associated")
+	mustSucceed(t, errs)
+}
+
+func testStartupCollision(t *testing.T) {
+	p := fmtptest.NewPair(t, fmtptest.PairOptions{})
+
+	// Both parties request the association at the same time, each STARTUP answers the other
+	errs := make(chan error, 2)
+	for _, conn := range []*fmtp.Conn{p.ConnA, p.ConnB} {
+		go func(conn *fmtp.Conn) {
+			errs <- conn.Associate(context.Background())
+		}(conn)
+	}
+	expectErr(t, <-errs, nil)
+	expectErr(t, <-errs, nil)
+	expectState(t, p.ConnA, fmtp.DataReady)
+	expectState(t, p.ConnB, fmtp.DataReady)
+
+	p.SendA(t, "after collision")
+	p.RecB.ExpectBodies(t, "after collision")
+}
+
+func testShutdown(t *testing.T) {
+	p := fmtptest.NewPair(t, fmtptest.PairOptions{})
+	shutdown := make(chan struct{})
+	p.ConnB.ShutdownNotify = func() { close(shutdown) }
+	p.Associate(t)
+	expectState(t, p.ConnB, fmtp.DataReady)
+
+	// The recipient is informed, and the connection still exists
+	if err := p.ConnA.Deassociate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-shutdown:
+	case <-time.After(fmtptest.Timeout):
+		t.Fatal("recipient not informed of the SHUTDOWN")
+	}
+	expectState(t, p.ConnA, fmtp.Ready)
+	expectState(t, p.ConnB, fmtp.Ready)
+}
+
+func testReassociation(t *testing.T) {
+	p := fmtptest.NewPair(t, fmtptest.PairOptions{})
+	p.Associate(t)
+	if err := p.ConnA.Deassociate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expectState(t, p.ConnB, fmtp.Ready)
+
+	// A new association is established over the same connection
+	p.Associate(t)
+	p.SendA(t, "again")
+	p.RecB.ExpectBodies(t, "again")
+}
+
+func testConnectionRelease(t *testing.T) {
+	p := fmtptest.NewPair(t, fmtptest.PairOptions{})
+	if err := p.ConnA.Disconnect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expectState(t, p.ConnA, fmtp.Idle)
+	expectState(t, p.ConnB, fmtp.Idle)
+}
+
+func testUndefinedEvents(t *testing.T) {
+	conn, errs := peerAgainstInitiator(t, newSUT(t), append(identification,
+		// Neither data nor HEARTBEAT nor SHUTDOWN is defined before the association, be it requested or not
+		fmtpsim.Step{Send: fmtpsim.KindOperator, Text: "too early"},
+		fmtpsim.Step{Send: fmtpsim.KindHeartbeat},
+		fmtpsim.Step{Send: fmtpsim.KindShutdown},
+		fmtpsim.Step{Expect: fmtpsim.KindStartup},
+		fmtpsim.Step{Send: fmtpsim.KindHeartbeat},
+		fmtpsim.Step{Send: fmtpsim.KindShutdown},
+		fmtpsim.Step{Send: fmtpsim.KindOperator, Text: "pending"},
+		fmtpsim.Step{Send: fmtpsim.KindStartup},
+
+		// Nor is a STARTUP once associated
+		fmtpsim.Step{Send: fmtpsim.KindStartup},
+		fmtpsim.Step{Send: fmtpsim.KindOperator, Text: "associated"},
+		fmtpsim.Step{Expect: fmtpsim.KindOperator, Text: "still up"},
+		fmtpsim.Step{Expect: fmtpsim.KindNothing, Within: fmtpsim.Duration(20 * time.Millisecond)},
+	)...)
+	rec := &fmtptest.Recorder{}
+	conn.SetHandler(rec)
+	expectErr(t, conn.Init(context.Background(), "", "PEER"), nil)
+	expectErr(t, conn.Associate(context.Background()), nil)
+	rec.ExpectBodies(t, "associated")
+	msg, _ := fmtp.NewOperatorMessageString("still up")
+	expectErr(t, conn.Send(context.Background(), msg), nil)
+	mustSucceed(t, errs)
+}
+
+// heartbeats signals the HEARTBEATs received
+type heartbeats struct {
+	*fmtp.PrometheusMetrics
+	received chan struct{}
+}
+
+func (hb heartbeats) HeartbeatReceived(remote fmtp.ID) {
+	hb.received <- struct{}{}
+}
+
+// expectHeartbeat checks whether a HEARTBEAT is received
+func (hb heartbeats) expectHeartbeat(t *testing.T, want bool) {
+	t.Helper()
+	wait := fmtptest.Timeout
+	if !want {
+		wait = 20 * time.Millisecond
+	}
+	select {
+	case <-hb.received:
+		if !want {
+			t.Fatal("unexpected HEARTBEAT")
+		}
+	case <-time.After(wait):
+		if want {
+			t.Fatal("expected a HEARTBEAT")
+		}
+	}
+}
+
+// heartbeatPair creates an associated pair whose A follows a fake clock, and B reports the HEARTBEATs received
+func heartbeatPair(t *testing.T) (*fmtptest.Pair, *clock.Fake, heartbeats) {
+	fc := clock.NewFake(time.Now())
+	hb := heartbeats{PrometheusMetrics: fmtp.NewPrometheusMetrics(), received: make(chan struct{}, 10)}
+	p := fmtptest.NewPair(t, fmtptest.PairOptions{
+		ClientA: []fmtp.ClientSetter{fmtp.SetClock(fc), fmtp.SetTimers(0, 0, time.Hour)},
+		ClientB: []fmtp.ClientSetter{fmtp.SetMetrics(hb)},
+	})
+	p.Associate(t)
+	fc.BlockUntil(2)
+	return p, fc, hb
+}
+
+func testHeartbeatCadence(t *testing.T) {
+	_, fc, hb := heartbeatPair(t)
+
+	// Nothing before Ts, then a HEARTBEAT every Ts
+	fc.Advance(fmtp.DefaultTs - time.Second)
+	hb.expectHeartbeat(t, false)
+	for i := 0; i < 3; i++ {
+		fc.Advance(time.Second)
+		hb.expectHeartbeat(t, true)
+		fc.BlockUntil(2)
+		fc.Advance(fmtp.DefaultTs - time.Second)
+	}
+}
+
+func testDataResetsTs(t *testing.T) {
+	p, fc, hb := heartbeatPair(t)
+
+	// Sending data just before Ts expires postpones the HEARTBEAT
+	fc.Advance(fmtp.DefaultTs - time.Second)
+	p.SendA(t, "data")
+	p.RecB.ExpectBodies(t, "data")
+	fc.Advance(time.Second)
+	hb.expectHeartbeat(t, false)
+	fc.Advance(fmtp.DefaultTs - time.Second)
+	hb.expectHeartbeat(t, true)
+}
+
+func testTrExpiry(t *testing.T) {
+	// A follows a fake clock, in which B never sends anything
+	fc := clock.NewFake(time.Now())
+	p := fmtptest.NewPair(t, fmtptest.PairOptions{ClientA: []fmtp.ClientSetter{fmtp.SetClock(fc), fmtp.SetTimers(0, time.Hour, 0)}})
+	shutdown := make(chan struct{})
+	p.ConnB.ShutdownNotify = func() { close(shutdown) }
+	p.Associate(t)
+	fc.BlockUntil(2)
+
+	// Once Tr has elapsed, A shuts the association down
+	fc.Advance(fmtp.DefaultTr)
+	select {
+	case <-shutdown:
+	case <-time.After(fmtptest.Timeout):
+		t.Fatal("no SHUTDOWN received after Tr")
+	}
+	expectState(t, p.ConnA, fmtp.Ready)
+	expectState(t, p.ConnB, fmtp.Ready)
+}
+
+func testHeartbeatsResetTr(t *testing.T) {
+	// Both follow the same fake clock, only B sending HEARTBEATs
+	fc := clock.NewFake(time.Now())
+	hb := heartbeats{PrometheusMetrics: fmtp.NewPrometheusMetrics(), received: make(chan struct{}, 10)}
+	p := fmtptest.NewPair(t, fmtptest.PairOptions{
+		ClientA: []fmtp.ClientSetter{fmtp.SetClock(fc), fmtp.SetTimers(0, time.Hour, 0), fmtp.SetMetrics(hb)},
+		ClientB: []fmtp.ClientSetter{fmtp.SetClock(fc), fmtp.SetTimers(0, 0, time.Hour)},
+	})
+	p.Associate(t)
+
+	// Over several Tr, the HEARTBEATs alone keep the association up
+	for i := 0; i < 5; i++ {
+		// Ts and Tr of both are armed, unless A has shut the association down
+		for deadline := time.Now().Add(fmtptest.Timeout); fc.Timers() < 4; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("association shut down after %d HEARTBEATs, A is %s", i, p.ConnA.State())
+			}
+		}
+		fc.Advance(fmtp.DefaultTs)
+		hb.expectHeartbeat(t, true)
+	}
+	if st := p.ConnA.State(); st != fmtp.DataReady {
+		t.Errorf("expected state %s, got %s", fmtp.DataReady, st)
+	}
+}
+
+func testCompatBodyLen(t *testing.T) {
+	p := fmtptest.NewPair(t, fmtptest.PairOptions{})
+	body := strings.Repeat("X", fmtp.CompatBodyLen)
+	p.SendA(t, body)
+	p.RecB.ExpectBodies(t, body)
+}
+
+func testMaxBodyLen(t *testing.T) {
+	// A message can't be longer than what the LENGTH field can describe
+	if _, err := fmtp.NewOperationalMessage(bytes.NewReader(make([]byte, fmtp.MaxBodyLen+1))); err == nil {
+		t.Errorf("expected an error for a body of %d octets", fmtp.MaxBodyLen+1)
+	}
+
+	// But up to it, it is accepted
+	p := fmtptest.NewPair(t, fmtptest.PairOptions{})
+	body := strings.Repeat("X", fmtp.MaxBodyLen)
+	p.SendA(t, body)
+	p.RecB.ExpectBodies(t, body)
+}
+
+func testShortLength(t *testing.T) {
+	err := peerAgainstResponder(t, newSUT(t),
+		fmtpsim.Step{Send: fmtpsim.KindIDRequest},
+		fmtpsim.Step{Expect: fmtpsim.KindIDRequest},
+		fmtpsim.Step{Send: fmtpsim.KindIDResponse},
+		fmtpsim.Step{Send: fmtpsim.KindStartup},
+		fmtpsim.Step{Expect: fmtpsim.KindStartup},
+		fmtpsim.Step{Send: fmtpsim.KindRaw, Header: &fmtpsim.RawHeader{Version: 2, Length: 4, Typ: 2}},
+		fmtpsim.Step{Expect: fmtpsim.KindClose},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// discards signals the messages discarded by a client, as reported in its log
+type discards struct {
+	fmtp.Logger
+	discarded chan struct{}
+}
+
+func (d discards) With(fmtp.Fields) fmtp.Logger {
+	return d
+}
+
+func (d discards) Warnf(format string, args ...interface{}) {
+	if strings.Contains(fmt.Sprintf(format, args...), "discarded") {
+		d.discarded <- struct{}{}
+	}
+}
+
+func testUnknownTyp(t *testing.T) {
+	// A follows a fake clock, in which B never sends anything
+	fc := clock.NewFake(time.Now())
+	d := discards{Logger: fmtp.NewNopLogger(), discarded: make(chan struct{}, 1)}
+	p := fmtptest.NewPair(t, fmtptest.PairOptions{ClientA: []fmtp.ClientSetter{fmtp.SetClock(fc), fmtp.SetTimers(0, time.Hour, 0), fmtp.SetLogger(d)}})
+	shutdown := make(chan struct{})
+	p.ConnB.ShutdownNotify = func() { close(shutdown) }
+	p.Associate(t)
+	fc.BlockUntil(2)
+
+	// A message of an unknown type is discarded, and doesn't count as the remote party being alive
+	fc.Advance(fmtp.DefaultTr - time.Second)
+	msg, err := fmtp.NewMessage(fmtp.Typ(9), strings.NewReader("garbage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Link.InjectMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-d.discarded:
+	case <-time.After(fmtptest.Timeout):
+		t.Fatal("message of an unknown type not discarded")
+	}
+	fc.Advance(time.Second)
+	select {
+	case <-shutdown:
+	case <-time.After(fmtptest.Timeout):
+		t.Fatal("no SHUTDOWN received after Tr")
+	}
+	if got := len(p.RecA.Messages()); got != 0 {
+		t.Errorf("expected nothing delivered, got %d messages", got)
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"context"
 	"io"
 
+	"github.com/aabizri/fmtp/clock"
 	"github.com/pkg/errors"
 )
 
@@ -50,8 +51,17 @@ func (conn *Conn) recvIDRequestMessage(ctx context.Context) (*idRequest, error)
 	if err != nil {
 		return nil, err
 	}
+
+	// The remote party may have rejected our own identification instead of sending its own
+	if resp := (&idResponse{}); resp.UnmarshalBinary(buf.Bytes()) == nil && !resp.OK {
+		return nil, ErrConnectionRejectedByRemote
+	}
+
 	idr := &idRequest{}
-	idr.UnmarshalBinary(buf.Bytes())
+	err = idr.UnmarshalBinary(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
 
 	// Return it
 	return idr, nil
@@ -96,35 +106,77 @@ func (conn *Conn) recvIDResponseMessage(ctx context.Context) (*idResponse, error
 }
 
 // recv receives a connection request from an outside party
-func (conn *Conn) recv(ctx context.Context) error {
+func (conn *Conn) recv(ctx context.Context) (err error) {
+	conn.inbound = true
+
+	// We are now awaiting the remote identification
+	err = conn.transition(acceptEvt)
+	if err != nil {
+		return err
+	}
+
+	// If we fail from now on, the connection is released
+	defer func() {
+		if err != nil {
+			conn.transitionCause(disconnectEvt, err)
+			conn.stopWriter()
+		}
+	}()
+	conn.startWriter()
+
 	// We create a local context following the ti timer
-	tiCtx, cancel := context.WithTimeout(ctx, conn.Ti)
+	tiCtx, cancel := clock.WithTimeout(ctx, conn.client.clock, conn.Ti)
 	defer cancel()
 
 	// Receive an ID Request, using the tiCtx
 	idr, err := conn.recvIDRequestMessage(tiCtx)
 	if tiCtx.Err() != nil { // If the cancel comes from tiCtx, we do not return a "context canceled" but the correct error
+		conn.client.metrics.TimerExpired(conn.remote, TimerTi)
 		return ErrConnectionDeadlineExceeded
 	} else if err != nil {
 		return err
 	}
 
 	// We note the remote ID in the connection
-	switch {
-	// If we have an acceptRemote function, then we use it !
-	case conn.acceptRemote != nil:
-		// If we don't accept it, send a reject message
-		if !conn.acceptRemote(idr.Sender) {
-			conn.sendIDResponseMessage(ctx, false)
-			return ErrConnectionRejectedByLocal
-		}
-		fallthrough // Now that the check is done, we expect the same particular behaviour as a wildcard
+	conn.remote = idr.Sender
+	conn.setLogger()
+
+	// If required, check that the remote certificate matches the ID
+	if err := conn.checkCertificateID(idr.Sender); err != nil {
+		conn.sendIDResponseMessage(ctx, false)
+		err = errors.Wrap(ErrConnectionRejectedByLocal, err.Error())
+		conn.rejected(LocalParty, err)
+		return err
+	}
 
-	// If we have no acceptRemote function then its a wildcard
-	case conn.acceptRemote == nil:
-		conn.remote = idr.Sender
+	// The request must be intended for us
+	if idr.Receiver != conn.local {
+		conn.sendIDResponseMessage(ctx, false)
+		err = errors.Wrapf(ErrConnectionRejectedByLocal, "request intended for %q", idr.Receiver)
+		conn.rejected(LocalParty, err)
+		return err
+	}
+
+	// If we have an acceptRemote function, then we use it, otherwise its a wildcard
+	if conn.acceptRemote != nil && !conn.acceptRemote(idr.Sender) {
+		// If we don't accept it, send a reject message
+		conn.sendIDResponseMessage(ctx, false)
+		conn.rejected(LocalParty, ErrConnectionRejectedByLocal)
+		return ErrConnectionRejectedByLocal
+	}
 
+	// There can only be one connection with a remote party, so we reserve its ID until we are registered
+	if !conn.client.reserveID(idr.Sender) {
+		conn.sendIDResponseMessage(ctx, false)
+		err = errors.Wrap(ErrConnectionRejectedByLocal, "already connected to this remote party")
+		conn.rejected(LocalParty, err)
+		return err
 	}
+	defer func() {
+		if err != nil {
+			conn.client.releaseID(idr.Sender)
+		}
+	}()
 
 	// We send an ID request message using the normal context
 	err = conn.sendIDRequestMessage(ctx, conn.local, idr.Sender)
@@ -133,12 +185,13 @@ func (conn *Conn) recv(ctx context.Context) error {
 	}
 
 	// We reset our tiCtx
-	tiCtx, cancel = context.WithTimeout(ctx, conn.Ti)
+	tiCtx, cancel = clock.WithTimeout(ctx, conn.client.clock, conn.Ti)
 	defer cancel()
 
 	// We await a positive response
 	idresp, err := conn.recvIDResponseMessage(tiCtx)
 	if tiCtx.Err() != nil { // If the cancel comes from tiCtx, we do not return a "context canceled" but the correct error
+		conn.client.metrics.TimerExpired(conn.remote, TimerTi)
 		return ErrConnectionDeadlineExceeded
 	} else if err != nil {
 		return err
@@ -146,9 +199,19 @@ func (conn *Conn) recv(ctx context.Context) error {
 
 	// If the response was negative, we signal it
 	if !idresp.OK {
+		conn.rejected(RemoteParty, ErrConnectionRejectedByRemote)
 		return ErrConnectionRejectedByRemote
 	}
 
+	// The connection is now established
+	conn.transition(idAcceptEvt)
+
+	// Register the connection client-side
+	err = conn.client.registerConn(conn)
+	if err != nil {
+		return err
+	}
+
 	// launch the agent
 	go conn.agent()
 
@@ -5,10 +5,11 @@ import (
 	"context"
 	"io"
 	"net"
+	"sync"
 	"time"
 
+	"github.com/aabizri/fmtp/clock"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 )
 
 var (
@@ -20,6 +21,9 @@ var (
 
 	// ErrConnectionRejectedByLocal is returned when the connection has been rejected by the local party
 	ErrConnectionRejectedByLocal = errors.New("connection rejected for invalid credentials")
+
+	// ErrConnectionClosed is returned when an operation is attempted on a closed connection
+	ErrConnectionClosed = errors.New("connection closed")
 )
 
 // Conn holds the connection with an endpoint
@@ -35,11 +39,36 @@ type Conn struct {
 	// the underlying tcp conn, or any io.RWC
 	tcp io.ReadWriteCloser
 
+	// logger is the connection's logger, set once the remote ID and tcp are known, see log
+	logger Logger
+
+	// dec decodes what is received over tcp, every read going through it as it buffers the stream
+	dec *Decoder
+
+	// out queues the messages for the writer, the only one writing to tcp, which stops once outDone is closed
+	out       lanes
+	outDone   chan struct{}
+	startOnce sync.Once
+	stopOnce  sync.Once
+
+	// inbound is true if the connection has been accepted rather than dialled
+	inbound bool
+
 	// orders is how an order is given to the agent
 	orders chan order
 
 	// done closes the agent directly
-	done chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// closed is closed once the agent has stopped
+	closed chan struct{}
+
+	// state is the current state of the connection, see State
+	stateMu    sync.RWMutex
+	state      State
+	stateSince time.Time
+	stateCh    chan struct{}
 
 	// ti is the maximum period of time in which data must be received during an FMTP connection attempt in order for it to be successful
 	Ti time.Duration
@@ -53,9 +82,15 @@ type Conn struct {
 	// handler is the user's handler for OPERATOR and OPERATIONAL messages
 	Handler Handler
 
-	// ShutdownNotify notifies the user that a shutdown has been initiated
+	// ShutdownNotify is called when the remote party shuts the association down, it is called synchronously and should not block
 	ShutdownNotify func()
 
+	// ErrorNotify is called when an error happens on the connection outside of a user call, such as ErrAssociationTimeoutExceeded
+	ErrorNotify func(error)
+
+	// StateNotify is called on every state change of the connection, it is called synchronously and should not block
+	StateNotify func(from, to State)
+
 	// which client does this belong to ?
 	client *Client
 }
@@ -80,6 +115,7 @@ func (conn *Conn) SetUnderlying(rwc io.ReadWriteCloser) error {
 		return errors.New("SetUnderlying: given io.ReadWriteCloser is nil, can't set")
 	}
 	conn.tcp = rwc
+	conn.dec = NewDecoder(rwc)
 	return nil
 }
 
@@ -99,6 +135,9 @@ func (c *Client) NewConn(h Handler) *Conn {
 		local:   c.id,
 		orders:  make(chan order),
 		done:    make(chan struct{}),
+		closed:  make(chan struct{}),
+		out:     newLanes(c.writeQueueSize),
+		outDone: make(chan struct{}),
 		Ti:      c.tiDuration,
 		Tr:      c.trDuration,
 		Ts:      c.tsDuration,
@@ -110,50 +149,84 @@ func (c *Client) NewConn(h Handler) *Conn {
 }
 
 // Init initialises a connection
-func (conn *Conn) Init(ctx context.Context, addr string, remote ID) error {
+// If it fails, the underlying connection is closed.
+func (conn *Conn) Init(ctx context.Context, addr string, remote ID) (err error) {
 	// Debug
-	logger := conn.client.logger.WithFields(logrus.Fields{
-		"addr":      addr,
-		"remote ID": remote,
+	logger := conn.client.logger.With(Fields{
+		FieldRemoteAddr: addr,
+		FieldRemoteID:   string(remote),
 	})
-	logger.Debug("Conn.Init called")
+	logger.Debugf("Conn.Init called")
 
 	// Set the remote indicated here as the conn's remote
 	conn.remote = remote
 
+	// We are now pending connection
+	err = conn.transition(connectEvt)
+	if err != nil {
+		return err
+	}
+
+	// If we fail from now on, the connection is released
+	defer func() {
+		if err == nil {
+			return
+		}
+		conn.transitionCause(disconnectEvt, err)
+		conn.stopWriter()
+		if conn.tcp != nil {
+			conn.tcp.Close()
+		}
+	}()
+
 	// If there is no underlying connection set, create a TCP connection
 	if conn.tcp == nil {
-		logger.Debug("no underlying connection set, establishing a TCP connection now...")
+		logger.Debugf("no underlying connection set, establishing a TCP connection now...")
 		// Create the TCP connection
-		tcpConn, err := establishTCPConn(ctx, conn.client.dialer, addr)
+		tcpConn, err := establishTCPConn(ctx, conn.client.dialer, conn.client.tlsConfig, addr)
 		if err != nil {
 			return errors.Wrap(err, "Connect: error while establishing TCP connection")
 		}
 		conn.tcp = tcpConn
+		conn.dec = NewDecoder(tcpConn)
 	}
+	conn.transition(tcpUpEvt)
+	conn.setLogger()
+	conn.startWriter()
 
 	// Send an ID Request
-	err := conn.sendIDRequestMessage(ctx, conn.local, remote)
+	err = conn.sendIDRequestMessage(ctx, conn.local, remote)
 	if err != nil {
 		return err
 	}
 
 	// Create a new context for us to be able to cancel execution, it will act as the ti timer.
-	tiCtx, cancel := context.WithTimeout(ctx, conn.Ti)
+	tiCtx, cancel := clock.WithTimeout(ctx, conn.client.clock, conn.Ti)
 	defer cancel()
 
 	// Receive an ID Request, using the tiCtx
 	idr, err := conn.recvIDRequestMessage(tiCtx)
 	if tiCtx.Err() != nil { // If the cancel comes from tiCtx, we do not return a "context canceled" but the correct error
+		conn.client.metrics.TimerExpired(remote, TimerTi)
 		return ErrConnectionDeadlineExceeded
 	} else if err != nil {
+		if err == ErrConnectionRejectedByRemote {
+			conn.rejected(RemoteParty, err)
+		}
 		return err
 	}
 
 	// Validate it and send the reply, using the tiCtx
 	ok := idr.validateID(remote, conn.local)
+	if ok {
+		if err := conn.checkCertificateID(remote); err != nil {
+			logger.Errorf("rejecting remote: %v", err)
+			ok = false
+		}
+	}
 	err = conn.sendIDResponseMessage(tiCtx, ok)
 	if tiCtx.Err() != nil { // If the cancel comes from tiCtx, we do not return a "context canceled" but the correct error
+		conn.client.metrics.TimerExpired(remote, TimerTi)
 		return ErrConnectionDeadlineExceeded
 	} else if err != nil {
 		return err
@@ -161,11 +234,12 @@ func (conn *Conn) Init(ctx context.Context, addr string, remote ID) error {
 
 	// If that was a reject, return an error
 	if !ok {
+		conn.rejected(LocalParty, ErrConnectionRejectedByLocal)
 		return ErrConnectionRejectedByLocal
 	}
 
-	// Launch the agent
-	go conn.agent()
+	// The connection is now established
+	conn.transition(idAcceptEvt)
 
 	// Register the connection client-side
 	err = conn.client.registerConn(conn)
@@ -173,24 +247,42 @@ func (conn *Conn) Init(ctx context.Context, addr string, remote ID) error {
 		return err
 	}
 
+	// Launch the agent
+	go conn.agent()
+
 	// Finished
 	return nil
 }
 
 // Close closes the association & connection without any grace
+// It is safe to call it several times, and from any goroutine.
 func (conn *Conn) Close() error {
-	conn.done <- struct{}{}
-	return nil
+	var err error
+	conn.closeOnce.Do(func() {
+		close(conn.done)
+
+		// If the agent has already stopped, the underlying connection has already been closed
+		select {
+		case <-conn.closed:
+			return
+		default:
+		}
+		if conn.tcp != nil {
+			err = conn.tcp.Close()
+		}
+	})
+	return err
 }
 
 // Disconnect disconnects a connection, gracefully
 func (conn *Conn) Disconnect(ctx context.Context) error {
-	return conn.order(ctx, disconnectCmd)
+	return conn.order(ctx, disconnectCmd, nil)
 }
 
-// Deassociate de-associates gracefully
+// Deassociate de-associates gracefully.
+// The data messages still queued once the SHUTDOWN is written aren't sent, their Send failing with ErrConnectionClosed.
 func (conn *Conn) Deassociate(ctx context.Context) error {
-	return conn.order(ctx, deassociateCmd)
+	return conn.order(ctx, deassociateCmd, nil)
 }
 
 // Connect initiates an FMTP Connection. It is a wrapper around (*Client).NewConn(nil) and NewConn.Init(ctx, address, id)
@@ -206,27 +298,22 @@ func (c *Client) Connect(ctx context.Context, address string, id ID) (*Conn, err
 // If the given context expires before the connection is complete, an error is returned.
 // But once successfully established, the context has no effect.
 func (conn *Conn) Associate(ctx context.Context) error {
-	return conn.order(ctx, associateCmd)
+	return conn.order(ctx, associateCmd, nil)
 }
 
 // Send sends a message over a connection, making the agent associate it if needed.
-func (conn *Conn) Send(ctx context.Context, msg *Message) error {
-	done := make(chan error)
-	go func() {
-		conn.orders <- order{
-			command: sendCmd,
-			ctx:     ctx,
-			done:    done,
-			msg:     msg,
-		}
-	}()
-
-	select {
-	case err := <-done:
+// It returns once the message has been written, or has failed to be.
+//
+// Unless set with WithPriority, the priority of the message is PriorityNormal for Operator messages and PriorityLow for Operational ones.
+func (conn *Conn) Send(ctx context.Context, msg *Message, opts ...SendOption) error {
+	if msg == nil {
+		return errors.New("Send: given message is nil, can't send")
+	}
+	priority, err := sendPriority(msg, opts)
+	if err != nil {
 		return err
-	case <-ctx.Done():
-		return ctx.Err()
 	}
+	return conn.orderPriority(ctx, sendCmd, msg, priority)
 }
 
 // Write creates an operator message and sends it
@@ -257,19 +344,136 @@ func (conn *Conn) RemoteID() ID {
 	return conn.remote
 }
 
-// send sends a message over a connection
-//
-// Warning: it is absolutely not safe for concurrent use
-func (conn *Conn) send(ctx context.Context, msg *Message) error {
-	_, err := send(ctx, conn.tcp, msg)
+// startWriter launches the writer of the connection, once the underlying connection is set
+func (conn *Conn) startWriter() {
+	conn.startOnce.Do(func() {
+		outAgent(conn.tcp, conn.out, conn.outDone, conn.written)
+	})
+}
+
+// stopWriter stops the writer of the connection, it is safe to call it several times
+func (conn *Conn) stopWriter() {
+	conn.stopOnce.Do(func() {
+		close(conn.outDone)
+	})
+}
+
+// enqueue hands a message to the writer in the lane of the given priority, the result being reported on done, which must be buffered
+func (conn *Conn) enqueue(ctx context.Context, msg *Message, priority Priority, done chan error) error {
+	o := &outgoing{ctx: ctx, msg: msg, priority: priority, done: done, at: conn.client.clock.Now()}
+	return conn.push(o)
+}
+
+// post hands a message to the writer like enqueue, but without ever waiting: if its lane is full, a goroutine waits for room instead.
+// Any failure is reported on done, which must be buffered. It is what the agent uses, so that a slow remote party doesn't stall it.
+func (conn *Conn) post(ctx context.Context, msg *Message, priority Priority, done chan error) {
+	o := &outgoing{ctx: ctx, msg: msg, priority: priority, done: done, at: conn.client.clock.Now()}
+	select {
+	case conn.out[priority] <- o:
+		return
+	default:
+	}
+	go func() {
+		if err := conn.push(o); err != nil {
+			o.done <- err
+		}
+	}()
+}
+
+// push waits for room in the lane of an outgoing message, recording its failure if the connection is closed or its context expires first
+func (conn *Conn) push(o *outgoing) error {
+	var err error
+	select {
+	case conn.out[o.priority] <- o:
+		return nil
+	case <-conn.outDone:
+		err = ErrConnectionClosed
+	case <-o.ctx.Done():
+		err = o.ctx.Err()
+	}
+	conn.written(o, 0, err)
 	return err
 }
 
+// send sends a message over a connection with the default priority of its type, returning once it has been written or has failed
+func (conn *Conn) send(ctx context.Context, msg *Message) error {
+	done := make(chan error, 1)
+	err := conn.enqueue(ctx, msg, priorityOf(msg.Typ()), done)
+	if err != nil {
+		return err
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-conn.outDone:
+		select {
+		case err := <-done:
+			return err
+		default:
+			return ErrConnectionClosed
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// drain waits for the messages handed to the writer so far to have been written
+func (conn *Conn) drain(ctx context.Context) error {
+	// A barrier in the lowest lane is only reached once every lane is empty
+	done := make(chan error, 1)
+	o := &outgoing{ctx: ctx, priority: PriorityLow, done: done}
+	select {
+	case conn.out[PriorityLow] <- o:
+	case <-conn.outDone:
+		return ErrConnectionClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-conn.outDone:
+		return ErrConnectionClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// written records the outcome of the writing of a message
+func (conn *Conn) written(o *outgoing, n int64, err error) {
+	typ := o.msg.Typ()
+	if err != nil {
+		// Nobody waits for the system messages sent by the agent, so their failure is logged here
+		if typ == system {
+			conn.log().Errorf("error while writing system message: %v", err)
+		}
+		conn.client.metrics.SendFailed(conn.remote, typ)
+		conn.emit(Event{Type: EventSendFailed, MsgType: typ, Err: err})
+		return
+	}
+	conn.client.metrics.MessageSent(conn.remote, typ, int(n), clock.Since(conn.client.clock, o.at))
+	if o.sig != nil && o.sig.equals(heartbeat) {
+		conn.client.metrics.HeartbeatSent(conn.remote)
+	}
+	if typ == Operator || typ == Operational {
+		conn.transition(dataSentEvt)
+	}
+}
+
 // receive receives a message from the connection
 //
 // Warning: it is absolutely not safe for concurrent use
 func (conn *Conn) receive(ctx context.Context) (*Message, error) {
-	return receive(ctx, conn.tcp)
+	msg, err := receive(ctx, conn.dec)
+	if err == nil {
+		conn.received(msg)
+	}
+	return msg, err
+}
+
+// received records the reception of a message
+func (conn *Conn) received(msg *Message) {
+	conn.client.metrics.MessageReceived(conn.remote, msg.Typ(), int(msg.header.length))
 }
 
 // disconnect is the actual action taken by an agent when disconnecting
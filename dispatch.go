@@ -0,0 +1,248 @@
+package fmtp
+
+import (
+	"runtime"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultDispatchQueueSize is the default size of the handler dispatch queues
+const DefaultDispatchQueueSize = 64
+
+// DispatchMode is the way received messages are handed over to the handler
+type DispatchMode uint8
+
+// The following constants define the dispatch modes
+const (
+	// DispatchInline calls the handler from the connection's agent, which waits for it to return before processing anything else.
+	// A slow handler thus delays the heartbeats and the orders given to the connection.
+	DispatchInline DispatchMode = iota
+
+	// DispatchOrdered calls the handler from a worker dedicated to the connection, in the order the messages have been received
+	DispatchOrdered
+
+	// DispatchPool calls the handler from a pool of workers shared by all the connections of a client, without any ordering guarantee
+	DispatchPool
+)
+
+func (dm DispatchMode) String() string {
+	switch dm {
+	case DispatchInline:
+		return "Inline"
+	case DispatchOrdered:
+		return "Ordered"
+	case DispatchPool:
+		return "Pool"
+	default:
+		return "Unknown DispatchMode"
+	}
+}
+
+// Backpressure is the policy applied when a dispatch queue is full
+type Backpressure uint8
+
+// The following constants define the backpressure policies
+const (
+	// BackpressureBlock makes the connection's agent wait for room in the queue, which may delay the heartbeats
+	BackpressureBlock Backpressure = iota
+
+	// BackpressureDropNewest drops the message received
+	BackpressureDropNewest
+
+	// BackpressureDropOldest drops the oldest message in the queue to make room for the message received
+	BackpressureDropOldest
+)
+
+func (bp Backpressure) String() string {
+	switch bp {
+	case BackpressureBlock:
+		return "Block"
+	case BackpressureDropNewest:
+		return "DropNewest"
+	case BackpressureDropOldest:
+		return "DropOldest"
+	default:
+		return "Unknown Backpressure"
+	}
+}
+
+// DispatchOptions configures how received messages are handed over to the handler
+type DispatchOptions struct {
+	// Mode is the dispatch mode
+	Mode DispatchMode
+
+	// QueueSize is the number of messages waiting to be handled, per connection for DispatchOrdered, for the whole pool for DispatchPool.
+	// If zero, DefaultDispatchQueueSize is used.
+	QueueSize int
+
+	// Workers is the number of workers of the pool, for DispatchPool. If zero, GOMAXPROCS is used.
+	Workers int
+
+	// Policy is applied when the queue is full
+	Policy Backpressure
+
+	// OnDrop is called for every message dropped because of the backpressure policy, if not nil.
+	// The message's body has already been closed.
+	OnDrop func(conn *Conn, msg *Message)
+}
+
+// SetDispatch sets the way received messages are handed over to the handlers, by default they are handled inline
+func SetDispatch(opts DispatchOptions) ClientSetter {
+	return func(c *Client) error {
+		if opts.Mode > DispatchPool {
+			return errors.Errorf("SetDispatch: unknown dispatch mode %d", opts.Mode)
+		}
+		if opts.Policy > BackpressureDropOldest {
+			return errors.Errorf("SetDispatch: unknown backpressure policy %d", opts.Policy)
+		}
+		if opts.QueueSize < 0 || opts.Workers < 0 {
+			return errors.New("SetDispatch: negative queue size or number of workers")
+		}
+		if opts.QueueSize == 0 {
+			opts.QueueSize = DefaultDispatchQueueSize
+		}
+		if opts.Workers == 0 {
+			opts.Workers = runtime.GOMAXPROCS(0)
+		}
+		c.dispatchOpts = opts
+		return nil
+	}
+}
+
+// job is a message to be handled
+type job struct {
+	conn    *Conn
+	handler Handler
+	msg     *Message
+}
+
+// serve handles the message
+func (j job) serve() {
+	j.handler.ServeFMTP(j.conn, j.msg)
+	j.msg.release()
+}
+
+// workQueue is a bounded queue of jobs, applying a backpressure policy
+type workQueue struct {
+	jobs chan job
+	opts *DispatchOptions
+}
+
+func newWorkQueue(opts *DispatchOptions) *workQueue {
+	return &workQueue{
+		jobs: make(chan job, opts.QueueSize),
+		opts: opts,
+	}
+}
+
+// drop drops a job
+func (wq *workQueue) drop(j job) {
+	j.conn.log().With(Fields{FieldMsgType: j.msg.Typ().String()}).Warnf("dispatch queue full, dropping message")
+	if j.msg.Body != nil {
+		j.msg.Body.Close()
+	}
+	if wq.opts.OnDrop != nil {
+		wq.opts.OnDrop(j.conn, j.msg)
+	}
+}
+
+// push queues a job, applying the backpressure policy if the queue is full
+func (wq *workQueue) push(j job) {
+	switch wq.opts.Policy {
+	case BackpressureBlock:
+		wq.jobs <- j
+	case BackpressureDropNewest:
+		select {
+		case wq.jobs <- j:
+		default:
+			wq.drop(j)
+		}
+	case BackpressureDropOldest:
+		for {
+			select {
+			case wq.jobs <- j:
+				return
+			default:
+			}
+			// Make room, if a worker hasn't done it in the meantime
+			select {
+			case oldest := <-wq.jobs:
+				wq.drop(oldest)
+			default:
+			}
+		}
+	}
+}
+
+// work handles the queued jobs until the queue is closed
+func (wq *workQueue) work() {
+	for j := range wq.jobs {
+		j.serve()
+	}
+}
+
+// dispatcher hands the messages received over a connection to its handler
+type dispatcher interface {
+	dispatch(msg *Message)
+
+	// close is called once the connection's agent has stopped
+	close()
+}
+
+// newDispatcher returns the dispatcher for a connection, following the client's dispatch options
+func (c *Client) newDispatcher(conn *Conn) dispatcher {
+	switch c.dispatchOpts.Mode {
+	case DispatchOrdered:
+		wq := newWorkQueue(&c.dispatchOpts)
+		go wq.work()
+		return &queueDispatcher{conn: conn, wq: wq, owned: true}
+	case DispatchPool:
+		c.poolOnce.Do(func() {
+			c.pool = newWorkQueue(&c.dispatchOpts)
+			for i := 0; i < c.dispatchOpts.Workers; i++ {
+				go c.pool.work()
+			}
+		})
+		return &queueDispatcher{conn: conn, wq: c.pool}
+	default:
+		return inlineDispatcher{conn: conn}
+	}
+}
+
+// inlineDispatcher calls the handler directly
+type inlineDispatcher struct {
+	conn *Conn
+}
+
+func (d inlineDispatcher) dispatch(msg *Message) {
+	if d.conn.Handler != nil {
+		d.conn.Handler.ServeFMTP(d.conn, msg)
+	}
+	msg.release()
+}
+
+func (d inlineDispatcher) close() {}
+
+// queueDispatcher queues the messages for workers
+type queueDispatcher struct {
+	conn *Conn
+	wq   *workQueue
+
+	// owned is true if the queue is dedicated to the connection, it is then closed along with it
+	owned bool
+}
+
+func (d *queueDispatcher) dispatch(msg *Message) {
+	if d.conn.Handler == nil {
+		msg.release()
+		return
+	}
+	d.wq.push(job{conn: d.conn, handler: d.conn.Handler, msg: msg})
+}
+
+// close lets the worker handle the remaining messages, then stop
+func (d *queueDispatcher) close() {
+	if d.owned {
+		close(d.wq.jobs)
+	}
+}
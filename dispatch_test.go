@@ -0,0 +1,115 @@
+package fmtp
+
+import (
+	"testing"
+	"time"
+)
+
+// lentJob returns a job whose message body is held in a pooled buffer
+func lentJob(conn *Conn, body string) job {
+	lb := newLentBody(len(body))
+	copy(lb.b, body)
+	msg := &Message{header: newHeader(Operator), Body: lb}
+	return job{conn: conn, handler: HandlerFunc(func(*Conn, *Message) {}), msg: msg}
+}
+
+// payload returns the body of a queued job
+func payload(j job) string {
+	return string(j.msg.Body.(*lentBody).b)
+}
+
+// saturated returns a work queue without workers, filled with the jobs "1" to "n", along with the messages it drops
+func saturated(t *testing.T, policy Backpressure, n int) (*workQueue, *Conn, []job, chan *Message) {
+	c, err := NewClient("A", SetLogger(NewNopLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := c.NewConn(nil)
+	dropped := make(chan *Message, n+1)
+	wq := newWorkQueue(&DispatchOptions{
+		QueueSize: n,
+		Policy:    policy,
+		OnDrop: func(_ *Conn, msg *Message) {
+			dropped <- msg
+		},
+	})
+	jobs := make([]job, n)
+	for i := range jobs {
+		jobs[i] = lentJob(conn, string(rune('1'+i)))
+		wq.push(jobs[i])
+	}
+	return wq, conn, jobs, dropped
+}
+
+// expectQueued checks the payloads of the queued jobs, emptying the queue
+func expectQueued(t *testing.T, wq *workQueue, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		select {
+		case j := <-wq.jobs:
+			if got := payload(j); got != w {
+				t.Errorf("expected %q queued, got %q", w, got)
+			}
+		default:
+			t.Fatalf("expected %q queued, got nothing", w)
+		}
+	}
+	if len(wq.jobs) != 0 {
+		t.Errorf("expected %d jobs queued, got %d more", len(want), len(wq.jobs))
+	}
+}
+
+// expectDropped checks that the given job has been dropped, its buffer having been given back
+func expectDropped(t *testing.T, dropped chan *Message, j job) {
+	t.Helper()
+	select {
+	case msg := <-dropped:
+		if msg != j.msg {
+			t.Errorf("expected the message %v to be dropped, got %v", j.msg, msg)
+		}
+		if lb := msg.Body.(*lentBody); lb.buf != nil {
+			t.Error("expected the dropped message's buffer to be given back")
+		}
+	default:
+		t.Fatal("expected a message to be dropped")
+	}
+}
+
+func TestBackpressureBlock(t *testing.T) {
+	wq, conn, _, dropped := saturated(t, BackpressureBlock, 2)
+
+	// The push waits for room
+	pushed := make(chan struct{})
+	go func() {
+		wq.push(lentJob(conn, "3"))
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("expected the push to block while the queue is full")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if j := <-wq.jobs; payload(j) != "1" {
+		t.Errorf("expected %q first, got %q", "1", payload(j))
+	}
+	<-pushed
+	expectQueued(t, wq, "2", "3")
+	if len(dropped) != 0 {
+		t.Errorf("expected nothing dropped, got %d messages", len(dropped))
+	}
+}
+
+func TestBackpressureDropNewest(t *testing.T) {
+	wq, conn, _, dropped := saturated(t, BackpressureDropNewest, 2)
+	j := lentJob(conn, "3")
+	wq.push(j)
+	expectDropped(t, dropped, j)
+	expectQueued(t, wq, "1", "2")
+}
+
+func TestBackpressureDropOldest(t *testing.T) {
+	wq, conn, jobs, dropped := saturated(t, BackpressureDropOldest, 2)
+	wq.push(lentJob(conn, "3"))
+	expectDropped(t, dropped, jobs[0])
+	expectQueued(t, wq, "2", "3")
+}
@@ -0,0 +1,173 @@
+package fmtp
+
+import (
+	"net"
+	"time"
+)
+
+// EventType is the type of a connection lifecycle event
+type EventType uint8
+
+// The following constants define the connection lifecycle events
+const (
+	// EventTCPConnected means the underlying connection has been established, dialled or accepted
+	EventTCPConnected EventType = iota
+
+	// EventIDAccepted means the identification exchange succeeded, the connection is established
+	EventIDAccepted
+
+	// EventIDRejected means the identification exchange failed, Initiator tells which party rejected it
+	EventIDRejected
+
+	// EventAssociationUp means the association has been established, Initiator tells which party asked for it
+	EventAssociationUp
+
+	// EventAssociationDown means the association has ended, Initiator tells which party ended it
+	EventAssociationDown
+
+	// EventHeartbeatMissed means nothing has been received for tr, the association is being shut down
+	EventHeartbeatMissed
+
+	// EventSendFailed means a message couldn't be sent
+	EventSendFailed
+
+	// EventClosed means the connection has been released
+	EventClosed
+)
+
+func (et EventType) String() string {
+	switch et {
+	case EventTCPConnected:
+		return "TCPConnected"
+	case EventIDAccepted:
+		return "IDAccepted"
+	case EventIDRejected:
+		return "IDRejected"
+	case EventAssociationUp:
+		return "AssociationUp"
+	case EventAssociationDown:
+		return "AssociationDown"
+	case EventHeartbeatMissed:
+		return "HeartbeatMissed"
+	case EventSendFailed:
+		return "SendFailed"
+	case EventClosed:
+		return "Closed"
+	default:
+		return "Unknown EventType"
+	}
+}
+
+// Party designates one of the parties of a connection
+type Party uint8
+
+// The following constants define the parties of a connection
+const (
+	LocalParty Party = iota
+	RemoteParty
+)
+
+func (p Party) String() string {
+	switch p {
+	case LocalParty:
+		return "local"
+	case RemoteParty:
+		return "remote"
+	default:
+		return "Unknown Party"
+	}
+}
+
+// Event is a connection lifecycle event, see SetEventHook
+type Event struct {
+	// Type is the type of event
+	Type EventType
+
+	// Time is when the event happened
+	Time time.Time
+
+	// Conn is the connection the event is about
+	Conn *Conn
+
+	// RemoteID is the ID of the remote party, empty if not yet known
+	RemoteID ID
+
+	// RemoteAddr is the address of the remote party, nil if unknown
+	RemoteAddr net.Addr
+
+	// Inbound is true if the connection has been accepted, false if it has been dialled
+	Inbound bool
+
+	// Initiator is the party which initiated the event, for EventIDRejected, EventAssociationUp and EventAssociationDown
+	Initiator Party
+
+	// MsgType is the type of the message which couldn't be sent, for EventSendFailed
+	MsgType Typ
+
+	// Err is the cause of the event, if any
+	Err error
+}
+
+// SetEventHook sets the function called on every lifecycle event of the client's connections, dialled and accepted.
+// It is called synchronously from the connections' goroutines, so it should not block.
+func SetEventHook(hook func(Event)) ClientSetter {
+	return func(c *Client) error {
+		c.eventHook = hook
+		return nil
+	}
+}
+
+// emit emits an event about the connection
+func (conn *Conn) emit(ev Event) {
+	hook := conn.client.eventHook
+	if hook == nil {
+		return
+	}
+	ev.Time = conn.client.clock.Now()
+	ev.Conn = conn
+	ev.RemoteID = conn.remote
+	ev.RemoteAddr = conn.RemoteAddr()
+	ev.Inbound = conn.inbound
+	hook(ev)
+}
+
+// rejected records the rejection of the identification by the given party
+func (conn *Conn) rejected(by Party, err error) {
+	conn.client.metrics.ConnectionRejected(conn.remote, by == RemoteParty)
+	conn.emit(Event{Type: EventIDRejected, Initiator: by, Err: err})
+}
+
+// emitTransition emits the events corresponding to a state change
+func (conn *Conn) emitTransition(from, to State, ev event, cause error) {
+	switch {
+	case ev == tcpUpEvt || ev == acceptEvt:
+		conn.emit(Event{Type: EventTCPConnected})
+	case ev == idAcceptEvt:
+		conn.emit(Event{Type: EventIDAccepted})
+	case to == DataReady:
+		// If we were pending association, we sent the first STARTUP
+		initiator := RemoteParty
+		if from == AssPending {
+			initiator = LocalParty
+		}
+		conn.emit(Event{Type: EventAssociationUp, Initiator: initiator})
+	}
+
+	// Leaving the association
+	if from == DataReady {
+		initiator := LocalParty
+		switch ev {
+		case shutdownRecvEvt:
+			initiator = RemoteParty
+		case trTimeoutEvt:
+			cause = ErrAssociationTimeoutExceeded
+			conn.emit(Event{Type: EventHeartbeatMissed, Err: cause})
+		}
+		conn.emit(Event{Type: EventAssociationDown, Initiator: initiator, Err: cause})
+	}
+
+	// Releasing a connection whose underlying connection had been established
+	if ev == disconnectEvt && from != ConnPending {
+		conn.emit(Event{Type: EventClosed, Err: cause})
+	}
+}
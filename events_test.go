@@ -0,0 +1,64 @@
+package fmtp
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aabizri/fmtp/clock"
+)
+
+// expectEvents checks the next events received
+func expectEvents(t *testing.T, events <-chan Event, want ...Event) {
+	t.Helper()
+	for _, w := range want {
+		select {
+		case ev := <-events:
+			if ev.Type != w.Type || ev.Initiator != w.Initiator || ev.Err != w.Err {
+				t.Fatalf("expected %s (%v, %v), got %s (%v, %v)", w.Type, w.Initiator, w.Err, ev.Type, ev.Initiator, ev.Err)
+			}
+			if ev.RemoteID != "B" || ev.Inbound || ev.Conn == nil {
+				t.Errorf("%s: unexpected connection details %+v", ev.Type, ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %s, got nothing", w.Type)
+		}
+	}
+}
+
+// TestEventSequence checks the events emitted while connecting, associating and then missing the remote's heartbeats
+func TestEventSequence(t *testing.T) {
+	// Only A follows the fake clock, with a Ts longer than Tr so that it never sends a HEARTBEAT
+	fc := clock.NewFake(time.Now())
+	events := make(chan Event, 16)
+	a := newFakeClient(t, "A", fc, SetTimers(0, time.Hour, 0), SetEventHook(func(ev Event) {
+		events <- ev
+	}))
+	b, _ := NewClient("B", SetLogger(NewNopLogger()))
+
+	ca, _, err := connectPipe(t, a, b, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEvents(t, events,
+		Event{Type: EventTCPConnected},
+		Event{Type: EventIDAccepted},
+	)
+	if err := ca.Associate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expectEvents(t, events, Event{Type: EventAssociationUp, Initiator: LocalParty})
+
+	// Nothing is received for Tr
+	fc.BlockUntil(2)
+	fc.Advance(DefaultTr)
+	expectEvents(t, events,
+		Event{Type: EventHeartbeatMissed, Err: ErrAssociationTimeoutExceeded},
+		Event{Type: EventAssociationDown, Initiator: LocalParty, Err: ErrAssociationTimeoutExceeded},
+	)
+	select {
+	case ev := <-events:
+		t.Errorf("unexpected event %s", ev.Type)
+	default:
+	}
+}
@@ -0,0 +1,153 @@
+package fmtpsim
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aabizri/fmtp"
+	"github.com/aabizri/fmtp/fmtptest"
+)
+
+// scenariosDir holds the scenarios bundled with the command
+const scenariosDir = "../cmd/fmtpsim/scenarios"
+
+func load(t *testing.T, name string) *Scenario {
+	t.Helper()
+	sc, err := LoadFile(filepath.Join(scenariosDir, name+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sc
+}
+
+// newClient creates a client with the given Tr
+func newClient(t *testing.T, id fmtp.ID, tr time.Duration) *fmtp.Client {
+	c, err := fmtp.NewClient(id, fmtp.SetLogger(fmtp.NewNopLogger()), fmtp.SetTimers(time.Second, 0, tr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// runAgainstInitiator plays a responder scenario against an fmtp initiator with a short Tr, returning the simulator's outcome
+func runAgainstInitiator(t *testing.T, sc *Scenario, initiate func(conn *fmtp.Conn)) error {
+	sim, sut := fmtptest.Pipe("sim", "sut")
+	conn := newClient(t, "SUT", 100*time.Millisecond).NewConn(nil)
+	conn.SetUnderlying(sut)
+	defer conn.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- Run(context.Background(), sc, sim, t.Logf)
+	}()
+	initiate(conn)
+	return <-errs
+}
+
+// runAgainstResponder plays an initiator scenario against an fmtp server, keeping the default Tr
+func runAgainstResponder(t *testing.T, sc *Scenario) error {
+	l := fmtptest.NewListener()
+	srv := newClient(t, "SUT", 0).NewServer("", nil)
+	go srv.Serve(l)
+	defer srv.Close()
+
+	sim, err := l.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Run(context.Background(), sc, sim, t.Logf)
+}
+
+func TestReject(t *testing.T) {
+	err := runAgainstInitiator(t, load(t, "reject"), func(conn *fmtp.Conn) {
+		if err := conn.Init(context.Background(), "", "SIM"); err != fmtp.ErrConnectionRejectedByRemote {
+			t.Errorf("expected %v, got %v", fmtp.ErrConnectionRejectedByRemote, err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSilentStartup(t *testing.T) {
+	sc := load(t, "silent-startup")
+	sc.Steps[len(sc.Steps)-1].Wait = Duration(300 * time.Millisecond)
+	err := runAgainstInitiator(t, sc, func(conn *fmtp.Conn) {
+		if err := conn.Init(context.Background(), "", "SIM"); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.Associate(context.Background()); err != fmtp.ErrAssociationTimeoutExceeded {
+			t.Errorf("expected %v, got %v", fmtp.ErrAssociationTimeoutExceeded, err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNoHeartbeat(t *testing.T) {
+	err := runAgainstInitiator(t, load(t, "no-heartbeat"), func(conn *fmtp.Conn) {
+		if err := conn.Init(context.Background(), "", "SIM"); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.Associate(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAgainstResponder(t *testing.T) {
+	for _, name := range []string{"early-data", "malformed-header", "oversize-body"} {
+		t.Run(name, func(t *testing.T) {
+			if err := runAgainstResponder(t, load(t, name)); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestStepError(t *testing.T) {
+	sc := &Scenario{
+		Name: "wrong expectation",
+		Role: Initiator,
+		Steps: []Step{
+			{Send: KindIDRequest, Sender: "SIM", Receiver: "SUT"},
+			{Expect: KindStartup, Within: Duration(time.Second)},
+		},
+	}
+	err := runAgainstResponder(t, sc)
+	se, ok := err.(*StepError)
+	if !ok {
+		t.Fatalf("expected a *StepError, got %v", err)
+	}
+	if se.Index != 1 || !strings.Contains(se.Error(), "received id-request") {
+		t.Errorf("unexpected error %v", se)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+	}{
+		{"role", `{"role": "spectator", "steps": [{"wait": "1s"}]}`},
+		{"no steps", `{"role": "initiator", "steps": []}`},
+		{"two actions", `{"role": "initiator", "steps": [{"send": "startup", "expect": "startup"}]}`},
+		{"not sendable", `{"role": "initiator", "steps": [{"send": "close"}]}`},
+		{"not expectable", `{"role": "initiator", "steps": [{"expect": "raw"}]}`},
+		{"duration", `{"role": "initiator", "steps": [{"wait": 1}]}`},
+		{"unknown field", `{"role": "initiator", "steps": [{"wait": "1s", "colour": "blue"}]}`},
+		{"size", `{"role": "initiator", "steps": [{"send": "operator", "size": 70000}]}`},
+	}
+	for _, test := range tests {
+		if _, err := Load(strings.NewReader(test.json)); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package fmtpsim
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aabizri/fmtp"
+	"github.com/pkg/errors"
+)
+
+// StepError is returned when a step of a scenario fails
+type StepError struct {
+	// Index is the index of the step in the scenario
+	Index int
+
+	// Step is the failed step
+	Step Step
+
+	// Err is the cause of the failure
+	Err error
+}
+
+func (se *StepError) Error() string {
+	return fmt.Sprintf("step %d (%s): %v", se.Index, se.Step, se.Err)
+}
+
+// received is a message received, or the error which ended the reception
+type received struct {
+	msg *fmtp.Message
+	err error
+}
+
+// player plays a scenario over a connection
+type player struct {
+	sc   *Scenario
+	rw   io.ReadWriteCloser
+	logf func(format string, args ...interface{})
+
+	// remote is the ID of the system under test, the scenario's Remote or else the sender of the first id-request received
+	remote fmtp.ID
+
+	// in delivers what has been received, the last value being the error ending the reception
+	in     <-chan received
+	closed error
+}
+
+// Run plays a scenario over a connection with the system under test, which is closed once done.
+//
+// If logf is non-nil, every step and every message received is logged with it.
+// If a step fails, a *StepError is returned.
+func Run(ctx context.Context, sc *Scenario, rw io.ReadWriteCloser, logf func(format string, args ...interface{})) error {
+	err := sc.Validate()
+	if err != nil {
+		return err
+	}
+	if logf == nil {
+		logf = func(string, ...interface{}) {}
+	}
+
+	// Launch the reader, which stops once the connection is closed
+	done := make(chan struct{})
+	defer func() {
+		rw.Close()
+		close(done)
+	}()
+	p := &player{sc: sc, rw: rw, logf: logf, remote: sc.Remote, in: readMessages(rw, done)}
+
+	// Play the steps
+	for i, st := range sc.Steps {
+		logf("step %d: %s", i, st)
+		err := p.play(ctx, st)
+		if err != nil {
+			return &StepError{Index: i, Step: st, Err: err}
+		}
+	}
+	return nil
+}
+
+// readMessages reads messages until an error happens or done is closed
+func readMessages(r io.Reader, done <-chan struct{}) <-chan received {
+	in := make(chan received)
+	go func() {
+		for {
+			msg := &fmtp.Message{}
+			_, err := msg.ReadFrom(r)
+			if err != nil {
+				msg = nil
+			}
+			select {
+			case in <- received{msg: msg, err: err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return in
+}
+
+// play plays a single step
+func (p *player) play(ctx context.Context, st Step) error {
+	switch {
+	case st.Send != "":
+		b, err := p.encode(st)
+		if err != nil {
+			return err
+		}
+		_, err = p.rw.Write(b)
+		return err
+	case st.Expect != "":
+		return p.expect(ctx, st)
+	default:
+		select {
+		case <-time.After(time.Duration(st.Wait)):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// encode returns the wire form of what a step sends
+func (p *player) encode(st Step) ([]byte, error) {
+	var (
+		msg *fmtp.Message
+		err error
+	)
+	switch st.Send {
+	case KindIDRequest:
+		msg, err = fmtp.NewIDRequestMessage(orDefault(st.Sender, p.sc.Local), orDefault(st.Receiver, p.remote))
+	case KindIDResponse:
+		msg, err = fmtp.NewIDResponseMessage(st.Accept == nil || *st.Accept)
+	case KindStartup:
+		msg, err = fmtp.NewSystemMessage(fmtp.SignalStartup)
+	case KindShutdown:
+		msg, err = fmtp.NewSystemMessage(fmtp.SignalShutdown)
+	case KindHeartbeat:
+		msg, err = fmtp.NewSystemMessage(fmtp.SignalHeartbeat)
+	case KindOperator:
+		msg, err = fmtp.NewMessage(fmtp.Operator, bytes.NewReader(body(st)))
+	case KindOperational:
+		msg, err = fmtp.NewMessage(fmtp.Operational, bytes.NewReader(body(st)))
+	case KindRaw:
+		return encodeRaw(st)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Encode it
+	buf := &bytes.Buffer{}
+	_, err = msg.WriteTo(buf)
+	return buf.Bytes(), err
+}
+
+// encodeRaw returns the raw bytes of a step
+func encodeRaw(st Step) ([]byte, error) {
+	var b []byte
+	if h := st.Header; h != nil {
+		b = append(b, h.Version, h.Reserved, byte(h.Length>>8), byte(h.Length), h.Typ)
+	}
+	raw, err := hex.DecodeString(st.Hex)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid hex")
+	}
+	b = append(b, raw...)
+	return append(b, st.Text...), nil
+}
+
+// body returns the body of an operator or operational message sent
+func body(st Step) []byte {
+	if st.Size != 0 {
+		return bytes.Repeat([]byte{'X'}, st.Size)
+	}
+	return []byte(st.Text)
+}
+
+// orDefault returns id, or def if id is empty
+func orDefault(id, def fmtp.ID) fmtp.ID {
+	if id == "" {
+		return def
+	}
+	return id
+}
+
+// expect waits for the expected message, checking it
+func (p *player) expect(ctx context.Context, st Step) error {
+	within := time.Duration(st.Within)
+	if within == 0 {
+		within = time.Duration(p.sc.Timeout)
+	}
+	if within == 0 {
+		within = DefaultTimeout
+	}
+	timer := time.NewTimer(within)
+	defer timer.Stop()
+
+	for {
+		// Get the next message
+		var msg *fmtp.Message
+		if p.closed == nil {
+			select {
+			case r := <-p.in:
+				msg, p.closed = r.msg, r.err
+			case <-timer.C:
+				if st.Expect == KindNothing {
+					return nil
+				}
+				return errors.Errorf("nothing received within %s", within)
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		// The connection is closed
+		if p.closed != nil {
+			p.logf("connection closed: %v", p.closed)
+			if st.Expect == KindClose {
+				return nil
+			}
+			return errors.Wrap(p.closed, "connection closed")
+		}
+
+		// Check what we received
+		kind := classify(msg)
+		p.logf("received %s", describe(kind, msg))
+		if kind == KindHeartbeat && st.Expect != KindHeartbeat && p.sc.IgnoreHeartbeats {
+			continue
+		}
+		if kind != st.Expect {
+			return errors.Errorf("received %s", describe(kind, msg))
+		}
+		return p.check(st, msg)
+	}
+}
+
+// check checks the content of the expected message
+func (p *player) check(st Step, msg *fmtp.Message) error {
+	switch st.Expect {
+	case KindIDRequest:
+		sender, receiver, _ := msg.IDRequest()
+		if want := orDefault(st.Sender, p.remote); want != "" && sender != want {
+			return errors.Errorf("expected sender %q, got %q", want, sender)
+		}
+		if p.remote == "" {
+			p.remote = sender
+		}
+		if want := orDefault(st.Receiver, p.sc.Local); want != "" && receiver != want {
+			return errors.Errorf("expected receiver %q, got %q", want, receiver)
+		}
+	case KindIDResponse:
+		accept, _ := msg.IDResponse()
+		if st.Accept != nil && accept != *st.Accept {
+			return errors.Errorf("expected accept %t, got %t", *st.Accept, accept)
+		}
+	case KindOperator, KindOperational:
+		b, err := msg.Payload()
+		if err != nil {
+			return err
+		}
+		if st.Text != "" && string(b) != st.Text {
+			return errors.Errorf("expected body %q, got %q", st.Text, b)
+		}
+		if st.Size != 0 && len(b) != st.Size {
+			return errors.Errorf("expected a body of %d bytes, got %d", st.Size, len(b))
+		}
+	}
+	return nil
+}
+
+// classify returns the kind of a received message
+func classify(msg *fmtp.Message) Kind {
+	switch msg.Typ() {
+	case fmtp.Operator:
+		return KindOperator
+	case fmtp.Operational:
+		return KindOperational
+	}
+	if sig, err := msg.SystemSignal(); err == nil {
+		switch sig {
+		case fmtp.SignalStartup:
+			return KindStartup
+		case fmtp.SignalShutdown:
+			return KindShutdown
+		case fmtp.SignalHeartbeat:
+			return KindHeartbeat
+		}
+	}
+	if _, err := msg.IDResponse(); err == nil {
+		return KindIDResponse
+	}
+	if _, _, err := msg.IDRequest(); err == nil {
+		return KindIDRequest
+	}
+	return KindUnknown
+}
+
+// describe describes a received message for the logs and errors
+func describe(kind Kind, msg *fmtp.Message) string {
+	b, _ := msg.Payload()
+	if len(b) > 32 {
+		return fmt.Sprintf("%s (%s, %d bytes: %q...)", kind, msg.Typ(), len(b), b[:32])
+	}
+	return fmt.Sprintf("%s (%s, %q)", kind, msg.Typ(), b)
+}
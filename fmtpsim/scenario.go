@@ -0,0 +1,246 @@
+// Package fmtpsim is a scriptable FMTP peer, to check how an FMTP system copes with odd behaviour from its remote party.
+//
+// A Scenario is a list of steps, each one either sending a message, expecting one, or waiting.
+// Nothing is done implicitly: the identification and association procedures are written out step by step,
+// so that any of them can be skipped, altered or broken. Scenarios are usually written in JSON:
+//
+//	{
+//		"name": "reject",
+//		"role": "responder",
+//		"local": "SIM",
+//		"steps": [
+//			{"expect": "id-request"},
+//			{"send": "id-response", "accept": false},
+//			{"expect": "close"}
+//		]
+//	}
+//
+// Messages are encoded and decoded with the fmtp package's wire helpers, save for raw bytes which are sent as given.
+package fmtpsim
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/aabizri/fmtp"
+	"github.com/pkg/errors"
+)
+
+// DefaultTimeout is how long an expectation waits by default
+const DefaultTimeout = 10 * time.Second
+
+// Role is the role of the simulator in the connection
+type Role string
+
+// The following constants define the roles of the simulator
+const (
+	// Initiator dials the system under test
+	Initiator Role = "initiator"
+
+	// Responder waits for the system under test to connect
+	Responder Role = "responder"
+)
+
+// Kind is the kind of a step's message
+type Kind string
+
+// The following constants define the kinds of messages which can be sent or expected
+const (
+	KindIDRequest   Kind = "id-request"
+	KindIDResponse  Kind = "id-response"
+	KindStartup     Kind = "startup"
+	KindShutdown    Kind = "shutdown"
+	KindHeartbeat   Kind = "heartbeat"
+	KindOperator    Kind = "operator"
+	KindOperational Kind = "operational"
+
+	// KindRaw sends raw bytes, it can only be sent
+	KindRaw Kind = "raw"
+
+	// KindClose expects the connection to be closed by the remote party, KindNothing expects silence, they can only be expected
+	KindClose   Kind = "close"
+	KindNothing Kind = "nothing"
+
+	// KindUnknown is reported for a received message which couldn't be decoded
+	KindUnknown Kind = "unknown"
+)
+
+// Duration is a time.Duration written as a string in JSON, such as "1m30s"
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return errors.Wrap(err, "duration must be a string such as \"1m30s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// RawHeader is a message header sent as is, without any validation, so that it can be malformed
+type RawHeader struct {
+	Version  uint8  `json:"version"`
+	Reserved uint8  `json:"reserved"`
+	Length   uint16 `json:"length"`
+	Typ      uint8  `json:"typ"`
+}
+
+// Step is a step of a scenario. Exactly one of Send, Expect and Wait must be set.
+type Step struct {
+	// Send is the kind of message to send
+	Send Kind `json:"send,omitempty"`
+
+	// Expect is the kind of message expected, which must be the next one received
+	Expect Kind `json:"expect,omitempty"`
+
+	// Wait is a time to wait, doing nothing
+	Wait Duration `json:"wait,omitempty"`
+
+	// Within is how long an expectation waits, the scenario's Timeout if zero
+	Within Duration `json:"within,omitempty"`
+
+	// Accept is the outcome of an id-response sent, ACCEPT if nil, or expected, anything if nil
+	Accept *bool `json:"accept,omitempty"`
+
+	// Sender and Receiver are the IDs of an id-request sent or expected.
+	// When sending, they default to the scenario's Local and Remote. When expecting, to its Remote and Local if set.
+	Sender   fmtp.ID `json:"sender,omitempty"`
+	Receiver fmtp.ID `json:"receiver,omitempty"`
+
+	// Text is the body of an operator, operational or raw message sent, or of an operator or operational message expected if set
+	Text string `json:"text,omitempty"`
+
+	// Size, if set, is the size of the body of an operator or operational message, sent filled with 'X', or expected
+	Size int `json:"size,omitempty"`
+
+	// Header and Hex are sent, in that order and before Text, with raw messages. Hex is hexadecimal-encoded.
+	Header *RawHeader `json:"header,omitempty"`
+	Hex    string     `json:"hex,omitempty"`
+}
+
+// String describes the step
+func (st Step) String() string {
+	switch {
+	case st.Send != "":
+		return "send " + string(st.Send)
+	case st.Expect != "":
+		return "expect " + string(st.Expect)
+	default:
+		return "wait " + time.Duration(st.Wait).String()
+	}
+}
+
+// Scenario is a scripted behaviour of the simulator
+type Scenario struct {
+	// Name and Description are informative
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+
+	// Role is the role of the simulator
+	Role Role `json:"role"`
+
+	// Local is the ID of the simulator, Remote the one of the system under test, used as defaults by the steps.
+	// If Remote is empty, it is learnt from the first id-request received.
+	Local  fmtp.ID `json:"local,omitempty"`
+	Remote fmtp.ID `json:"remote,omitempty"`
+
+	// Timeout is how long an expectation waits by default, DefaultTimeout if zero
+	Timeout Duration `json:"timeout,omitempty"`
+
+	// IgnoreHeartbeats makes the HEARTBEATs received be skipped, unless expected
+	IgnoreHeartbeats bool `json:"ignoreHeartbeats,omitempty"`
+
+	// Steps are played in order
+	Steps []Step `json:"steps"`
+}
+
+// Load reads a JSON scenario, validating it
+func Load(r io.Reader) (*Scenario, error) {
+	sc := &Scenario{}
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(sc)
+	if err != nil {
+		return nil, errors.Wrap(err, "Load: error while decoding scenario")
+	}
+	return sc, sc.Validate()
+}
+
+// LoadFile reads a JSON scenario from a file, see Load
+func LoadFile(path string) (*Scenario, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Load(f)
+}
+
+// sendable and expectable are the kinds which can be sent and expected
+var (
+	sendable = map[Kind]bool{
+		KindIDRequest: true, KindIDResponse: true, KindStartup: true, KindShutdown: true, KindHeartbeat: true,
+		KindOperator: true, KindOperational: true, KindRaw: true,
+	}
+	expectable = map[Kind]bool{
+		KindIDRequest: true, KindIDResponse: true, KindStartup: true, KindShutdown: true, KindHeartbeat: true,
+		KindOperator: true, KindOperational: true, KindClose: true, KindNothing: true,
+	}
+)
+
+// Validate checks that the scenario is well-formed
+func (sc *Scenario) Validate() error {
+	if sc.Role != Initiator && sc.Role != Responder {
+		return errors.Errorf("invalid role %q, must be %q or %q", sc.Role, Initiator, Responder)
+	}
+	for _, id := range []fmtp.ID{sc.Local, sc.Remote} {
+		if id == "" {
+			continue
+		}
+		if err := id.Check(); err != nil {
+			return errors.Wrapf(err, "invalid ID %q", id)
+		}
+	}
+	if len(sc.Steps) == 0 {
+		return errors.New("scenario has no steps")
+	}
+
+	for i, st := range sc.Steps {
+		set := 0
+		if st.Send != "" {
+			set++
+			if !sendable[st.Send] {
+				return errors.Errorf("step %d: %q cannot be sent", i, st.Send)
+			}
+		}
+		if st.Expect != "" {
+			set++
+			if !expectable[st.Expect] {
+				return errors.Errorf("step %d: %q cannot be expected", i, st.Expect)
+			}
+		}
+		if st.Wait != 0 {
+			set++
+		}
+		if set != 1 {
+			return errors.Errorf("step %d: exactly one of send, expect and wait must be set", i)
+		}
+		if st.Size > fmtp.MaxBodyLen {
+			return errors.Errorf("step %d: size %d larger than the maximum body length %d", i, st.Size, fmtp.MaxBodyLen)
+		}
+	}
+	return nil
+}
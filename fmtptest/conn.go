@@ -0,0 +1,118 @@
+// Package fmtptest provides utilities for testing FMTP clients, servers and handlers.
+//
+// Connections are established over in-memory pipes instead of TCP, their traffic can be dropped,
+// delayed or interleaved with raw bytes, and the messages received on each side recorded.
+// For the common case of two parties talking to each other, see NewPair.
+package fmtptest
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/aabizri/fmtp"
+)
+
+// Addr is the address of an in-memory connection or listener
+type Addr string
+
+// Network returns the network name, "fmtptest"
+func (a Addr) Network() string {
+	return "fmtptest"
+}
+
+func (a Addr) String() string {
+	return string(a)
+}
+
+// Conn is one end of an in-memory full-duplex connection, whose outgoing traffic can be altered.
+// It can be set as the underlying connection of an fmtp.Conn with SetUnderlying.
+//
+// As with net.Pipe, there is no internal buffering: a write blocks until the other end has read it.
+type Conn struct {
+	net.Conn
+
+	// peer is the other end
+	peer *Conn
+
+	// local and remote are the reported addresses
+	local, remote Addr
+
+	// mu guards the fields below
+	mu    sync.Mutex
+	drop  bool
+	delay time.Duration
+}
+
+// Pipe creates an in-memory full-duplex connection, whose ends are reported as having the given addresses
+func Pipe(addr1, addr2 string) (*Conn, *Conn) {
+	p1, p2 := net.Pipe()
+	c1 := &Conn{Conn: p1, local: Addr(addr1), remote: Addr(addr2)}
+	c2 := &Conn{Conn: p2, local: Addr(addr2), remote: Addr(addr1), peer: c1}
+	c1.peer = c2
+	return c1, c2
+}
+
+// Peer returns the other end of the connection
+func (c *Conn) Peer() *Conn {
+	return c.peer
+}
+
+// LocalAddr returns the local address
+func (c *Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns the remote address
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SetDrop sets whether the outgoing traffic is dropped.
+// When dropping, writes report success but nothing reaches the other end, as if the link went silent.
+func (c *Conn) SetDrop(drop bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.drop = drop
+}
+
+// SetDelay sets the delay applied to every outgoing write, zero meaning none.
+// The writer is blocked for the duration of the delay.
+func (c *Conn) SetDelay(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.delay = d
+}
+
+// Write writes to the other end, applying the drop and delay settings
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	drop, delay := c.drop, c.delay
+	c.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	if drop {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+// Inject makes raw bytes available to be read from this end, as if they had been written by the other end.
+// Each injection is atomic with regards to the other writes, it blocks until the bytes have all been read.
+func (c *Conn) Inject(b []byte) error {
+	_, err := c.peer.Conn.Write(b)
+	return err
+}
+
+// InjectMessage encodes a message and injects it as a whole, see Inject
+func (c *Conn) InjectMessage(msg *fmtp.Message) error {
+	buf := &bytes.Buffer{}
+	_, err := msg.WriteTo(buf)
+	if err != nil {
+		return err
+	}
+	return c.Inject(buf.Bytes())
+}
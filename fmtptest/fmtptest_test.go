@@ -0,0 +1,122 @@
+package fmtptest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aabizri/fmtp"
+	"github.com/aabizri/fmtp/clock"
+)
+
+// waitState waits for a connection to reach the given state
+func waitState(t *testing.T, conn *fmtp.Conn, want fmtp.State) {
+	t.Helper()
+	deadline := time.Now().Add(Timeout)
+	for conn.State() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected state %s, got %s", want, conn.State())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPair(t *testing.T) {
+	p := NewPair(t, PairOptions{})
+	if p.ConnA.State() != fmtp.Ready || p.ConnB.State() != fmtp.Ready {
+		t.Fatalf("expected both ends to be Ready, got %s and %s", p.ConnA.State(), p.ConnB.State())
+	}
+
+	// Exchange messages both ways
+	p.SendA(t, "hello")
+	p.RecB.ExpectBodies(t, "hello")
+	p.SendB(t, "world")
+	p.RecA.ExpectBodies(t, "world")
+
+	got := p.RecB.Messages()[0]
+	if got.From != "A" || got.Typ != fmtp.Operator {
+		t.Errorf("unexpected message %+v", got)
+	}
+	if p.ConnB.RemoteAddr().String() != p.Link.LocalAddr().String() {
+		t.Errorf("unexpected remote address %s", p.ConnB.RemoteAddr())
+	}
+}
+
+func TestInjectMessage(t *testing.T) {
+	p := NewPair(t, PairOptions{})
+	p.Associate(t)
+
+	// A message injected on B's end is received by B as if sent by A
+	msg, _ := fmtp.NewOperatorMessageString("injected")
+	if err := p.Link.Peer().InjectMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	p.RecB.ExpectBodies(t, "injected")
+}
+
+func TestInjectGarbage(t *testing.T) {
+	p := NewPair(t, PairOptions{})
+	p.Associate(t)
+
+	// A header with an invalid length makes B release the connection
+	if err := p.Link.Peer().Inject([]byte{2, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, p.ConnB, fmtp.Idle)
+}
+
+func TestDrop(t *testing.T) {
+	fc := clock.NewFake(time.Now())
+	p := NewPair(t, PairOptions{ClientB: []fmtp.ClientSetter{fmtp.SetClock(fc)}})
+	p.Associate(t)
+	fc.BlockUntil(2)
+
+	// Dropped messages never reach B
+	p.Link.SetDrop(true)
+	p.SendA(t, "lost")
+	p.RecB.ExpectNone(t, 20*time.Millisecond)
+
+	// So B shuts the association down once Tr expires
+	fc.Advance(fmtp.DefaultTr)
+	waitState(t, p.ConnB, fmtp.Ready)
+
+	// Traffic flows again once dropping stops
+	p.Link.SetDrop(false)
+	p.SendA(t, "found")
+	p.RecB.ExpectBodies(t, "found")
+}
+
+func TestDelay(t *testing.T) {
+	p := NewPair(t, PairOptions{})
+	p.Associate(t)
+
+	const delay = 20 * time.Millisecond
+	p.Link.SetDelay(delay)
+	start := time.Now()
+	p.SendA(t, "late")
+	p.RecB.ExpectBodies(t, "late")
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("message received after %s, expected at least %s", elapsed, delay)
+	}
+}
+
+func TestListenerClosed(t *testing.T) {
+	l := NewListener()
+	l.Close()
+	if _, err := l.Accept(); err == nil {
+		t.Error("Accept on a closed listener should fail")
+	}
+	if _, err := l.Dial(context.Background()); err == nil {
+		t.Error("Dial to a closed listener should fail")
+	}
+}
+
+func TestRecorderWait(t *testing.T) {
+	r := &Recorder{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	got, err := r.Wait(ctx, 1)
+	if err != context.DeadlineExceeded || len(got) != 0 {
+		t.Errorf("expected no message and %v, got %d and %v", context.DeadlineExceeded, len(got), err)
+	}
+}
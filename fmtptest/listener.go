@@ -0,0 +1,74 @@
+package fmtptest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// listenerCount numbers the listeners, so that they have distinct addresses
+var listenerCount uint64
+
+// Listener is an in-memory net.Listener, to be given to (*fmtp.Server).Serve.
+// Connections are made to it with Dial.
+type Listener struct {
+	addr  Addr
+	conns chan *Conn
+
+	// dialled numbers the connections, so that they have distinct addresses
+	dialled uint64
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewListener creates a new in-memory listener
+func NewListener() *Listener {
+	n := atomic.AddUint64(&listenerCount, 1)
+	return &Listener{
+		addr:   Addr(fmt.Sprintf("listener-%d", n)),
+		conns:  make(chan *Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// Accept waits for and returns the next connection to the listener
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the listener, the connections already accepted are left untouched
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+// Addr returns the listener's address
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
+
+// Dial connects to the listener, waiting for the connection to be accepted or the context to expire.
+// It returns the dialling end of the connection, the accepted one being its Peer.
+func (l *Listener) Dial(ctx context.Context) (*Conn, error) {
+	n := atomic.AddUint64(&l.dialled, 1)
+	c, s := Pipe(fmt.Sprintf("%s-client-%d", l.addr, n), string(l.addr))
+
+	select {
+	case l.conns <- s:
+		return c, nil
+	case <-l.closed:
+		return nil, &net.OpError{Op: "dial", Net: l.addr.Network(), Addr: l.addr, Err: net.ErrClosed}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,156 @@
+package fmtptest
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/aabizri/fmtp"
+)
+
+// PairOptions configures a Pair
+type PairOptions struct {
+	// IDA and IDB are the IDs of the initiator and the responder, "A" and "B" if empty
+	IDA, IDB fmtp.ID
+
+	// ClientA and ClientB are applied when creating the clients.
+	// The clients log nothing by default, a logger can be set with fmtp.SetLogger.
+	ClientA, ClientB []fmtp.ClientSetter
+
+	// HandlerA and HandlerB, if set, are called with every message once recorded
+	HandlerA, HandlerB fmtp.Handler
+}
+
+// Pair is two clients connected to each other over an in-memory connection.
+//
+// A is the initiator: its connection was dialled, while B is the responder: it has a Server, which accepted the connection.
+// Every message received by each side is recorded.
+type Pair struct {
+	// The clients
+	A, B *fmtp.Client
+
+	// ConnA and ConnB are each client's end of the FMTP connection
+	ConnA, ConnB *fmtp.Conn
+
+	// RecA and RecB record the messages received by each side
+	RecA, RecB *Recorder
+
+	// Link is A's end of the underlying in-memory connection, B's end being its Peer.
+	// It allows altering the traffic and injecting raw bytes.
+	Link *Conn
+
+	// Server and Listener are B's
+	Server   *fmtp.Server
+	Listener *Listener
+}
+
+// NewPair creates two clients and connects them, failing the test if it isn't possible.
+// The connection is established (Ready) but not yet associated, see (*Pair).Associate.
+// Everything is closed when the test ends.
+func NewPair(t testing.TB, opts PairOptions) *Pair {
+	t.Helper()
+	if opts.IDA == "" {
+		opts.IDA = "A"
+	}
+	if opts.IDB == "" {
+		opts.IDB = "B"
+	}
+	p := &Pair{
+		RecA:     &Recorder{Next: opts.HandlerA},
+		RecB:     &Recorder{Next: opts.HandlerB},
+		Listener: NewListener(),
+	}
+
+	// Create the clients
+	var err error
+	p.A, err = fmtp.NewClient(opts.IDA, append([]fmtp.ClientSetter{fmtp.SetLogger(fmtp.NewNopLogger())}, opts.ClientA...)...)
+	if err != nil {
+		t.Fatalf("fmtptest: error while creating client A: %v", err)
+	}
+	p.B, err = fmtp.NewClient(opts.IDB, append([]fmtp.ClientSetter{fmtp.SetLogger(fmtp.NewNopLogger())}, opts.ClientB...)...)
+	if err != nil {
+		t.Fatalf("fmtptest: error while creating client B: %v", err)
+	}
+
+	// Launch B's server, noting when the connection is established on its side
+	accepted := make(chan struct{}, 1)
+	p.Server = p.B.NewServer(p.Listener.Addr().String(), p.RecB)
+	p.Server.NotifyConn = func(net.Addr, fmtp.ID) {
+		accepted <- struct{}{}
+	}
+	go p.Server.Serve(p.Listener)
+	t.Cleanup(p.Close)
+
+	// Connect A to it
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	p.Link, err = p.Listener.Dial(ctx)
+	if err != nil {
+		t.Fatalf("fmtptest: error while dialling: %v", err)
+	}
+	p.ConnA = p.A.NewConn(p.RecA)
+	p.ConnA.SetUnderlying(p.Link)
+	err = p.ConnA.Init(ctx, "", opts.IDB)
+	if err != nil {
+		t.Fatalf("fmtptest: error while connecting: %v", err)
+	}
+
+	// Retrieve B's end
+	select {
+	case <-accepted:
+	case <-ctx.Done():
+		t.Fatalf("fmtptest: connection not established on the responder's side: %v", ctx.Err())
+	}
+	var ok bool
+	p.ConnB, ok = p.B.Conn(opts.IDA)
+	if !ok {
+		t.Fatal("fmtptest: connection not registered on the responder's side")
+	}
+
+	return p
+}
+
+// Associate associates the connection from A, failing the test if it isn't possible
+func (p *Pair) Associate(t testing.TB) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	if err := p.ConnA.Associate(ctx); err != nil {
+		t.Fatalf("fmtptest: error while associating: %v", err)
+	}
+}
+
+// SendA sends an OPERATOR message with the given text from A to B, failing the test if it isn't possible
+func (p *Pair) SendA(t testing.TB, text string) {
+	t.Helper()
+	sendText(t, p.ConnA, text)
+}
+
+// SendB sends an OPERATOR message with the given text from B to A, failing the test if it isn't possible
+func (p *Pair) SendB(t testing.TB, text string) {
+	t.Helper()
+	sendText(t, p.ConnB, text)
+}
+
+// Close closes both ends and the server, without any grace
+func (p *Pair) Close() {
+	if p.ConnA != nil {
+		p.ConnA.Close()
+	}
+	p.Server.Close()
+	p.Listener.Close()
+}
+
+// sendText sends an OPERATOR message over a connection
+func sendText(t testing.TB, conn *fmtp.Conn, text string) {
+	t.Helper()
+	msg, err := fmtp.NewOperatorMessageString(text)
+	if err != nil {
+		t.Fatalf("fmtptest: error while creating message: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	if err := conn.Send(ctx, msg); err != nil {
+		t.Fatalf("fmtptest: error while sending message: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package fmtptest
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aabizri/fmtp"
+)
+
+// Timeout is how long the assertion helpers wait for something to happen before failing the test
+var Timeout = 5 * time.Second
+
+// Received is a message received by a Recorder
+type Received struct {
+	// From is the remote party which sent it
+	From fmtp.ID
+
+	// Typ is the type of the message
+	Typ fmtp.Typ
+
+	// Body is its content
+	Body []byte
+}
+
+// Recorder is an fmtp.Handler recording the messages it receives.
+// The zero value is ready to use.
+type Recorder struct {
+	// Next, if set, is called with every message once recorded
+	Next fmtp.Handler
+
+	// mu guards the fields below
+	mu       sync.Mutex
+	received []Received
+	changed  chan struct{}
+}
+
+// ServeFMTP records a copy of the message, then passes it on to Next if set
+func (r *Recorder) ServeFMTP(conn *fmtp.Conn, msg *fmtp.Message) {
+	body, err := msg.Payload()
+	if err != nil {
+		return
+	}
+	body = append([]byte(nil), body...)
+
+	r.mu.Lock()
+	r.received = append(r.received, Received{From: conn.RemoteID(), Typ: msg.Typ(), Body: body})
+	if r.changed != nil {
+		close(r.changed)
+		r.changed = nil
+	}
+	r.mu.Unlock()
+
+	if r.Next != nil {
+		r.Next.ServeFMTP(conn, msg)
+	}
+}
+
+// Messages returns the messages received so far, in order of reception
+func (r *Recorder) Messages() []Received {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Received(nil), r.received...)
+}
+
+// Reset forgets the messages received so far
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.received = nil
+}
+
+// Wait waits until at least n messages have been received, returning them all.
+// If the context expires before, the messages received so far are returned along with the context's error.
+func (r *Recorder) Wait(ctx context.Context, n int) ([]Received, error) {
+	for {
+		r.mu.Lock()
+		if len(r.received) >= n {
+			received := append([]Received(nil), r.received...)
+			r.mu.Unlock()
+			return received, nil
+		}
+		if r.changed == nil {
+			r.changed = make(chan struct{})
+		}
+		changed := r.changed
+		r.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return r.Messages(), ctx.Err()
+		}
+	}
+}
+
+// ExpectBodies waits for the given bodies to be received, in order, failing the test otherwise.
+// It only considers the first len(want) messages received, further ones are ignored.
+func (r *Recorder) ExpectBodies(t testing.TB, want ...string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	got, err := r.Wait(ctx, len(want))
+	if err != nil {
+		t.Fatalf("fmtptest: expected %d messages, only got %d: %v", len(want), len(got), err)
+	}
+	for i := range want {
+		if string(got[i].Body) != want[i] {
+			t.Errorf("fmtptest: message %d: expected body %q, got %q", i, want[i], got[i].Body)
+		}
+	}
+}
+
+// ExpectNone fails the test if any message has been received within the given duration
+func (r *Recorder) ExpectNone(t testing.TB, d time.Duration) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+
+	got, err := r.Wait(ctx, 1)
+	if err == nil {
+		t.Errorf("fmtptest: expected no message, got %d, the first one being %q", len(got), got[0].Body)
+	}
+}
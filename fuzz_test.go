@@ -0,0 +1,214 @@
+package fmtp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+)
+
+// encode returns the wire form of messages
+func encode(t testing.TB, msgs ...*Message) []byte {
+	buf := &bytes.Buffer{}
+	for _, msg := range msgs {
+		if _, err := msg.WriteTo(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// mustMessage panics if a seed message cannot be created
+func mustMessage(msg *Message, err error) *Message {
+	if err != nil {
+		panic(err)
+	}
+	return msg
+}
+
+func FuzzHeaderUnmarshalBinary(f *testing.F) {
+	for _, typ := range []Typ{Operational, Operator, identification, system} {
+		h := newHeader(typ)
+		h.setBodyLen(2)
+		b, _ := h.MarshalBinary()
+		f.Add(b)
+	}
+	f.Add([]byte{2, 0, 0x28, 0x05, 2})
+	f.Add([]byte{2, 0, 0, 4, 4})
+	f.Add([]byte{2, 0, 0xff, 0xff, 1})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		h := &header{}
+		if err := h.UnmarshalBinary(b); err != nil {
+			return
+		}
+		if h.length < headerLen || h.length > maxLength {
+			t.Fatalf("accepted length %d", h.length)
+		}
+		out, err := h.MarshalBinary()
+		if err != nil {
+			t.Fatalf("cannot marshal back %v: %v", b, err)
+		}
+		if !bytes.Equal(out, b) {
+			t.Fatalf("round trip mismatch: %v became %v", b, out)
+		}
+	})
+}
+
+func FuzzIDRequestUnmarshalBinary(f *testing.F) {
+	f.Add([]byte("PEER-SUT"))
+	f.Add([]byte("A-B"))
+	f.Add([]byte("-"))
+	f.Add([]byte("A-B-C"))
+	f.Add([]byte(strings.Repeat("X", maxIDLen) + "-" + strings.Repeat("Y", maxIDLen)))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		idr := &idRequest{}
+		if err := idr.UnmarshalBinary(b); err != nil {
+			return
+		}
+		out, err := idr.MarshalBinary()
+		if err != nil {
+			t.Fatalf("cannot marshal back %q: %v", b, err)
+		}
+		if !bytes.Equal(out, b) {
+			t.Fatalf("round trip mismatch: %q became %q", b, out)
+		}
+	})
+}
+
+func FuzzIDResponseUnmarshalBinary(f *testing.F) {
+	f.Add([]byte(accept))
+	f.Add([]byte(reject))
+	f.Add([]byte("accept"))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		idr := &idResponse{}
+		if err := idr.UnmarshalBinary(b); err != nil {
+			return
+		}
+		out, err := idr.MarshalBinary()
+		if err != nil {
+			t.Fatalf("cannot marshal back %q: %v", b, err)
+		}
+		if !bytes.Equal(out, b) {
+			t.Fatalf("round trip mismatch: %q became %q", b, out)
+		}
+	})
+}
+
+func FuzzSystemSigUnmarshalBinary(f *testing.F) {
+	f.Add([]byte("01"))
+	f.Add([]byte("00"))
+	f.Add([]byte("03"))
+	f.Add([]byte("0"))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		ss := &systemSig{}
+		if err := ss.UnmarshalBinary(b); err != nil {
+			return
+		}
+		out, _ := ss.MarshalBinary()
+		if !bytes.Equal(out, b) {
+			t.Fatalf("round trip mismatch: %q became %q", b, out)
+		}
+	})
+}
+
+func FuzzMessageReadFrom(f *testing.F) {
+	f.Add(encode(f, mustMessage(newIDRequestMessage("PEER", "SUT"))))
+	f.Add(encode(f, mustMessage(newIDResponseMessage(true))))
+	f.Add(encode(f, mustMessage(newSystemMessage(startup))))
+	f.Add(encode(f, mustMessage(NewOperatorMessageString("hello"))))
+	f.Add(encode(f, mustMessage(NewOperationalMessage(bytes.NewReader(make([]byte, CompatBodyLen))))))
+	f.Add([]byte{2, 0, 0, 10, 1, 'a'})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		msg := &Message{}
+		n, err := msg.ReadFrom(bytes.NewReader(b))
+		if n > int64(len(b)) {
+			t.Fatalf("read %d bytes out of %d", n, len(b))
+		}
+		if err != nil {
+			return
+		}
+
+		// What was read must be written back identically
+		if out := encode(t, msg); !bytes.Equal(out, b[:n]) {
+			t.Fatalf("round trip mismatch: %v became %v", b[:n], out)
+		}
+	})
+}
+
+// FuzzResponder feeds a byte stream to a responding connection, which must be released without panicking nor leaking goroutines
+func FuzzResponder(f *testing.F) {
+	var (
+		idRequest  = encode(f, mustMessage(newIDRequestMessage("PEER", "SUT")))
+		idResponse = encode(f, mustMessage(newIDResponseMessage(true)))
+		startupMsg = encode(f, mustMessage(newSystemMessage(startup)))
+		data       = encode(f, mustMessage(NewOperatorMessageString("hello")))
+		heartbeat  = encode(f, mustMessage(newSystemMessage(heartbeat)))
+		shutdown   = encode(f, mustMessage(newSystemMessage(shutdown)))
+	)
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	f.Add([]byte{})
+	f.Add(idRequest)
+	f.Add(join(idRequest, idResponse))
+	f.Add(join(idRequest, idResponse, startupMsg, data, heartbeat))
+	f.Add(join(idRequest, idResponse, startupMsg, data, shutdown, startupMsg, data))
+	f.Add(join(idRequest, idResponse, data, startupMsg))
+	f.Add(join(idRequest, idResponse, startupMsg, []byte{2, 0, 0, 1, 1}))
+	f.Add(join(idRequest, encode(f, mustMessage(newIDResponseMessage(false)))))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		base := runtime.NumGoroutine()
+
+		c, err := NewClient("SUT", SetLogger(NewNopLogger()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		remote, local := net.Pipe()
+		conn := c.NewConn(HandlerFunc(func(*Conn, *Message) {}))
+		conn.SetUnderlying(local)
+
+		// Serve it as the server does
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if err := conn.recv(context.Background()); err != nil {
+				local.Close()
+				return
+			}
+			<-conn.closed
+		}()
+
+		// Discard what the connection sends, and feed it the input before disconnecting
+		go io.Copy(ioutil.Discard, remote)
+		remote.Write(b)
+		remote.Close()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("connection not released once disconnected")
+		}
+
+		// Every goroutine must have stopped
+		deadline := time.Now().Add(time.Second)
+		for runtime.NumGoroutine() > base {
+			if time.Now().After(deadline) {
+				buf := &bytes.Buffer{}
+				pprof.Lookup("goroutine").WriteTo(buf, 1)
+				t.Fatalf("%d goroutines leaked:\n%s", runtime.NumGoroutine()-base, buf)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+}
@@ -60,25 +60,25 @@ func (h *header) String() string {
 
 // MarshalBinary marshals a header into binary form
 func (h *header) MarshalBinary() ([]byte, error) {
-	// Check
-	err := h.Check()
+	out := make([]byte, headerLen)
+	err := h.put(out)
 	if err != nil {
 		return nil, err
 	}
+	return out, nil
+}
 
-	// Get the length in binary
-	lenBuf := make([]byte, 2)
-	binary.BigEndian.PutUint16(lenBuf, h.length)
-
-	// Now create the byte slice
-	out := []byte{
-		byte(h.version),
-		byte(h.reserved),
-		byte(lenBuf[0]),
-		byte(lenBuf[1]),
-		byte(h.typ),
+// put checks and marshals a header into b, which must be headerLen long
+func (h *header) put(b []byte) error {
+	err := h.Check()
+	if err != nil {
+		return err
 	}
-	return out, nil
+	b[0] = h.version
+	b[1] = h.reserved
+	binary.BigEndian.PutUint16(b[2:4], h.length)
+	b[4] = byte(h.typ)
+	return nil
 }
 
 func (h *header) UnmarshalBinary(b []byte) error {
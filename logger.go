@@ -0,0 +1,158 @@
+package fmtp
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// These are the names of the fields attached to log entries
+const (
+	FieldRemoteID   = "remote_id"
+	FieldRemoteAddr = "remote_addr"
+	FieldState      = "state"
+	FieldMsgType    = "msg_type"
+)
+
+// Fields are the structured fields attached to a log entry
+type Fields map[string]interface{}
+
+// Logger is the structured logger used by a client, see SetLogger
+type Logger interface {
+	// With returns a logger attaching the given fields to every entry
+	With(fields Fields) Logger
+
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// SetLogger sets the logger of a client, and of its connections and servers
+// By default, entries of Info level and above are written to stderr using logrus.
+func SetLogger(logger Logger) ClientSetter {
+	return func(c *Client) error {
+		if logger == nil {
+			return errors.New("SetLogger: given logger is nil, can't set")
+		}
+		c.logger = logger
+		return nil
+	}
+}
+
+// defaultLogger returns the logger used when none has been set
+func defaultLogger() Logger {
+	return NewLogrusLogger(&logrus.Logger{
+		Out:       os.Stderr,
+		Level:     logrus.InfoLevel,
+		Formatter: new(logrus.TextFormatter),
+		Hooks:     make(logrus.LevelHooks),
+	})
+}
+
+// log returns the connection's logger, attaching the connection's remote ID and remote address.
+// Until setLogger has been called, the fields are attached on every call.
+func (conn *Conn) log() Logger {
+	if conn.logger != nil {
+		return conn.logger
+	}
+	return conn.client.logger.With(conn.logFields())
+}
+
+// setLogger builds the connection's logger once and for all, when its remote ID and underlying connection are known
+func (conn *Conn) setLogger() {
+	conn.logger = conn.client.logger.With(conn.logFields())
+}
+
+// logFields returns the fields attached to the connection's log entries
+func (conn *Conn) logFields() Fields {
+	fields := Fields{FieldRemoteID: string(conn.remote)}
+	if addr := conn.RemoteAddr(); addr != nil {
+		fields[FieldRemoteAddr] = addr.String()
+	}
+	return fields
+}
+
+// logrusLogger is a Logger backed by logrus
+type logrusLogger struct {
+	l logrus.FieldLogger
+}
+
+// NewLogrusLogger returns a Logger backed by a logrus logger or entry
+func NewLogrusLogger(l logrus.FieldLogger) Logger {
+	return logrusLogger{l: l}
+}
+
+func (ll logrusLogger) With(fields Fields) Logger {
+	return logrusLogger{l: ll.l.WithFields(logrus.Fields(fields))}
+}
+
+func (ll logrusLogger) Debugf(format string, args ...interface{}) { ll.l.Debugf(format, args...) }
+func (ll logrusLogger) Infof(format string, args ...interface{})  { ll.l.Infof(format, args...) }
+func (ll logrusLogger) Warnf(format string, args ...interface{})  { ll.l.Warnf(format, args...) }
+func (ll logrusLogger) Errorf(format string, args ...interface{}) { ll.l.Errorf(format, args...) }
+
+// slogLogger is a Logger backed by log/slog
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// NewSlogLogger returns a Logger backed by a log/slog logger
+func NewSlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l: l}
+}
+
+func (sl slogLogger) With(fields Fields) Logger {
+	// Sort the keys, so that the attributes come in a stable order
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	args := make([]interface{}, 0, 2*len(fields))
+	for _, k := range keys {
+		args = append(args, k, fields[k])
+	}
+	return slogLogger{l: sl.l.With(args...)}
+}
+
+// log formats and logs the message, if the level is enabled
+func (sl slogLogger) log(level slog.Level, format string, args ...interface{}) {
+	ctx := context.Background()
+	if !sl.l.Enabled(ctx, level) {
+		return
+	}
+	sl.l.Log(ctx, level, fmt.Sprintf(format, args...))
+}
+
+func (sl slogLogger) Debugf(format string, args ...interface{}) {
+	sl.log(slog.LevelDebug, format, args...)
+}
+func (sl slogLogger) Infof(format string, args ...interface{}) {
+	sl.log(slog.LevelInfo, format, args...)
+}
+func (sl slogLogger) Warnf(format string, args ...interface{}) {
+	sl.log(slog.LevelWarn, format, args...)
+}
+func (sl slogLogger) Errorf(format string, args ...interface{}) {
+	sl.log(slog.LevelError, format, args...)
+}
+
+// nopLogger discards everything
+type nopLogger struct{}
+
+// NewNopLogger returns a Logger discarding every entry
+func NewNopLogger() Logger {
+	return nopLogger{}
+}
+
+func (nopLogger) With(Fields) Logger            { return nopLogger{} }
+func (nopLogger) Debugf(string, ...interface{}) {}
+func (nopLogger) Infof(string, ...interface{})  {}
+func (nopLogger) Warnf(string, ...interface{})  {}
+func (nopLogger) Errorf(string, ...interface{}) {}
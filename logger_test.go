@@ -0,0 +1,118 @@
+package fmtp
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"testing"
+)
+
+// entries decodes the JSON entries logged
+func entries(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var got []map[string]interface{}
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var entry map[string]interface{}
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, entry)
+	}
+	return got
+}
+
+// expectFields checks the fields of a log entry
+func expectFields(t *testing.T, entry map[string]interface{}, want map[string]interface{}) {
+	t.Helper()
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("%s: expected %v, got %v", k, v, entry[k])
+		}
+	}
+}
+
+func TestSlogLoggerFields(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewSlogLogger(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	c, err := NewClient("A", SetLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	conn := c.NewConn(nil)
+	conn.SetUnderlying(p1)
+	conn.remote = "B"
+	conn.setLogger()
+
+	// Debug entries are filtered out by the handler
+	conn.log().With(Fields{FieldMsgType: Operator.String()}).Debugf("hidden")
+	conn.log().With(Fields{FieldMsgType: Operator.String()}).Warnf("message %d", 1)
+
+	got := entries(t, &buf)
+	if len(got) != 1 {
+		t.Fatalf("expected a single entry, got %d", len(got))
+	}
+	expectFields(t, got[0], map[string]interface{}{
+		"level":         "WARN",
+		"msg":           "message 1",
+		FieldRemoteID:   "B",
+		FieldRemoteAddr: p1.RemoteAddr().String(),
+		FieldMsgType:    Operator.String(),
+	})
+	if _, ok := got[0][FieldState]; ok {
+		t.Errorf("expected no state outside of transitions, got %v", got[0][FieldState])
+	}
+}
+
+func TestSlogLoggerTransition(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewSlogLogger(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	c, err := NewClient("A", SetLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := c.NewConn(nil)
+	conn.remote = "B"
+	if err := conn.transition(connectEvt); err != nil {
+		t.Fatal(err)
+	}
+
+	got := entries(t, &buf)
+	if len(got) != 1 {
+		t.Fatalf("expected a single entry, got %d", len(got))
+	}
+	expectFields(t, got[0], map[string]interface{}{
+		FieldRemoteID: "B",
+		FieldState:    ConnPending.String(),
+	})
+}
+
+func TestLogAllocs(t *testing.T) {
+	c, err := NewClient("A", SetLogger(NewNopLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := c.NewConn(nil)
+	conn.remote = "B"
+	conn.setLogger()
+	if n := testing.AllocsPerRun(100, func() {
+		conn.log().Debugf("received new order")
+	}); n != 0 {
+		t.Errorf("expected no allocation, got %v", n)
+	}
+}
+
+func TestNopLogger(t *testing.T) {
+	logger := NewNopLogger().With(Fields{FieldRemoteID: "B"})
+	if logger != NewNopLogger() {
+		t.Errorf("expected a nop logger, got %T", logger)
+	}
+	logger.Debugf("%d", 1)
+	logger.Infof("%d", 1)
+	logger.Warnf("%d", 1)
+	logger.Errorf("%d", 1)
+}
@@ -6,8 +6,6 @@ import (
 	"io/ioutil"
 	"strings"
 
-	"bufio"
-
 	"github.com/pkg/errors"
 )
 
@@ -61,86 +59,15 @@ func (msg *Message) bodyLen() (int, bool) {
 // WriteTo writes a Message to the given io.Writer.
 // This consumes the Message Body.
 func (msg *Message) WriteTo(w io.Writer) (int64, error) {
-	// Check if message is valid
-	if msg.header == nil {
-		return 0, errors.New("WriteTo: cannot write message as header is nil")
-	}
-
-	// Read the body into a []byte
-	r := io.LimitReader(msg.Body, MaxBodyLen+1)
-	defer msg.Body.Close()
-	bbin, err := ioutil.ReadAll(r)
-	if err != nil {
-		return 0, err
-	} else if len(bbin) > MaxBodyLen {
-		return 0, errors.New("WriteTo: cannot write message as body is larger than MaxBodyLen")
-	}
-
-	// Set the correct body length in the header
-	msg.header.setBodyLen(uint16(len(bbin)))
-
-	// Marshal it
-	hbin, err := msg.header.MarshalBinary()
-	if err != nil {
-		return 0, err
-	}
-
-	// Write using a bufio.Writer
-	wbuf := bufio.NewWriterSize(w, len(bbin)+len(hbin))
-	nb1, err := wbuf.Write(hbin)
-	if err != nil {
-		return 0, err
-	}
-	nb2, err := wbuf.Write(bbin)
-	if err != nil {
-		return 0, err
-	}
-	total := int64(nb1 + nb2)
-
-	// Flush !
-	err = wbuf.Flush()
-	if err != nil {
-		return total, err
-	}
-
-	return total, nil
+	return NewEncoder(w).encode(msg)
 }
 
 // ReadFrom creates a m.Message from an io.Reader.
+// It reads exactly one message, without reading ahead nor pooling its body, use a Decoder to read a stream of messages.
 func (msg *Message) ReadFrom(r io.Reader) (int64, error) {
-	// First we decode the header
-	h := &header{}
-	b := make([]byte, headerLen)
-
-	// Read the expected length
-	n1, err := r.Read(b)
-	if err != nil {
-		return int64(n1), err
-	}
-
-	// Unmarshal it
-	err = h.UnmarshalBinary(b)
-	if err != nil {
-		return int64(n1), err
-	}
-	msg.header = h
-
-	// Now, given the header-indicated size we create a buffer of that size
-	bodyLen := h.bodyLen()
-	content := make([]byte, bodyLen)
-	n2, err := io.ReadFull(r, content)
-	total := int64(n1 + n2)
-	if err != nil {
-		return total, err
-	} else if n2 < bodyLen {
-		return total, errors.Errorf("ReadFrom: message body is smaller than expected (%d<%d)", n2, bodyLen)
-	}
-
-	// And we create a bytes.Reader from it
-	body := ioutil.NopCloser(bytes.NewReader(content))
-	msg.Body = body
-
-	return total, nil
+	dec := &Decoder{r: r}
+	err := dec.Decode(msg)
+	return dec.off, err
 }
 
 // Typ returns the message's type
@@ -237,3 +164,44 @@ func newIDResponseMessage(accept bool) (*Message, error) {
 func newSystemMessage(ss *systemSig) (*Message, error) {
 	return NewMessage(system, bytes.NewReader(ss[:]))
 }
+
+// release closes the body of a message once handled, giving its buffer back if it was lent
+func (msg *Message) release() {
+	if msg.Body != nil {
+		msg.Body.Close()
+	}
+}
+
+// bufferedBody is a message body read into memory by MatchPayload, so that it can be read again
+type bufferedBody struct {
+	*bytes.Reader
+	b []byte
+}
+
+// Close satisfies io.Closer
+func (bb *bufferedBody) Close() error {
+	return nil
+}
+
+// Payload returns the message body, reading it into memory if needed so that it can still be read by the handler.
+// It fails if the body is larger than MaxBodyLen.
+//
+// The body of a message received is lent to the handler: the returned slice must not be retained once ServeFMTP returns.
+func (msg *Message) Payload() ([]byte, error) {
+	switch b := msg.Body.(type) {
+	case *bufferedBody:
+		return b.b, nil
+	case *lentBody:
+		return b.b, nil
+	}
+	if msg.Body == nil {
+		return nil, nil
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(msg.Body, MaxBodyLen+1))
+	msg.Body.Close()
+	msg.Body = &bufferedBody{Reader: bytes.NewReader(b), b: b}
+	if err == nil && len(b) > MaxBodyLen {
+		err = errors.New("Payload: body is larger than MaxBodyLen")
+	}
+	return b, err
+}
@@ -0,0 +1,313 @@
+package fmtp
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Timer designates one of the FMTP timers
+type Timer string
+
+// The following constants define the FMTP timers
+const (
+	TimerTi Timer = "ti"
+	TimerTs Timer = "ts"
+	TimerTr Timer = "tr"
+)
+
+// Metrics collects measurements about the connections of a client, see SetMetrics
+// Its methods are called synchronously from the connections' goroutines, so they should be fast and safe for concurrent use.
+type Metrics interface {
+	// MessageSent is called for every message sent, with its size on the wire and the time it took to send it
+	MessageSent(remote ID, typ Typ, size int, latency time.Duration)
+
+	// SendFailed is called for every message which couldn't be sent
+	SendFailed(remote ID, typ Typ)
+
+	// MessageReceived is called for every message received, with its size on the wire
+	MessageReceived(remote ID, typ Typ, size int)
+
+	// HeartbeatSent is called for every HEARTBEAT sent
+	HeartbeatSent(remote ID)
+
+	// HeartbeatReceived is called for every HEARTBEAT received
+	HeartbeatReceived(remote ID)
+
+	// TimerExpired is called every time a timer expires
+	TimerExpired(remote ID, timer Timer)
+
+	// ConnectionRejected is called for every connection rejected during the identification phase, by the remote or the local party
+	ConnectionRejected(remote ID, byRemote bool)
+
+	// AssociationChanged is called every time an association is established or lost
+	AssociationChanged(remote ID, up bool)
+}
+
+// SetMetrics sets the metrics collector of a client, by default no metrics are collected
+func SetMetrics(m Metrics) ClientSetter {
+	return func(c *Client) error {
+		if m == nil {
+			return errors.New("SetMetrics: given collector is nil, can't set")
+		}
+		c.metrics = m
+		return nil
+	}
+}
+
+// nopMetrics collects nothing
+type nopMetrics struct{}
+
+func (nopMetrics) MessageSent(ID, Typ, int, time.Duration) {}
+func (nopMetrics) SendFailed(ID, Typ)                      {}
+func (nopMetrics) MessageReceived(ID, Typ, int)            {}
+func (nopMetrics) HeartbeatSent(ID)                        {}
+func (nopMetrics) HeartbeatReceived(ID)                    {}
+func (nopMetrics) TimerExpired(ID, Timer)                  {}
+func (nopMetrics) ConnectionRejected(ID, bool)             {}
+func (nopMetrics) AssociationChanged(ID, bool)             {}
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the send latency histogram buckets
+var DefaultLatencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// histogram is a cumulative histogram
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// family is a metric family, indexed by the rendered label set
+type family struct {
+	name, help, typ string
+	values          map[string]float64
+	histograms      map[string]*histogram
+}
+
+// PrometheusMetrics is a Metrics collector exposing its measurements in the Prometheus text format.
+// It is an http.Handler, to be scraped by Prometheus.
+type PrometheusMetrics struct {
+	buckets []float64
+
+	mu       sync.Mutex
+	families []*family
+	byName   map[string]*family
+}
+
+// These are the names of the metrics exposed by PrometheusMetrics
+const (
+	metricMessagesSent      = "fmtp_messages_sent_total"
+	metricBytesSent         = "fmtp_bytes_sent_total"
+	metricSendErrors        = "fmtp_send_errors_total"
+	metricSendLatency       = "fmtp_send_latency_seconds"
+	metricMessagesReceived  = "fmtp_messages_received_total"
+	metricBytesReceived     = "fmtp_bytes_received_total"
+	metricHeartbeatsSent    = "fmtp_heartbeats_sent_total"
+	metricHeartbeatsRecv    = "fmtp_heartbeats_received_total"
+	metricTimerExpirations  = "fmtp_timer_expirations_total"
+	metricRejections        = "fmtp_connection_rejections_total"
+	metricAssociationChange = "fmtp_association_changes_total"
+	metricAssociationUp     = "fmtp_association_up"
+)
+
+// NewPrometheusMetrics returns a new collector, using DefaultLatencyBuckets for the send latency histogram
+func NewPrometheusMetrics() *PrometheusMetrics {
+	pm := &PrometheusMetrics{
+		buckets: DefaultLatencyBuckets,
+		byName:  make(map[string]*family),
+	}
+	pm.register(metricMessagesSent, "counter", "Messages sent, per remote party and message type.")
+	pm.register(metricBytesSent, "counter", "Bytes sent, per remote party and message type.")
+	pm.register(metricSendErrors, "counter", "Messages which couldn't be sent, per remote party and message type.")
+	pm.register(metricSendLatency, "histogram", "Time taken to send a message, per remote party and message type.")
+	pm.register(metricMessagesReceived, "counter", "Messages received, per remote party and message type.")
+	pm.register(metricBytesReceived, "counter", "Bytes received, per remote party and message type.")
+	pm.register(metricHeartbeatsSent, "counter", "HEARTBEAT messages sent, per remote party.")
+	pm.register(metricHeartbeatsRecv, "counter", "HEARTBEAT messages received, per remote party.")
+	pm.register(metricTimerExpirations, "counter", "Expirations of the ti, ts and tr timers, per remote party.")
+	pm.register(metricRejections, "counter", "Connections rejected during identification, per remote party and rejecting party.")
+	pm.register(metricAssociationChange, "counter", "Associations established (up) and lost (down), per remote party.")
+	pm.register(metricAssociationUp, "gauge", "Whether the association with the remote party is established.")
+	return pm
+}
+
+// register registers a metric family
+func (pm *PrometheusMetrics) register(name, typ, help string) {
+	f := &family{name: name, help: help, typ: typ, values: make(map[string]float64), histograms: make(map[string]*histogram)}
+	pm.families = append(pm.families, f)
+	pm.byName[name] = f
+}
+
+// escapeLabel escapes a label value
+var escapeLabel = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace
+
+// labels renders a label set, given as name & value pairs
+func labels(pairs ...string) string {
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+`="`+escapeLabel(pairs[i+1])+`"`)
+	}
+	return strings.Join(parts, ",")
+}
+
+// add adds v to a counter
+func (pm *PrometheusMetrics) add(name, lbls string, v float64) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.byName[name].values[lbls] += v
+}
+
+// set sets a gauge
+func (pm *PrometheusMetrics) set(name, lbls string, v float64) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.byName[name].values[lbls] = v
+}
+
+// observe adds an observation to a histogram
+func (pm *PrometheusMetrics) observe(name, lbls string, v float64) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	f := pm.byName[name]
+	h := f.histograms[lbls]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(pm.buckets))}
+		f.histograms[lbls] = h
+	}
+	for i, upper := range pm.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// MessageSent satisfies Metrics
+func (pm *PrometheusMetrics) MessageSent(remote ID, typ Typ, size int, latency time.Duration) {
+	lbls := labels("remote", string(remote), "type", typ.String())
+	pm.add(metricMessagesSent, lbls, 1)
+	pm.add(metricBytesSent, lbls, float64(size))
+	pm.observe(metricSendLatency, lbls, latency.Seconds())
+}
+
+// SendFailed satisfies Metrics
+func (pm *PrometheusMetrics) SendFailed(remote ID, typ Typ) {
+	pm.add(metricSendErrors, labels("remote", string(remote), "type", typ.String()), 1)
+}
+
+// MessageReceived satisfies Metrics
+func (pm *PrometheusMetrics) MessageReceived(remote ID, typ Typ, size int) {
+	lbls := labels("remote", string(remote), "type", typ.String())
+	pm.add(metricMessagesReceived, lbls, 1)
+	pm.add(metricBytesReceived, lbls, float64(size))
+}
+
+// HeartbeatSent satisfies Metrics
+func (pm *PrometheusMetrics) HeartbeatSent(remote ID) {
+	pm.add(metricHeartbeatsSent, labels("remote", string(remote)), 1)
+}
+
+// HeartbeatReceived satisfies Metrics
+func (pm *PrometheusMetrics) HeartbeatReceived(remote ID) {
+	pm.add(metricHeartbeatsRecv, labels("remote", string(remote)), 1)
+}
+
+// TimerExpired satisfies Metrics
+func (pm *PrometheusMetrics) TimerExpired(remote ID, timer Timer) {
+	pm.add(metricTimerExpirations, labels("remote", string(remote), "timer", string(timer)), 1)
+}
+
+// ConnectionRejected satisfies Metrics
+func (pm *PrometheusMetrics) ConnectionRejected(remote ID, byRemote bool) {
+	by := "local"
+	if byRemote {
+		by = "remote"
+	}
+	pm.add(metricRejections, labels("remote", string(remote), "by", by), 1)
+}
+
+// AssociationChanged satisfies Metrics
+func (pm *PrometheusMetrics) AssociationChanged(remote ID, up bool) {
+	direction, v := "down", 0.0
+	if up {
+		direction, v = "up", 1.0
+	}
+	pm.add(metricAssociationChange, labels("remote", string(remote), "direction", direction), 1)
+	pm.set(metricAssociationUp, labels("remote", string(remote)), v)
+}
+
+// sortedKeys returns the keys of a map, sorted
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatFloat formats a value the way Prometheus expects it
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sample formats a sample line
+func sample(name, lbls string, v string) string {
+	if lbls == "" {
+		return name + " " + v + "\n"
+	}
+	return name + "{" + lbls + "} " + v + "\n"
+}
+
+// WriteTo writes the metrics in the Prometheus text format
+func (pm *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	pm.mu.Lock()
+	var b strings.Builder
+	for _, f := range pm.families {
+		if len(f.values) == 0 && len(f.histograms) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		for _, lbls := range sortedKeys(f.values) {
+			b.WriteString(sample(f.name, lbls, formatFloat(f.values[lbls])))
+		}
+
+		// Histograms have their buckets, sum & count
+		keys := make([]string, 0, len(f.histograms))
+		for k := range f.histograms {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, lbls := range keys {
+			h := f.histograms[lbls]
+			sep := ""
+			if lbls != "" {
+				sep = ","
+			}
+			for i, upper := range pm.buckets {
+				b.WriteString(sample(f.name+"_bucket", lbls+sep+`le="`+formatFloat(upper)+`"`, strconv.FormatUint(h.counts[i], 10)))
+			}
+			b.WriteString(sample(f.name+"_bucket", lbls+sep+`le="+Inf"`, strconv.FormatUint(h.count, 10)))
+			b.WriteString(sample(f.name+"_sum", lbls, formatFloat(h.sum)))
+			b.WriteString(sample(f.name+"_count", lbls, strconv.FormatUint(h.count, 10)))
+		}
+	}
+	pm.mu.Unlock()
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format
+func (pm *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	pm.WriteTo(w)
+}
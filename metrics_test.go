@@ -0,0 +1,152 @@
+package fmtp
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connectPipe connects a client to a responder over an in-memory pipe, returning the initiator's and the responder's connections
+func connectPipe(t *testing.T, initiator, responder *Client, h Handler, acceptRemote func(ID) bool) (*Conn, *Conn, error) {
+	p1, p2 := net.Pipe()
+	ci := initiator.NewConn(nil)
+	ci.SetUnderlying(p1)
+	cr := responder.NewConn(h)
+	cr.SetUnderlying(p2)
+	if acceptRemote != nil {
+		cr.SetAcceptRemote(acceptRemote)
+	}
+	t.Cleanup(func() {
+		ci.Close()
+		cr.Close()
+	})
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- cr.recv(context.Background())
+	}()
+	err := ci.Init(context.Background(), "", responder.id)
+	if rerr := <-errc; err == nil {
+		err = rerr
+	}
+	return ci, cr, err
+}
+
+// scrape scrapes the metrics over HTTP
+func scrape(t *testing.T, pm *PrometheusMetrics) string {
+	srv := httptest.NewServer(pm)
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// expectLines checks that every expected line is in the exposition
+func expectLines(t *testing.T, exposition string, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		if !strings.Contains(exposition, "\n"+line+"\n") {
+			t.Errorf("expected line %q in:\n%s", line, exposition)
+		}
+	}
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	pmA, pmB := NewPrometheusMetrics(), NewPrometheusMetrics()
+	a, _ := NewClient("A", SetMetrics(pmA), SetLogger(NewNopLogger()))
+	b, _ := NewClient("B", SetMetrics(pmB), SetLogger(NewNopLogger()))
+
+	received := make(chan struct{})
+	h := HandlerFunc(func(conn *Conn, msg *Message) {
+		close(received)
+	})
+	ca, _, err := connectPipe(t, a, b, h, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Send a message, associating in the process
+	msg, _ := NewOperatorMessageString("hello")
+	if err := ca.Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+
+	exposition := scrape(t, pmB)
+	expectLines(t, exposition,
+		"# TYPE fmtp_messages_received_total counter",
+		`fmtp_messages_received_total{remote="A",type="Operator"} 1`,
+		`fmtp_bytes_received_total{remote="A",type="Operator"} 10`,
+		`fmtp_messages_received_total{remote="A",type="System"} 1`,
+		`fmtp_messages_sent_total{remote="A",type="System"} 1`,
+		`fmtp_association_changes_total{remote="A",direction="up"} 1`,
+		`fmtp_association_up{remote="A"} 1`,
+	)
+
+	exposition = scrape(t, pmA)
+	expectLines(t, exposition,
+		`fmtp_messages_sent_total{remote="B",type="Operator"} 1`,
+		`fmtp_bytes_sent_total{remote="B",type="Operator"} 10`,
+		"# TYPE fmtp_send_latency_seconds histogram",
+		`fmtp_send_latency_seconds_bucket{remote="B",type="Operator",le="+Inf"} 1`,
+		`fmtp_send_latency_seconds_count{remote="B",type="Operator"} 1`,
+	)
+
+	// Lose the association
+	if err := ca.Deassociate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expectLines(t, scrape(t, pmA),
+		`fmtp_association_changes_total{remote="B",direction="down"} 1`,
+		`fmtp_association_up{remote="B"} 0`,
+	)
+}
+
+func TestPrometheusMetricsRejection(t *testing.T) {
+	pmA, pmB := NewPrometheusMetrics(), NewPrometheusMetrics()
+	a, _ := NewClient("A", SetMetrics(pmA), SetLogger(NewNopLogger()))
+	b, _ := NewClient("B", SetMetrics(pmB), SetLogger(NewNopLogger()))
+
+	_, _, err := connectPipe(t, a, b, nil, func(ID) bool { return false })
+	if err == nil {
+		t.Fatal("expected the connection to be rejected")
+	}
+
+	expectLines(t, scrape(t, pmA), `fmtp_connection_rejections_total{remote="B",by="remote"} 1`)
+	expectLines(t, scrape(t, pmB), `fmtp_connection_rejections_total{remote="A",by="local"} 1`)
+}
+
+func TestPrometheusMetricsTimers(t *testing.T) {
+	pm := NewPrometheusMetrics()
+	pm.TimerExpired("A", TimerTr)
+	pm.TimerExpired("A", TimerTr)
+	pm.HeartbeatSent(`quote"d`)
+
+	var b strings.Builder
+	pm.WriteTo(&b)
+	expectLines(t, b.String(),
+		`fmtp_timer_expirations_total{remote="A",timer="tr"} 2`,
+		`fmtp_heartbeats_sent_total{remote="quote\"d"} 1`,
+	)
+	if strings.Contains(b.String(), "fmtp_messages_sent_total") {
+		t.Error("metrics without samples shouldn't be exposed")
+	}
+}
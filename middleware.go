@@ -0,0 +1,143 @@
+package fmtp
+
+import (
+	"bytes"
+	"io"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/aabizri/fmtp/clock"
+)
+
+// A Middleware wraps a Handler, to add behaviour before and after it handles a message
+type Middleware func(Handler) Handler
+
+// Chain wraps the handler with the given middlewares
+// The first middleware is the outermost one, so Chain(h, a, b) handles a message through a, then b, then h.
+func Chain(h Handler, mws ...Middleware) Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// middlewareLogger returns the logger to use in a middleware for the given connection
+func middlewareLogger(conn *Conn, msg *Message) Logger {
+	var logger Logger
+	if conn == nil || conn.client == nil {
+		logger = defaultLogger()
+	} else {
+		logger = conn.log()
+	}
+	return logger.With(Fields{FieldMsgType: msg.Typ().String()})
+}
+
+// middlewareClock returns the clock to time the handling with for the given connection, that of its client
+func middlewareClock(conn *Conn) clock.Clock {
+	if conn == nil || conn.client == nil {
+		return clock.Real
+	}
+	return conn.client.clock
+}
+
+// closeBody closes the message body, if any
+func closeBody(msg *Message) {
+	if msg.Body != nil {
+		msg.Body.Close()
+	}
+}
+
+// Recover recovers from panics in the handler, so that they don't take the connection and the process down
+// The panic is logged along with its stack trace, then onPanic is called if not nil.
+func Recover(onPanic func(conn *Conn, msg *Message, v interface{})) Middleware {
+	return func(h Handler) Handler {
+		return HandlerFunc(func(conn *Conn, msg *Message) {
+			defer func() {
+				v := recover()
+				if v == nil {
+					return
+				}
+				middlewareLogger(conn, msg).Errorf("panic while handling message: %v\n%s", v, debug.Stack())
+				closeBody(msg)
+				if onPanic != nil {
+					onPanic(conn, msg, v)
+				}
+			}()
+			h.ServeFMTP(conn, msg)
+		})
+	}
+}
+
+// Logging logs every message handled, along with the time it took, using the connection's client logger and clock
+func Logging() Middleware {
+	return func(h Handler) Handler {
+		return HandlerFunc(func(conn *Conn, msg *Message) {
+			clk := middlewareClock(conn)
+			start := clk.Now()
+			h.ServeFMTP(conn, msg)
+			middlewareLogger(conn, msg).With(Fields{"duration": clock.Since(clk, start).String()}).Infof("message handled")
+		})
+	}
+}
+
+// Timing calls observe with the time taken by the handler for every message, as measured by the connection's client clock
+// It is the hook to use to record handling metrics.
+func Timing(observe func(conn *Conn, msg *Message, d time.Duration)) Middleware {
+	return func(h Handler) Handler {
+		return HandlerFunc(func(conn *Conn, msg *Message) {
+			clk := middlewareClock(conn)
+			start := clk.Now()
+			h.ServeFMTP(conn, msg)
+			observe(conn, msg, clock.Since(clk, start))
+		})
+	}
+}
+
+// Validate only passes on the messages for which validate returns no error, the others are logged and dropped
+// validate can inspect the payload through (*Message).Payload, which leaves it readable by the handler.
+func Validate(validate func(conn *Conn, msg *Message) error) Middleware {
+	return func(h Handler) Handler {
+		return HandlerFunc(func(conn *Conn, msg *Message) {
+			if err := validate(conn, msg); err != nil {
+				middlewareLogger(conn, msg).Warnf("dropping invalid message: %v", err)
+				closeBody(msg)
+				return
+			}
+			h.ServeFMTP(conn, msg)
+		})
+	}
+}
+
+// Archive writes a copy of every message to w, in the FMTP wire format, before handing it over to the handler
+// The archive can be read back message by message using (*Message).ReadFrom. Writes are serialised, so w can be shared.
+// Archiving errors are logged, they don't prevent the message from being handled.
+func Archive(w io.Writer) Middleware {
+	var mu sync.Mutex
+	return func(h Handler) Handler {
+		return HandlerFunc(func(conn *Conn, msg *Message) {
+			err := archive(&mu, w, msg)
+			if err != nil {
+				middlewareLogger(conn, msg).Errorf("error while archiving message: %v", err)
+			}
+			h.ServeFMTP(conn, msg)
+		})
+	}
+}
+
+// archive writes a copy of the message to w
+func archive(mu *sync.Mutex, w io.Writer, msg *Message) error {
+	b, err := msg.Payload()
+	if err != nil {
+		return err
+	}
+	cpy, err := NewMessage(msg.Typ(), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	_, err = cpy.WriteTo(w)
+	return err
+}
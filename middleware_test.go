@@ -0,0 +1,138 @@
+package fmtp_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aabizri/fmtp"
+	"github.com/aabizri/fmtp/clock"
+	"github.com/aabizri/fmtp/fmtptest"
+)
+
+// trace records a sequence of steps, concurrently
+type trace struct {
+	mu    sync.Mutex
+	steps []string
+}
+
+func (tr *trace) add(step string) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.steps = append(tr.steps, step)
+}
+
+func (tr *trace) expect(t *testing.T, want ...string) {
+	t.Helper()
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if fmt.Sprint(tr.steps) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, tr.steps)
+	}
+}
+
+// traceLogger is a Logger adding the Info entries to a trace, along with their duration field if any
+type traceLogger struct {
+	fmtp.Logger
+	tr       *trace
+	duration string
+}
+
+func (tl traceLogger) With(fields fmtp.Fields) fmtp.Logger {
+	if d, ok := fields["duration"]; ok {
+		tl.duration = fmt.Sprint(d)
+	}
+	return tl
+}
+
+func (tl traceLogger) Infof(format string, args ...interface{}) {
+	entry := "log " + fmt.Sprintf(format, args...)
+	if tl.duration != "" {
+		entry += " in " + tl.duration
+	}
+	tl.tr.add(entry)
+}
+
+// TestRecover checks that a panicking handler doesn't take the connection down
+func TestRecover(t *testing.T) {
+	panics := make(chan interface{}, 1)
+	handler := fmtp.Chain(fmtp.HandlerFunc(func(_ *fmtp.Conn, msg *fmtp.Message) {
+		if b, _ := msg.Payload(); string(b) == "boom" {
+			panic("boom")
+		}
+	}), fmtp.Recover(func(_ *fmtp.Conn, _ *fmtp.Message, v interface{}) {
+		panics <- v
+	}))
+	p := fmtptest.NewPair(t, fmtptest.PairOptions{HandlerB: handler})
+	p.Associate(t)
+
+	p.SendA(t, "boom")
+	select {
+	case v := <-panics:
+		if v != "boom" {
+			t.Errorf("expected the panic value, got %v", v)
+		}
+	case <-time.After(fmtptest.Timeout):
+		t.Fatal("panic not recovered")
+	}
+
+	// The connection is still usable
+	p.SendA(t, "after")
+	p.RecB.ExpectBodies(t, "boom", "after")
+	if st := p.ConnB.State(); st != fmtp.DataReady {
+		t.Errorf("expected the connection to be %s, got %s", fmtp.DataReady, st)
+	}
+}
+
+// TestChainOrder checks that the first middleware given to Chain is the outermost one
+func TestChainOrder(t *testing.T) {
+	tr := &trace{}
+	tag := func(name string) fmtp.Middleware {
+		return func(h fmtp.Handler) fmtp.Handler {
+			return fmtp.HandlerFunc(func(conn *fmtp.Conn, msg *fmtp.Message) {
+				tr.add(name + " before")
+				h.ServeFMTP(conn, msg)
+				tr.add(name + " after")
+			})
+		}
+	}
+	h := fmtp.Chain(fmtp.HandlerFunc(func(*fmtp.Conn, *fmtp.Message) {
+		tr.add("handler")
+	}), tag("a"), tag("b"))
+
+	msg, _ := fmtp.NewOperatorMessageString("hello")
+	h.ServeFMTP(nil, msg)
+	tr.expect(t, "a before", "b before", "handler", "b after", "a after")
+}
+
+// TestLoggingTiming checks that Logging and Timing report once the handler has returned, in the order they wrap it,
+// the time it took according to the client's clock
+func TestLoggingTiming(t *testing.T) {
+	run := func(order func(logging, timing fmtp.Middleware) []fmtp.Middleware) *trace {
+		tr := &trace{}
+		fc := clock.NewFake(time.Now())
+		c, err := fmtp.NewClient("A", fmtp.SetClock(fc), fmtp.SetLogger(traceLogger{Logger: fmtp.NewNopLogger(), tr: tr}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler := fmtp.HandlerFunc(func(*fmtp.Conn, *fmtp.Message) {
+			fc.Advance(3 * time.Second)
+			tr.add("handler")
+		})
+		timing := fmtp.Timing(func(_ *fmtp.Conn, _ *fmtp.Message, d time.Duration) {
+			tr.add("timing " + d.String())
+		})
+
+		msg, _ := fmtp.NewOperatorMessageString("hello")
+		fmtp.Chain(handler, order(fmtp.Logging(), timing)...).ServeFMTP(c.NewConn(nil), msg)
+		return tr
+	}
+
+	run(func(logging, timing fmtp.Middleware) []fmtp.Middleware {
+		return []fmtp.Middleware{logging, timing}
+	}).expect(t, "handler", "timing 3s", "log message handled in 3s")
+	run(func(logging, timing fmtp.Middleware) []fmtp.Middleware {
+		return []fmtp.Middleware{timing, logging}
+	}).expect(t, "handler", "log message handled in 3s", "timing 3s")
+}
@@ -0,0 +1,137 @@
+package fmtp
+
+import (
+	"path"
+	"sync"
+)
+
+// A Matcher reports whether a message should be routed to a handler, see ServeMux
+type Matcher func(conn *Conn, msg *Message) bool
+
+// MatchTyp matches the messages of the given type
+func MatchTyp(typ Typ) Matcher {
+	return func(_ *Conn, msg *Message) bool {
+		return msg.Typ() == typ
+	}
+}
+
+// MatchRemoteID matches the messages received from one of the given remote IDs
+func MatchRemoteID(ids ...ID) Matcher {
+	return func(conn *Conn, _ *Message) bool {
+		if conn == nil {
+			return false
+		}
+		remote := conn.RemoteID()
+		for _, id := range ids {
+			if remote == id {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MatchRemotePattern matches the messages received from a remote ID matching the given shell pattern, such as "LF*", see path.Match
+// It panics if the pattern is malformed.
+func MatchRemotePattern(pattern string) Matcher {
+	if _, err := path.Match(pattern, ""); err != nil {
+		panic("fmtp: invalid remote ID pattern " + pattern)
+	}
+	return func(conn *Conn, _ *Message) bool {
+		if conn == nil {
+			return false
+		}
+		ok, _ := path.Match(pattern, string(conn.RemoteID()))
+		return ok
+	}
+}
+
+// MatchPayload matches the messages whose payload satisfies the given predicate, such as the OLDI message title
+// The body is read into memory so that the handler can still read it, and the predicate must not modify it.
+func MatchPayload(pred func(payload []byte) bool) Matcher {
+	return func(_ *Conn, msg *Message) bool {
+		b, err := msg.Payload()
+		if err != nil {
+			return false
+		}
+		return pred(b)
+	}
+}
+
+// route is a handler registered in a ServeMux, along with its matchers
+type route struct {
+	matchers []Matcher
+	handler  Handler
+}
+
+// ServeMux is an FMTP message multiplexer, it is a Handler routing messages to other handlers.
+//
+// Handlers are registered along with matchers, the first handler registered whose matchers all match a message handles it.
+// Unmatched messages are passed to the fallback handler, or discarded if there is none.
+type ServeMux struct {
+	mu       sync.RWMutex
+	routes   []route
+	fallback Handler
+}
+
+// NewServeMux allocates and returns a new ServeMux
+func NewServeMux() *ServeMux {
+	return &ServeMux{}
+}
+
+// Handle registers the handler for the messages satisfying all the given matchers
+// With no matchers, the handler matches every message.
+func (mux *ServeMux) Handle(h Handler, matchers ...Matcher) {
+	if h == nil {
+		panic("fmtp: nil handler")
+	}
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	mux.routes = append(mux.routes, route{matchers: matchers, handler: h})
+}
+
+// HandleFunc registers the handler function for the messages satisfying all the given matchers
+func (mux *ServeMux) HandleFunc(f func(conn *Conn, msg *Message), matchers ...Matcher) {
+	mux.Handle(HandlerFunc(f), matchers...)
+}
+
+// Fallback sets the handler for messages matched by no registered handler
+func (mux *ServeMux) Fallback(h Handler) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	mux.fallback = h
+}
+
+// Handler returns the handler to use for the given message, nil if the message would be discarded
+func (mux *ServeMux) Handler(conn *Conn, msg *Message) Handler {
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+	for _, r := range mux.routes {
+		if r.match(conn, msg) {
+			return r.handler
+		}
+	}
+	return mux.fallback
+}
+
+// match reports whether all the route's matchers match
+func (r route) match(conn *Conn, msg *Message) bool {
+	for _, m := range r.matchers {
+		if !m(conn, msg) {
+			return false
+		}
+	}
+	return true
+}
+
+// ServeFMTP dispatches the message to the handler whose matchers match it
+func (mux *ServeMux) ServeFMTP(conn *Conn, msg *Message) {
+	h := mux.Handler(conn, msg)
+	if h == nil {
+		if msg.Body != nil {
+			msg.Body.Close()
+		}
+		return
+	}
+	h.ServeFMTP(conn, msg)
+}
@@ -0,0 +1,106 @@
+package fmtp_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/aabizri/fmtp"
+)
+
+// named is a handler recording its name and the body of the message it handled
+type named struct {
+	name string
+	got  *[]string
+}
+
+func (n named) ServeFMTP(_ *fmtp.Conn, msg *fmtp.Message) {
+	b, _ := ioutil.ReadAll(msg.Body)
+	*n.got = append(*n.got, n.name+":"+string(b))
+}
+
+// prefix matches the payloads starting with p
+func prefix(p string) fmtp.Matcher {
+	return fmtp.MatchPayload(func(b []byte) bool {
+		return bytes.HasPrefix(b, []byte(p))
+	})
+}
+
+// closeRecorder records whether it has been closed
+type closeRecorder struct {
+	*strings.Reader
+	closed bool
+}
+
+func (cr *closeRecorder) Close() error {
+	cr.closed = true
+	return nil
+}
+
+func TestServeMuxRouting(t *testing.T) {
+	tests := []struct {
+		name     string
+		typ      fmtp.Typ
+		body     string
+		fallback bool
+		want     string
+	}{
+		{"type and payload", fmtp.Operator, "URG 1", true, "urgent:URG 1"},
+		{"type before payload", fmtp.Operator, "PAC 1", true, "operator:PAC 1"},
+		{"payload", fmtp.Operational, "PAC 1", true, "pac:PAC 1"},
+		{"fallback", fmtp.Operational, "ABI 1", true, "fallback:ABI 1"},
+		{"not found", fmtp.Operational, "ABI 1", false, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			mux := fmtp.NewServeMux()
+			mux.Handle(named{"urgent", &got}, fmtp.MatchTyp(fmtp.Operator), prefix("URG"))
+			mux.Handle(named{"operator", &got}, fmtp.MatchTyp(fmtp.Operator))
+			mux.Handle(named{"pac", &got}, prefix("PAC"))
+			if test.fallback {
+				mux.Fallback(named{"fallback", &got})
+			}
+
+			msg, err := fmtp.NewMessage(test.typ, strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			mux.ServeFMTP(nil, msg)
+
+			switch {
+			case test.want == "" && len(got) != 0:
+				t.Errorf("expected the message to be discarded, got %q", got)
+			case test.want != "" && (len(got) != 1 || got[0] != test.want):
+				t.Errorf("expected %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestServeMuxHandler(t *testing.T) {
+	var got []string
+	mux := fmtp.NewServeMux()
+	operator := named{"operator", &got}
+	mux.Handle(operator, fmtp.MatchTyp(fmtp.Operator))
+
+	msg, _ := fmtp.NewOperatorMessageString("hello")
+	if h := mux.Handler(nil, msg); h != operator {
+		t.Errorf("expected the operator handler, got %v", h)
+	}
+	body := &closeRecorder{Reader: strings.NewReader("hello")}
+	msg, _ = fmtp.NewOperationalMessage(body)
+	if h := mux.Handler(nil, msg); h != nil {
+		t.Errorf("expected no handler, got %v", h)
+	}
+
+	// A message without handler is discarded
+	mux.ServeFMTP(nil, msg)
+	if len(got) != 0 {
+		t.Errorf("expected the message to be discarded, got %q", got)
+	}
+	if !body.closed {
+		t.Error("expected the discarded message's body to be closed")
+	}
+}
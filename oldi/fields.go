@@ -0,0 +1,340 @@
+package oldi
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// isUpper reports whether c is an uppercase letter
+func isUpper(c byte) bool {
+	return c >= 'A' && c <= 'Z'
+}
+
+// isDigit reports whether c is a digit
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// span returns the length of the prefix of s made of bytes satisfying f
+func span(s string, f func(byte) bool) int {
+	var i int
+	for i < len(s) && f(s[i]) {
+		i++
+	}
+	return i
+}
+
+// checkField checks that a field's content can be serialised
+func checkField(s string) error {
+	if s == "" {
+		return errors.New("empty field")
+	}
+	if strings.ContainsAny(s, "()-") {
+		return errors.Errorf("field %q contains a reserved character", s)
+	}
+	return nil
+}
+
+// MessageNumber identifies a message between two units, as in "E/L005"
+type MessageNumber struct {
+	// Sender is the sending unit's identifier, 1 to 4 letters
+	Sender string
+
+	// Receiver is the receiving unit's identifier, 1 to 4 letters
+	Receiver string
+
+	// Serial is the message's serial number, between 0 and 999
+	Serial int
+}
+
+// IsZero reports whether the message number is unset
+func (mn MessageNumber) IsZero() bool {
+	return mn == MessageNumber{}
+}
+
+func (mn MessageNumber) String() string {
+	return fmt.Sprintf("%s/%s%03d", mn.Sender, mn.Receiver, mn.Serial)
+}
+
+// check checks the message number's validity
+func (mn MessageNumber) check() error {
+	for _, unit := range [...]string{mn.Sender, mn.Receiver} {
+		if l := len(unit); l == 0 || l > 4 || span(unit, isUpper) != l {
+			return errors.Errorf("invalid unit identifier %q", unit)
+		}
+	}
+	if mn.Serial < 0 || mn.Serial > 999 {
+		return errors.Errorf("invalid serial number %d", mn.Serial)
+	}
+	return nil
+}
+
+// parseMessageNumber parses a message number at the beginning of s, returning what's left
+func parseMessageNumber(s string) (MessageNumber, string, error) {
+	var mn MessageNumber
+
+	// Sender unit, then a slash
+	n := span(s, isUpper)
+	if n == 0 || n > 4 || n == len(s) || s[n] != '/' {
+		return mn, s, errors.Errorf("invalid message number %q", s)
+	}
+	mn.Sender, s = s[:n], s[n+1:]
+
+	// Receiver unit, then the serial number
+	n = span(s, isUpper)
+	if n == 0 || n > 4 {
+		return mn, s, errors.Errorf("invalid receiving unit in %q", s)
+	}
+	mn.Receiver, s = s[:n], s[n:]
+	if span(s, isDigit) < 3 {
+		return mn, s, errors.Errorf("invalid serial number in %q", s)
+	}
+	mn.Serial, _ = strconv.Atoi(s[:3])
+	return mn, s[3:], nil
+}
+
+// Header is the first field of an OLDI message (ICAO field 3)
+type Header struct {
+	// Title is the message type designator
+	Title Title
+
+	// Number is the message number
+	Number MessageNumber
+
+	// Reference is the number of the message referred to, such as the acknowledged message in a LAM, if any
+	Reference MessageNumber
+}
+
+// Head returns the header itself, it makes every message embedding a Header a Message
+func (h *Header) Head() *Header {
+	return h
+}
+
+func (h *Header) String() string {
+	s := string(h.Title) + h.Number.String()
+	if !h.Reference.IsZero() {
+		s += h.Reference.String()
+	}
+	return s
+}
+
+// check checks the header's validity
+func (h *Header) check() error {
+	if len(h.Title) != 3 || span(string(h.Title), isUpper) != 3 {
+		return errors.Errorf("invalid title %q", h.Title)
+	}
+	if err := h.Number.check(); err != nil {
+		return err
+	}
+	if !h.Reference.IsZero() {
+		return h.Reference.check()
+	}
+	return nil
+}
+
+// parseHeader parses field 3
+func parseHeader(s string) (Header, error) {
+	var h Header
+	if len(s) < 3 || span(s[:3], isUpper) != 3 {
+		return h, errors.Errorf("invalid message title in %q", s)
+	}
+	h.Title = Title(s[:3])
+
+	var err error
+	h.Number, s, err = parseMessageNumber(s[3:])
+	if err != nil {
+		return h, err
+	}
+	if s != "" {
+		h.Reference, s, err = parseMessageNumber(s)
+		if err != nil {
+			return h, errors.Wrap(err, "invalid reference data")
+		}
+	}
+	if s != "" {
+		return h, errors.Errorf("unexpected data %q after message number", s)
+	}
+	return h, nil
+}
+
+// AircraftID is the aircraft identification and SSR mode and code (ICAO field 7), as in "BAW123/A4401"
+type AircraftID struct {
+	// Callsign is the aircraft identification, up to 7 characters
+	Callsign string
+
+	// SSRMode is the SSR mode, usually 'A', or 0 if there is no SSR code
+	SSRMode byte
+
+	// SSRCode is the SSR code, 4 octal digits
+	SSRCode string
+}
+
+func (a AircraftID) String() string {
+	if a.SSRMode == 0 {
+		return a.Callsign
+	}
+	return a.Callsign + "/" + string(a.SSRMode) + a.SSRCode
+}
+
+// check checks the aircraft identification's validity
+func (a AircraftID) check() error {
+	isAlnum := func(c byte) bool { return isUpper(c) || isDigit(c) }
+	if l := len(a.Callsign); l == 0 || l > 7 || span(a.Callsign, isAlnum) != l {
+		return errors.Errorf("invalid aircraft identification %q", a.Callsign)
+	}
+	if a.SSRMode == 0 {
+		return nil
+	}
+	isOctal := func(c byte) bool { return c >= '0' && c <= '7' }
+	if !isUpper(a.SSRMode) || len(a.SSRCode) != 4 || span(a.SSRCode, isOctal) != 4 {
+		return errors.Errorf("invalid SSR mode and code %q", string(a.SSRMode)+a.SSRCode)
+	}
+	return nil
+}
+
+// parseAircraftID parses field 7
+func parseAircraftID(s string) (AircraftID, error) {
+	var a AircraftID
+	i := strings.IndexByte(s, '/')
+	if i < 0 {
+		a.Callsign = s
+	} else if i+1 < len(s) {
+		a.Callsign, a.SSRMode, a.SSRCode = s[:i], s[i+1], s[i+2:]
+	} else {
+		return a, errors.Errorf("invalid aircraft identification %q", s)
+	}
+	return a, a.check()
+}
+
+// parseLevel returns the length of the flight level or altitude at the beginning of s, such as "F350", "A045", "S1130" or "M0840"
+func parseLevel(s string) int {
+	if s == "" {
+		return 0
+	}
+	var digits int
+	switch s[0] {
+	case 'F', 'A':
+		digits = 3
+	case 'S', 'M':
+		digits = 4
+	default:
+		return 0
+	}
+	if span(s[1:], isDigit) < digits {
+		return 0
+	}
+	return 1 + digits
+}
+
+// Estimate is the estimate data (ICAO field 14), as in "ABNUR/1412F350F330A"
+type Estimate struct {
+	// Point is the boundary point
+	Point string
+
+	// Time is the estimated time over the point, as HHMM
+	Time string
+
+	// Level is the cleared level, such as "F350"
+	Level string
+
+	// SupplementaryLevel is the level at which the point will be crossed if not at the cleared level, if any
+	SupplementaryLevel string
+
+	// Crossing is the crossing condition for the supplementary level, 'A' for at or above and 'B' for at or below
+	Crossing byte
+}
+
+func (e Estimate) String() string {
+	s := e.Point + "/" + e.Time + e.Level
+	if e.SupplementaryLevel != "" {
+		s += e.SupplementaryLevel + string(e.Crossing)
+	}
+	return s
+}
+
+// parseEstimate parses field 14
+func parseEstimate(s string) (Estimate, error) {
+	var e Estimate
+	i := strings.IndexByte(s, '/')
+	if i <= 0 {
+		return e, errors.Errorf("invalid estimate data %q: no point", s)
+	}
+	e.Point, s = s[:i], s[i+1:]
+
+	// Time
+	if span(s, isDigit) < 4 {
+		return e, errors.Errorf("invalid estimate time in %q", s)
+	}
+	e.Time, s = s[:4], s[4:]
+
+	// Level
+	n := parseLevel(s)
+	if n == 0 {
+		return e, errors.Errorf("invalid level in %q", s)
+	}
+	e.Level, s = s[:n], s[n:]
+
+	// Supplementary crossing data
+	if s != "" {
+		n = parseLevel(s)
+		if n == 0 || len(s) != n+1 || (s[n] != 'A' && s[n] != 'B') {
+			return e, errors.Errorf("invalid supplementary crossing data %q", s)
+		}
+		e.SupplementaryLevel, e.Crossing = s[:n], s[n]
+	}
+	return e, nil
+}
+
+// OptionalField is an optional field of a message (ICAO field 22), as in "9/B738/M"
+type OptionalField struct {
+	// Number is the ICAO field number, such as 9 for the type of aircraft, or 15 for the route
+	Number int
+
+	// Value is the field's content
+	Value string
+}
+
+func (f OptionalField) String() string {
+	return strconv.Itoa(f.Number) + "/" + f.Value
+}
+
+// parseOptionalField parses a field 22 item
+func parseOptionalField(s string) (OptionalField, error) {
+	var f OptionalField
+	n := span(s, isDigit)
+	if n == 0 || n > 2 || n == len(s) || s[n] != '/' {
+		return f, errors.Errorf("invalid optional field %q", s)
+	}
+	f.Number, _ = strconv.Atoi(s[:n])
+	f.Value = s[n+1:]
+	return f, nil
+}
+
+// parseOptionalFields parses the field 22 items of a message
+func parseOptionalFields(fields []string) ([]OptionalField, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	opts := make([]OptionalField, len(fields))
+	for i, s := range fields {
+		var err error
+		opts[i], err = parseOptionalField(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return opts, nil
+}
+
+// optional returns the first optional field with the given number, if any
+func optional(opts []OptionalField, number int) (string, bool) {
+	for _, f := range opts {
+		if f.Number == number {
+			return f.Value, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,312 @@
+package oldi
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+)
+
+// encode serialises a message given its header and fields
+func encode(h *Header, fields []string, opts []OptionalField) ([]byte, error) {
+	if err := h.check(); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('(')
+	buf.WriteString(h.String())
+	for _, f := range fields {
+		if err := checkField(f); err != nil {
+			return nil, err
+		}
+		buf.WriteByte('-')
+		buf.WriteString(f)
+	}
+	for _, f := range opts {
+		if err := checkField(f.Value); err != nil {
+			return nil, errors.Wrapf(err, "optional field %d", f.Number)
+		}
+		if f.Number < 0 || f.Number > 99 {
+			return nil, errors.Errorf("invalid optional field number %d", f.Number)
+		}
+		buf.WriteByte('-')
+		buf.WriteString(f.String())
+	}
+	buf.WriteByte(')')
+	return buf.Bytes(), nil
+}
+
+// expectFields checks that at least n fields follow field 3
+func expectFields(h *Header, fields []string, n int) error {
+	if len(fields) < n {
+		return errors.Errorf("%s: expected at least %d fields after field 3, got %d", h.Title, n, len(fields))
+	}
+	return nil
+}
+
+// Flight holds the flight data common to the coordination messages (ABI, ACT, REV, PAC)
+type Flight struct {
+	// Aircraft is the aircraft identification (field 7)
+	Aircraft AircraftID
+
+	// Departure is the departure aerodrome (field 13)
+	Departure string
+
+	// Estimate is the estimate data (field 14)
+	Estimate Estimate
+
+	// Destination is the destination aerodrome (field 16)
+	Destination string
+
+	// Optional holds the optional fields (field 22), in order
+	Optional []OptionalField
+}
+
+// Field returns the value of the first optional field with the given ICAO field number, if any
+func (f *Flight) Field(number int) (string, bool) {
+	return optional(f.Optional, number)
+}
+
+func (f *Flight) encode(h *Header) ([]byte, error) {
+	if err := f.Aircraft.check(); err != nil {
+		return nil, err
+	}
+	return encode(h, []string{f.Aircraft.String(), f.Departure, f.Estimate.String(), f.Destination}, f.Optional)
+}
+
+func (f *Flight) decode(h *Header, fields []string) error {
+	if err := expectFields(h, fields, 4); err != nil {
+		return err
+	}
+	var err error
+	if f.Aircraft, err = parseAircraftID(fields[0]); err != nil {
+		return err
+	}
+	f.Departure = fields[1]
+	if f.Estimate, err = parseEstimate(fields[2]); err != nil {
+		return err
+	}
+	f.Destination = fields[3]
+	f.Optional, err = parseOptionalFields(fields[4:])
+	return err
+}
+
+// AdvanceBoundaryInfo is an ABI message, giving advance notification of a flight to the next unit
+type AdvanceBoundaryInfo struct {
+	Header
+	Flight
+}
+
+// MarshalText returns the message in ICAO field format
+func (m *AdvanceBoundaryInfo) MarshalText() ([]byte, error) {
+	return m.Flight.encode(&m.Header)
+}
+
+// Activate is an ACT message, coordinating the transfer of a flight to the next unit
+type Activate struct {
+	Header
+	Flight
+}
+
+// MarshalText returns the message in ICAO field format
+func (m *Activate) MarshalText() ([]byte, error) {
+	return m.Flight.encode(&m.Header)
+}
+
+// Revision is a REV message, revising the coordination data of a flight
+type Revision struct {
+	Header
+	Flight
+}
+
+// MarshalText returns the message in ICAO field format
+func (m *Revision) MarshalText() ([]byte, error) {
+	return m.Flight.encode(&m.Header)
+}
+
+// PreliminaryActivation is a PAC message, notifying and pre-coordinating a flight not yet departed
+type PreliminaryActivation struct {
+	Header
+	Flight
+}
+
+// MarshalText returns the message in ICAO field format
+func (m *PreliminaryActivation) MarshalText() ([]byte, error) {
+	return m.Flight.encode(&m.Header)
+}
+
+// AbrogationOfCoordination is a MAC message, cancelling a notification or coordination previously made
+type AbrogationOfCoordination struct {
+	Header
+
+	// Aircraft is the aircraft identification (field 7)
+	Aircraft AircraftID
+
+	// Departure is the departure aerodrome (field 13)
+	Departure string
+
+	// Destination is the destination aerodrome (field 16)
+	Destination string
+
+	// Optional holds the optional fields (field 22), in order
+	Optional []OptionalField
+}
+
+// MarshalText returns the message in ICAO field format
+func (m *AbrogationOfCoordination) MarshalText() ([]byte, error) {
+	if err := m.Aircraft.check(); err != nil {
+		return nil, err
+	}
+	return encode(&m.Header, []string{m.Aircraft.String(), m.Departure, m.Destination}, m.Optional)
+}
+
+// LogicalAck is a LAM message, acknowledging the message referred to by its header's reference data
+type LogicalAck struct {
+	Header
+}
+
+// MarshalText returns the message in ICAO field format
+func (m *LogicalAck) MarshalText() ([]byte, error) {
+	if m.Reference.IsZero() {
+		return nil, errors.New("LAM: no reference data")
+	}
+	return encode(&m.Header, nil, nil)
+}
+
+// NewLogicalAck returns the LAM acknowledging the given message, numbered with the given serial
+func NewLogicalAck(m Message, serial int) *LogicalAck {
+	ref := m.Head().Number
+	return &LogicalAck{
+		Header: Header{
+			Title:     LAM,
+			Number:    MessageNumber{Sender: ref.Receiver, Receiver: ref.Sender, Serial: serial},
+			Reference: ref,
+		},
+	}
+}
+
+// ChangeOfFrequency is a COF message, transferring the communication of a flight to the receiving unit
+type ChangeOfFrequency struct {
+	Header
+
+	// Aircraft is the aircraft identification (field 7)
+	Aircraft AircraftID
+
+	// Optional holds the optional fields (field 22), in order
+	Optional []OptionalField
+}
+
+// MarshalText returns the message in ICAO field format
+func (m *ChangeOfFrequency) MarshalText() ([]byte, error) {
+	if err := m.Aircraft.check(); err != nil {
+		return nil, err
+	}
+	return encode(&m.Header, []string{m.Aircraft.String()}, m.Optional)
+}
+
+// SkipCommunication is a SCO message, transferring the communication of a flight to a unit further downstream
+type SkipCommunication struct {
+	Header
+
+	// Aircraft is the aircraft identification (field 7)
+	Aircraft AircraftID
+
+	// Optional holds the optional fields (field 22), in order
+	Optional []OptionalField
+}
+
+// MarshalText returns the message in ICAO field format
+func (m *SkipCommunication) MarshalText() ([]byte, error) {
+	if err := m.Aircraft.check(); err != nil {
+		return nil, err
+	}
+	return encode(&m.Header, []string{m.Aircraft.String()}, m.Optional)
+}
+
+// Generic is an OLDI message whose title has no dedicated type, its fields are kept as is
+type Generic struct {
+	Header
+
+	// Fields holds the fields following field 3
+	Fields []string
+}
+
+// MarshalText returns the message in ICAO field format
+func (m *Generic) MarshalText() ([]byte, error) {
+	return encode(&m.Header, m.Fields, nil)
+}
+
+// Parse parses an OLDI message in ICAO field format
+// Messages whose title has no dedicated type are returned as a *Generic.
+func Parse(b []byte) (Message, error) {
+	fields, err := Fields(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "oldi: invalid ICAO field format")
+	}
+	h, err := parseHeader(fields[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "oldi: invalid field 3")
+	}
+	fields = fields[1:]
+
+	// Decode the rest according to the title
+	var m Message
+	switch h.Title {
+	case ABI:
+		msg := &AdvanceBoundaryInfo{Header: h}
+		m, err = msg, msg.Flight.decode(&h, fields)
+	case ACT:
+		msg := &Activate{Header: h}
+		m, err = msg, msg.Flight.decode(&h, fields)
+	case REV:
+		msg := &Revision{Header: h}
+		m, err = msg, msg.Flight.decode(&h, fields)
+	case PAC:
+		msg := &PreliminaryActivation{Header: h}
+		m, err = msg, msg.Flight.decode(&h, fields)
+	case MAC:
+		msg := &AbrogationOfCoordination{Header: h}
+		if err = expectFields(&h, fields, 3); err != nil {
+			break
+		}
+		if msg.Aircraft, err = parseAircraftID(fields[0]); err != nil {
+			break
+		}
+		msg.Departure, msg.Destination = fields[1], fields[2]
+		msg.Optional, err = parseOptionalFields(fields[3:])
+		m = msg
+	case LAM:
+		if h.Reference.IsZero() {
+			err = errors.New("LAM: no reference data")
+		} else if len(fields) != 0 {
+			err = errors.New("LAM: unexpected fields after field 3")
+		}
+		m = &LogicalAck{Header: h}
+	case COF:
+		msg := &ChangeOfFrequency{Header: h}
+		if err = expectFields(&h, fields, 1); err != nil {
+			break
+		}
+		if msg.Aircraft, err = parseAircraftID(fields[0]); err != nil {
+			break
+		}
+		msg.Optional, err = parseOptionalFields(fields[1:])
+		m = msg
+	case SCO:
+		msg := &SkipCommunication{Header: h}
+		if err = expectFields(&h, fields, 1); err != nil {
+			break
+		}
+		if msg.Aircraft, err = parseAircraftID(fields[0]); err != nil {
+			break
+		}
+		msg.Optional, err = parseOptionalFields(fields[1:])
+		m = msg
+	default:
+		m = &Generic{Header: h, Fields: fields}
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "oldi: invalid %s message", h.Title)
+	}
+	return m, nil
+}
@@ -0,0 +1,102 @@
+/*
+Package oldi implements parsing and generation of EUROCONTROL OLDI (On-Line Data Interchange) messages in ICAO field format,
+as carried in FMTP Operational messages.
+
+An OLDI message in ICAO field format is enclosed in parentheses, its fields being separated by hyphens:
+
+	(ACTE/L005-BAW123/A4401-EGLL-ABNUR/1412F350-LIRF-9/B738/M-15/N0460F350 ABNUR UM984 GEN)
+
+The first field (ICAO field 3) holds the message title, the message number and optionally the reference data.
+It is followed by the fields specific to the message title, and by optional fields (ICAO field 22) of the form "-NN/content".
+*/
+package oldi
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	"github.com/aabizri/fmtp"
+	"github.com/pkg/errors"
+)
+
+// Title is the message type designator of an OLDI message
+type Title string
+
+// The following constants define the supported OLDI message titles
+const (
+	// ABI is the Advance Boundary Information message
+	ABI Title = "ABI"
+	// ACT is the Activate message
+	ACT Title = "ACT"
+	// REV is the Revision message
+	REV Title = "REV"
+	// PAC is the Preliminary Activation message
+	PAC Title = "PAC"
+	// MAC is the Message for Abrogation of Coordination
+	MAC Title = "MAC"
+	// LAM is the Logical Acknowledgement Message
+	LAM Title = "LAM"
+	// COF is the Change Of Frequency message
+	COF Title = "COF"
+	// SCO is the Skip Communication message
+	SCO Title = "SCO"
+)
+
+// A Message is an OLDI message
+type Message interface {
+	// Head returns the message's header (ICAO field 3)
+	Head() *Header
+
+	// MarshalText returns the message in ICAO field format
+	MarshalText() ([]byte, error)
+}
+
+// Marshal returns the ICAO field format of an OLDI message
+func Marshal(m Message) ([]byte, error) {
+	return m.MarshalText()
+}
+
+// NewOperationalMessage returns an FMTP Operational message carrying the given OLDI message
+func NewOperationalMessage(m Message) (*fmtp.Message, error) {
+	b, err := m.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	return fmtp.NewOperationalMessage(bytes.NewReader(b))
+}
+
+// ReadMessage parses the OLDI message carried by an FMTP message, consuming its body
+func ReadMessage(msg *fmtp.Message) (Message, error) {
+	if msg.Typ() != fmtp.Operational {
+		return nil, errors.Errorf("ReadMessage: expected an Operational message, got %s", msg.Typ())
+	}
+	defer msg.Body.Close()
+	b, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(b)
+}
+
+// MatchTitle matches the FMTP Operational messages carrying an OLDI message with one of the given titles, see fmtp.ServeMux
+func MatchTitle(titles ...Title) fmtp.Matcher {
+	pred := func(b []byte) bool {
+		fields, err := Fields(b)
+		if err != nil {
+			return false
+		}
+		h, err := parseHeader(fields[0])
+		if err != nil {
+			return false
+		}
+		for _, t := range titles {
+			if h.Title == t {
+				return true
+			}
+		}
+		return false
+	}
+	return func(conn *fmtp.Conn, msg *fmtp.Message) bool {
+		return msg.Typ() == fmtp.Operational && fmtp.MatchPayload(pred)(conn, msg)
+	}
+}
@@ -0,0 +1,261 @@
+package oldi
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/aabizri/fmtp"
+)
+
+// samples are messages in ICAO field format, following the layouts given in the OLDI specification
+var samples = []struct {
+	name string
+	text string
+	msg  Message
+}{
+	{
+		name: "ABI",
+		text: "(ABIE/L001-AFR1234/A5543-LFPO-BOJOL/1230F310-EGLL-9/A320/M-15/N0450F310 BOJOL UN857 ABB)",
+		msg: &AdvanceBoundaryInfo{
+			Header: Header{Title: ABI, Number: MessageNumber{"E", "L", 1}},
+			Flight: Flight{
+				Aircraft:    AircraftID{"AFR1234", 'A', "5543"},
+				Departure:   "LFPO",
+				Estimate:    Estimate{Point: "BOJOL", Time: "1230", Level: "F310"},
+				Destination: "EGLL",
+				Optional: []OptionalField{
+					{9, "A320/M"},
+					{15, "N0450F310 BOJOL UN857 ABB"},
+				},
+			},
+		},
+	},
+	{
+		name: "ACT with supplementary crossing data",
+		text: "(ACTE/L005-BAW123/A4401-EGLL-ABNUR/1412F350F330A-LIRF-8/IS-9/B738/M-18/REG/GEUUA)",
+		msg: &Activate{
+			Header: Header{Title: ACT, Number: MessageNumber{"E", "L", 5}},
+			Flight: Flight{
+				Aircraft:    AircraftID{"BAW123", 'A', "4401"},
+				Departure:   "EGLL",
+				Estimate:    Estimate{"ABNUR", "1412", "F350", "F330", 'A'},
+				Destination: "LIRF",
+				Optional: []OptionalField{
+					{8, "IS"},
+					{9, "B738/M"},
+					{18, "REG/GEUUA"},
+				},
+			},
+		},
+	},
+	{
+		name: "REV",
+		text: "(REVE/L006-BAW123/A4401-EGLL-ABNUR/1415F370-LIRF)",
+		msg: &Revision{
+			Header: Header{Title: REV, Number: MessageNumber{"E", "L", 6}},
+			Flight: Flight{
+				Aircraft:    AircraftID{"BAW123", 'A', "4401"},
+				Departure:   "EGLL",
+				Estimate:    Estimate{Point: "ABNUR", Time: "1415", Level: "F370"},
+				Destination: "LIRF",
+			},
+		},
+	},
+	{
+		name: "PAC",
+		text: "(PACBC/MC123-DLH456/A2213-EDDF-RESMI/0930A090-LFMN)",
+		msg: &PreliminaryActivation{
+			Header: Header{Title: PAC, Number: MessageNumber{"BC", "MC", 123}},
+			Flight: Flight{
+				Aircraft:    AircraftID{"DLH456", 'A', "2213"},
+				Departure:   "EDDF",
+				Estimate:    Estimate{Point: "RESMI", Time: "0930", Level: "A090"},
+				Destination: "LFMN",
+			},
+		},
+	},
+	{
+		name: "MAC",
+		text: "(MACE/L008-BAW123-EGLL-LIRF)",
+		msg: &AbrogationOfCoordination{
+			Header:      Header{Title: MAC, Number: MessageNumber{"E", "L", 8}},
+			Aircraft:    AircraftID{Callsign: "BAW123"},
+			Departure:   "EGLL",
+			Destination: "LIRF",
+		},
+	},
+	{
+		name: "LAM",
+		text: "(LAML/E002E/L005)",
+		msg: &LogicalAck{
+			Header: Header{Title: LAM, Number: MessageNumber{"L", "E", 2}, Reference: MessageNumber{"E", "L", 5}},
+		},
+	},
+	{
+		name: "COF",
+		text: "(COFE/L009-BAW123/A4401)",
+		msg: &ChangeOfFrequency{
+			Header:   Header{Title: COF, Number: MessageNumber{"E", "L", 9}},
+			Aircraft: AircraftID{"BAW123", 'A', "4401"},
+		},
+	},
+	{
+		name: "SCO",
+		text: "(SCOE/L010-BAW123-80/124.350)",
+		msg: &SkipCommunication{
+			Header:   Header{Title: SCO, Number: MessageNumber{"E", "L", 10}},
+			Aircraft: AircraftID{Callsign: "BAW123"},
+			Optional: []OptionalField{{80, "124.350"}},
+		},
+	},
+	{
+		name: "unknown title",
+		text: "(XYZE/L011-FOO-BAR BAZ)",
+		msg: &Generic{
+			Header: Header{Title: "XYZ", Number: MessageNumber{"E", "L", 11}},
+			Fields: []string{"FOO", "BAR BAZ"},
+		},
+	},
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, sample := range samples {
+		t.Run(sample.name, func(t *testing.T) {
+			msg, err := Parse([]byte(sample.text))
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if !reflect.DeepEqual(msg, sample.msg) {
+				t.Errorf("Parse: got %+v, expected %+v", msg, sample.msg)
+			}
+
+			b, err := Marshal(msg)
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+			if string(b) != sample.text {
+				t.Errorf("Marshal: got %q, expected %q", b, sample.text)
+			}
+		})
+	}
+}
+
+func TestParseLayout(t *testing.T) {
+	// Line breaks & redundant spaces, as found in messages coming from teletype-style systems
+	text := "(ACTE/L005 -BAW123/A4401\r\n-EGLL-ABNUR/1412F350\r\n-LIRF\r\n-15/N0460F350  ABNUR\r\nUM984 GEN)\r\n"
+	msg, err := Parse([]byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	act, ok := msg.(*Activate)
+	if !ok {
+		t.Fatalf("expected an *Activate, got %T", msg)
+	}
+	if route, _ := act.Field(15); route != "N0460F350 ABNUR UM984 GEN" {
+		t.Errorf("unexpected route %q", route)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+	}{
+		{"empty", ""},
+		{"no parenthesis", "ACTE/L005-BAW123-EGLL-ABNUR/1412F350-LIRF"},
+		{"unterminated", "(ACTE/L005-BAW123-EGLL-ABNUR/1412F350-LIRF"},
+		{"trailing data", "(LAML/E002E/L005)(LAML/E003E/L006)"},
+		{"empty field", "(ACTE/L005--EGLL-ABNUR/1412F350-LIRF)"},
+		{"invalid title", "(AC1E/L005-BAW123-EGLL-ABNUR/1412F350-LIRF)"},
+		{"invalid number", "(ACTE/L05-BAW123-EGLL-ABNUR/1412F350-LIRF)"},
+		{"missing fields", "(ACTE/L005-BAW123-EGLL)"},
+		{"invalid SSR code", "(ACTE/L005-BAW123/A4481-EGLL-ABNUR/1412F350-LIRF)"},
+		{"invalid level", "(ACTE/L005-BAW123-EGLL-ABNUR/1412X350-LIRF)"},
+		{"invalid crossing condition", "(ACTE/L005-BAW123-EGLL-ABNUR/1412F350F330C-LIRF)"},
+		{"invalid optional field", "(ACTE/L005-BAW123-EGLL-ABNUR/1412F350-LIRF-A320)"},
+		{"LAM without reference", "(LAML/E002)"},
+		{"invalid character", "(LAML/E002E/L005\x00)"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if msg, err := Parse([]byte(test.text)); err == nil {
+				t.Errorf("expected an error, got %+v", msg)
+			}
+		})
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+	}{
+		{"invalid unit", &LogicalAck{Header: Header{Title: LAM, Number: MessageNumber{"l", "E", 2}, Reference: MessageNumber{"E", "L", 5}}}},
+		{"LAM without reference", &LogicalAck{Header: Header{Title: LAM, Number: MessageNumber{"L", "E", 2}}}},
+		{"reserved character", &ChangeOfFrequency{
+			Header:   Header{Title: COF, Number: MessageNumber{"E", "L", 9}},
+			Aircraft: AircraftID{Callsign: "BAW123"},
+			Optional: []OptionalField{{18, "RMK/SEE-ALSO"}},
+		}},
+		{"serial overflow", &Generic{Header: Header{Title: "XYZ", Number: MessageNumber{"E", "L", 1000}}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if b, err := Marshal(test.msg); err == nil {
+				t.Errorf("expected an error, got %q", b)
+			}
+		})
+	}
+}
+
+func TestNewLogicalAck(t *testing.T) {
+	act, err := Parse([]byte(samples[1].text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Marshal(NewLogicalAck(act, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "(LAML/E002E/L005)"; string(b) != expected {
+		t.Errorf("got %q, expected %q", b, expected)
+	}
+}
+
+func TestOperationalMessage(t *testing.T) {
+	msg, err := NewOperationalMessage(samples[0].msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Typ() != fmtp.Operational {
+		t.Fatalf("expected an Operational message, got %s", msg.Typ())
+	}
+
+	// Go through the wire format
+	var buf bytes.Buffer
+	if _, err := msg.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	received := &fmtp.Message{}
+	if _, err := received.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadMessage(received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, samples[0].msg) {
+		t.Errorf("got %+v, expected %+v", got, samples[0].msg)
+	}
+
+	// Operator messages are refused
+	operator, err := fmtp.NewOperatorMessage(ioutil.NopCloser(bytes.NewReader([]byte(samples[0].text))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadMessage(operator); err == nil {
+		t.Error("expected an error when reading an Operator message")
+	}
+}
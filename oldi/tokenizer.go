@@ -0,0 +1,173 @@
+package oldi
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+)
+
+// TokenKind is the kind of a token of the ICAO field format
+type TokenKind uint8
+
+// The following constants define the kinds of tokens
+const (
+	// TokenOpen is the opening parenthesis of a message
+	TokenOpen TokenKind = iota
+	// TokenClose is the closing parenthesis of a message
+	TokenClose
+	// TokenSeparator is the hyphen introducing a field
+	TokenSeparator
+	// TokenText is the content of a field
+	TokenText
+	// TokenEOF means the end of the input has been reached
+	TokenEOF
+)
+
+func (k TokenKind) String() string {
+	switch k {
+	case TokenOpen:
+		return "'('"
+	case TokenClose:
+		return "')'"
+	case TokenSeparator:
+		return "'-'"
+	case TokenText:
+		return "text"
+	case TokenEOF:
+		return "EOF"
+	default:
+		return "unknown token"
+	}
+}
+
+// Token is a lexical unit of the ICAO field format
+type Token struct {
+	Kind TokenKind
+
+	// Text is the content of a TokenText, with line breaks replaced by spaces and surrounding spaces trimmed
+	Text string
+
+	// Offset is the position of the token in the input
+	Offset int
+}
+
+// Tokenizer splits a message in ICAO field format into tokens
+type Tokenizer struct {
+	src []byte
+	pos int
+}
+
+// NewTokenizer returns a tokenizer reading from the given input
+func NewTokenizer(b []byte) *Tokenizer {
+	return &Tokenizer{src: b}
+}
+
+// isSpace reports whether c is a whitespace character allowed between tokens
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// Next returns the next token
+// Whitespace between tokens is skipped, a TokenEOF is returned once the end of the input is reached.
+func (t *Tokenizer) Next() (Token, error) {
+	// Skip the leading whitespace
+	for t.pos < len(t.src) && isSpace(t.src[t.pos]) {
+		t.pos++
+	}
+	if t.pos == len(t.src) {
+		return Token{Kind: TokenEOF, Offset: t.pos}, nil
+	}
+
+	// Single-character tokens
+	start := t.pos
+	switch t.src[start] {
+	case '(':
+		t.pos++
+		return Token{Kind: TokenOpen, Offset: start}, nil
+	case ')':
+		t.pos++
+		return Token{Kind: TokenClose, Offset: start}, nil
+	case '-':
+		t.pos++
+		return Token{Kind: TokenSeparator, Offset: start}, nil
+	}
+
+	// Text, up to the next delimiter
+	var buf bytes.Buffer
+	for ; t.pos < len(t.src); t.pos++ {
+		c := t.src[t.pos]
+		if c == '(' || c == ')' || c == '-' {
+			break
+		}
+		switch {
+		case c == '\r' || c == '\n' || c == '\t':
+			c = ' '
+		case c < 0x20 || c > 0x7e:
+			return Token{}, errors.Errorf("invalid character %q at offset %d", c, t.pos)
+		}
+		// Collapse consecutive spaces
+		if c == ' ' && buf.Len() != 0 && buf.Bytes()[buf.Len()-1] == ' ' {
+			continue
+		}
+		buf.WriteByte(c)
+	}
+	return Token{Kind: TokenText, Text: string(bytes.TrimSpace(buf.Bytes())), Offset: start}, nil
+}
+
+// Fields splits a message in ICAO field format into its fields, the first one being field 3
+func Fields(b []byte) ([]string, error) {
+	t := NewTokenizer(b)
+
+	// expect returns the next token, checking its kind
+	expect := func(kind TokenKind) (Token, error) {
+		tok, err := t.Next()
+		if err != nil {
+			return tok, err
+		}
+		if tok.Kind != kind {
+			return tok, errors.Errorf("expected %s at offset %d, got %s", kind, tok.Offset, tok.Kind)
+		}
+		return tok, nil
+	}
+
+	// The message is opened by a parenthesis, immediately followed by field 3
+	if _, err := expect(TokenOpen); err != nil {
+		return nil, err
+	}
+	tok, err := expect(TokenText)
+	if err != nil {
+		return nil, err
+	}
+	fields := []string{tok.Text}
+
+	// Then come the other fields, each introduced by a hyphen, until the closing parenthesis
+	for {
+		tok, err := t.Next()
+		if err != nil {
+			return nil, err
+		}
+		switch tok.Kind {
+		case TokenClose:
+			if _, err := expect(TokenEOF); err != nil {
+				return nil, errors.Wrap(err, "trailing data after message")
+			}
+			return fields, nil
+		case TokenSeparator:
+			tok, err = t.Next()
+			if err != nil {
+				return nil, err
+			}
+			switch tok.Kind {
+			case TokenText:
+				fields = append(fields, tok.Text)
+			case TokenSeparator, TokenClose:
+				// An empty field
+				return nil, errors.Errorf("empty field at offset %d", tok.Offset)
+			default:
+				return nil, errors.Errorf("expected field content at offset %d, got %s", tok.Offset, tok.Kind)
+			}
+		default:
+			return nil, errors.Errorf("expected %s or %s at offset %d, got %s", TokenSeparator, TokenClose, tok.Offset, tok.Kind)
+		}
+	}
+}
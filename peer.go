@@ -0,0 +1,333 @@
+package fmtp
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/aabizri/fmtp/clock"
+	"github.com/pkg/errors"
+)
+
+// These are the default backoff durations for maintained peers
+const (
+	DefaultMinBackoff = 1 * time.Second
+	DefaultMaxBackoff = 2 * time.Minute
+)
+
+var (
+	// ErrAssociationLost is reported when a maintained association ends without a more specific cause, such as a SHUTDOWN from the remote party
+	ErrAssociationLost = errors.New("association lost")
+
+	// ErrPeerDown is returned when sending to a maintained peer which currently has no association
+	ErrPeerDown = errors.New("peer is down")
+)
+
+// PeerState is the state of a maintained peer
+type PeerState uint8
+
+// The following constants define the states of a maintained peer
+const (
+	// PeerConnecting means a connection and association attempt is ongoing
+	PeerConnecting PeerState = iota
+
+	// PeerUp means the peer is associated
+	PeerUp
+
+	// PeerDown means the peer isn't associated, a new attempt will be made after a backoff
+	PeerDown
+
+	// PeerStopped means the peer isn't maintained anymore
+	PeerStopped
+)
+
+func (ps PeerState) String() string {
+	switch ps {
+	case PeerConnecting:
+		return "Connecting"
+	case PeerUp:
+		return "Up"
+	case PeerDown:
+		return "Down"
+	case PeerStopped:
+		return "Stopped"
+	default:
+		return "Unknown PeerState"
+	}
+}
+
+// PeerStatus is a status report of a maintained peer
+type PeerStatus struct {
+	// State is the current state of the peer
+	State PeerState
+
+	// Err is the cause of the peer being down, if any
+	Err error
+
+	// Attempt is the number of consecutive attempts made to reach the peer, starting at 1
+	Attempt int
+
+	// Retry is the time before the next attempt, when the peer is down
+	Retry time.Duration
+}
+
+// MaintainOptions configures a maintained peer
+type MaintainOptions struct {
+	// MinBackoff is the time waited after the first failure, it doubles with every consecutive failure.
+	// If zero, DefaultMinBackoff is used.
+	MinBackoff time.Duration
+
+	// MaxBackoff is the maximum time waited between two attempts. If zero, DefaultMaxBackoff is used.
+	MaxBackoff time.Duration
+
+	// Jitter is the fraction of the backoff by which it is randomly increased or decreased, between 0 and 1
+	Jitter float64
+
+	// Handler is the handler set on every connection to the peer
+	Handler Handler
+
+	// OnStatus is called on every status change of the peer. It is called synchronously and should not block.
+	OnStatus func(PeerStatus)
+}
+
+// Peer is a remote party whose association is maintained by a client, see (*Client).Maintain
+type Peer struct {
+	c    *Client
+	addr string
+	id   ID
+	opts MaintainOptions
+
+	// ctx is cancelled when the peer is stopped
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// done is closed once the supervisor has returned
+	done chan struct{}
+
+	// mu guards the fields below
+	mu     sync.Mutex
+	conn   *Conn
+	status PeerStatus
+}
+
+// Maintain keeps an association with the remote party up, until stopped.
+//
+// It connects & associates with the remote party, and does so again whenever the connection or the association is lost,
+// for example after a Tr expiry or a SHUTDOWN from the remote party.
+// Consecutive failures are separated by an exponential backoff.
+func (c *Client) Maintain(addr string, id ID, opts MaintainOptions) *Peer {
+	// Apply the defaults
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = DefaultMinBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = opts.MinBackoff
+	}
+
+	// Create the peer
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Peer{
+		c:      c,
+		addr:   addr,
+		id:     id,
+		opts:   opts,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	// Launch the supervisor
+	go p.run()
+
+	return p
+}
+
+// ID returns the ID of the remote party
+func (p *Peer) ID() ID {
+	return p.id
+}
+
+// Conn returns the current connection to the peer, nil if it is down
+func (p *Peer) Conn() *Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conn
+}
+
+// Status returns the current status of the peer
+func (p *Peer) Status() PeerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+// Send sends a message to the peer over its current association
+// If the peer is currently down, ErrPeerDown is returned.
+func (p *Peer) Send(ctx context.Context, msg *Message, opts ...SendOption) error {
+	conn := p.Conn()
+	if conn == nil {
+		return ErrPeerDown
+	}
+	return conn.Send(ctx, msg, opts...)
+}
+
+// Stop stops maintaining the peer.
+// If associated, the association is ended gracefully and the connection released.
+// It waits for this to be done, or for the context to expire.
+func (p *Peer) Stop(ctx context.Context) error {
+	p.cancel()
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// setStatus sets the status, notifying the user
+func (p *Peer) setStatus(status PeerStatus) {
+	p.mu.Lock()
+	p.status = status
+	p.mu.Unlock()
+
+	if p.opts.OnStatus != nil {
+		p.opts.OnStatus(status)
+	}
+}
+
+// setConn sets the current connection
+func (p *Peer) setConn(conn *Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conn = conn
+}
+
+// backoff returns the time to wait after the given number of consecutive failures
+func (p *Peer) backoff(failures int) time.Duration {
+	d := p.opts.MinBackoff
+	for i := 1; i < failures && d < p.opts.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.opts.MaxBackoff {
+		d = p.opts.MaxBackoff
+	}
+
+	// Apply the jitter
+	if p.opts.Jitter > 0 {
+		d += time.Duration(p.opts.Jitter * (2*rand.Float64() - 1) * float64(d))
+	}
+	return d
+}
+
+// dial connects & associates with the peer
+// The returned channel holds the last asynchronous error reported by the connection.
+func (p *Peer) dial() (*Conn, <-chan error, error) {
+	conn := p.c.NewConn(p.opts.Handler)
+
+	// Record the asynchronous errors, so that we can report the cause of a loss
+	lastErr := make(chan error, 1)
+	conn.ErrorNotify = func(err error) {
+		select {
+		case <-lastErr:
+		default:
+		}
+		lastErr <- err
+	}
+
+	// Connect & associate
+	err := conn.Init(p.ctx, p.addr, p.id)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Maintain: error while establishing connection")
+	}
+	err = conn.Associate(p.ctx)
+	if err != nil {
+		conn.Close()
+		<-conn.closed
+		return nil, nil, errors.Wrap(err, "Maintain: error while establishing association")
+	}
+	return conn, lastErr, nil
+}
+
+// watch waits until the association with the peer is lost, or the peer stopped
+func (p *Peer) watch(conn *Conn) {
+	for {
+		state, changed := conn.stateChanged()
+		if state != DataReady {
+			return
+		}
+		select {
+		case <-changed:
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// run is the supervisor, it (re)establishes the association until the peer is stopped
+func (p *Peer) run() {
+	defer close(p.done)
+
+	var failures int
+	for {
+		// Connect & associate
+		p.setStatus(PeerStatus{State: PeerConnecting, Attempt: failures + 1})
+		conn, lastErr, err := p.dial()
+		if err == nil {
+			failures = 0
+
+			// Wait for the association to be lost
+			p.setConn(conn)
+			p.setStatus(PeerStatus{State: PeerUp})
+			p.watch(conn)
+			p.setConn(nil)
+
+			// If we have been stopped, end the association gracefully
+			if p.ctx.Err() != nil {
+				ctx, cancel := clock.WithTimeout(context.Background(), p.c.clock, conn.Ti)
+				if conn.State() == DataReady {
+					conn.Deassociate(ctx)
+				}
+				conn.Disconnect(ctx)
+				cancel()
+				conn.Close()
+				<-conn.closed
+				p.setStatus(PeerStatus{State: PeerStopped})
+				return
+			}
+
+			// Release what's left of the connection before reconnecting
+			conn.Close()
+			<-conn.closed
+
+			// Now that the agent has stopped, we can retrieve the cause
+			select {
+			case err = <-lastErr:
+			default:
+				err = ErrAssociationLost
+			}
+		}
+
+		// If we have been stopped, return
+		if p.ctx.Err() != nil {
+			p.setStatus(PeerStatus{State: PeerStopped})
+			return
+		}
+
+		// Wait before the next attempt
+		failures++
+		retry := p.backoff(failures)
+		p.setStatus(PeerStatus{State: PeerDown, Err: err, Attempt: failures, Retry: retry})
+		timer := p.c.clock.NewTimer(retry)
+		select {
+		case <-timer.C():
+		case <-p.ctx.Done():
+			timer.Stop()
+			p.setStatus(PeerStatus{State: PeerStopped})
+			return
+		}
+	}
+}
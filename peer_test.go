@@ -0,0 +1,206 @@
+package fmtp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aabizri/fmtp/clock"
+)
+
+// statuses collects the status changes of a peer
+type statuses chan PeerStatus
+
+func (s statuses) notify(status PeerStatus) {
+	s <- status
+}
+
+// next waits for the next status change, failing the test if it isn't in the expected state
+func (s statuses) next(t *testing.T, want PeerState) PeerStatus {
+	t.Helper()
+	select {
+	case status := <-s:
+		if status.State != want {
+			t.Fatalf("expected the peer to be %s, got %s (%v)", want, status.State, status.Err)
+		}
+		return status
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the peer to be %s, got nothing", want)
+	}
+	return PeerStatus{}
+}
+
+// maintained creates a client with a fake clock maintaining a peer at addr
+func maintained(t *testing.T, addr string, id ID, opts MaintainOptions) (*Peer, *clock.Fake, statuses) {
+	fc := clock.NewFake(time.Now())
+	c := newFakeClient(t, "A", fc, SetTimers(time.Hour, time.Hour, time.Hour))
+	s := make(statuses, 16)
+	opts.OnStatus = s.notify
+	p := c.Maintain(addr, id, opts)
+	t.Cleanup(func() {
+		p.cancel()
+		<-p.done
+	})
+	return p, fc, s
+}
+
+// serveTCP serves a client over a local TCP listener, returning its address
+func serveTCP(t *testing.T, c *Client) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := c.NewServer("", nil)
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().String()
+}
+
+// waitConn waits for the client to have an established connection with the given remote party
+func waitConn(t *testing.T, c *Client, id ID) *Conn {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if conn, ok := c.Conn(id); ok {
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no connection with %s", id)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPeerBackoff(t *testing.T) {
+	p := &Peer{opts: MaintainOptions{MinBackoff: time.Second, MaxBackoff: 10 * time.Second}}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, d := range want {
+		if got := p.backoff(i + 1); got != d {
+			t.Errorf("after %d failures: expected %v, got %v", i+1, d, got)
+		}
+	}
+	if got := p.backoff(1000); got != 10*time.Second {
+		t.Errorf("after 1000 failures: expected %v, got %v", 10*time.Second, got)
+	}
+}
+
+func TestPeerBackoffJitter(t *testing.T) {
+	p := &Peer{opts: MaintainOptions{MinBackoff: time.Second, MaxBackoff: 10 * time.Second, Jitter: 0.5}}
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 1000; i++ {
+		d := p.backoff(2)
+		if d < time.Second || d > 3*time.Second {
+			t.Fatalf("expected a backoff between 1s and 3s, got %v", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 2 {
+		t.Error("expected the backoff to vary")
+	}
+}
+
+// TestPeerRetries checks that the supervisor retries after a backoff doubling with every failure, up to MaxBackoff
+func TestPeerRetries(t *testing.T) {
+	// Find an address nobody listens to
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	_, fc, s := maintained(t, addr, "B", MaintainOptions{MinBackoff: time.Second, MaxBackoff: 4 * time.Second})
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		if status := s.next(t, PeerConnecting); status.Attempt != i+1 {
+			t.Errorf("expected attempt %d, got %d", i+1, status.Attempt)
+		}
+		status := s.next(t, PeerDown)
+		if status.Retry != want || status.Err == nil {
+			t.Errorf("attempt %d: expected a retry after %v with an error, got %v (%v)", i+1, want, status.Retry, status.Err)
+		}
+
+		// Nothing happens until the backoff has elapsed
+		fc.BlockUntil(1)
+		fc.Advance(want - time.Millisecond)
+		select {
+		case status := <-s:
+			t.Fatalf("expected nothing before the backoff elapsed, got %s", status.State)
+		case <-time.After(10 * time.Millisecond):
+		}
+		fc.Advance(time.Millisecond)
+	}
+}
+
+// TestPeerReconnect checks that the supervisor reconnects once the remote party shuts the association down
+func TestPeerReconnect(t *testing.T) {
+	b := newFakeClient(t, "B", clock.NewFake(time.Now()))
+	addr := serveTCP(t, b)
+	p, fc, s := maintained(t, addr, "B", MaintainOptions{MinBackoff: time.Second})
+	s.next(t, PeerConnecting)
+	s.next(t, PeerUp)
+	first := p.Conn()
+
+	// The remote party shuts the association down
+	if err := waitConn(t, b, "A").Deassociate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if status := s.next(t, PeerDown); status.Err != ErrAssociationLost {
+		t.Errorf("expected %v, got %v", ErrAssociationLost, status.Err)
+	}
+	if p.Conn() != nil {
+		t.Error("expected no connection while down")
+	}
+
+	// Once the backoff has elapsed, a new association is established, retrying until the old connection is released remotely
+	deadline := time.After(5 * time.Second)
+	for up := false; !up; {
+		select {
+		case status := <-s:
+			up = status.State == PeerUp
+		case <-time.After(time.Millisecond):
+			fc.Advance(time.Second)
+		case <-deadline:
+			t.Fatal("expected the peer to be up again")
+		}
+	}
+	if conn := p.Conn(); conn == nil || conn == first || conn.State() != DataReady {
+		t.Error("expected a new association")
+	}
+}
+
+// TestPeerStop checks that stopping a peer ends the association gracefully
+func TestPeerStop(t *testing.T) {
+	down := make(chan Event, 1)
+	b := newFakeClient(t, "B", clock.NewFake(time.Now()), SetEventHook(func(ev Event) {
+		if ev.Type != EventAssociationDown {
+			return
+		}
+		select {
+		case down <- ev:
+		default:
+		}
+	}))
+	addr := serveTCP(t, b)
+	p, _, s := maintained(t, addr, "B", MaintainOptions{})
+	s.next(t, PeerConnecting)
+	s.next(t, PeerUp)
+	remote := waitConn(t, b, "A")
+
+	if err := p.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s.next(t, PeerStopped)
+	select {
+	case ev := <-down:
+		if ev.Initiator != RemoteParty || ev.Err != nil {
+			t.Errorf("expected the association to be shut down by the remote party, got %v (%v)", ev.Initiator, ev.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SHUTDOWN not received by the remote party")
+	}
+	<-remote.closed
+	if p.Conn() != nil {
+		t.Error("expected no connection once stopped")
+	}
+}
@@ -1,32 +1,39 @@
 package fmtp
 
 import (
-	"bytes"
+	"context"
 	"io"
+	"time"
 )
 
-// inAgent receives incoming messages in a reader & unmarshal them, sending them as message when they are ready
+// inAgent receives incoming messages through a decoder, sending them as message when they are ready
 // reading & unmarshalling is tightly coupled as TCP is a streaming protocol, so we can't use a pipeline infrastructure here.
-func inAgent(in io.Reader, done chan struct{}, buffer int) (out chan *Message, errChan chan error) {
+//
+// It stops after the first error, or once done is closed and the reader unblocked.
+// If observe isn't nil, it is called for every message received.
+func inAgent(in *Decoder, done chan struct{}, buffer int, observe func(*Message)) (out chan *Message, errChan chan error) {
 	// Create the return channels
 	out = make(chan *Message, buffer)
 	errChan = make(chan error)
 
 	// Launch the goroutine
-	go func(in io.Reader, done chan struct{}, out chan *Message, errChan chan error) {
+	go func(in *Decoder, done chan struct{}, out chan *Message, errChan chan error) {
 		for {
-			select {
-			default:
-				msg := &Message{}
-				_, err := msg.ReadFrom(in)
-				if err != nil {
-					errChan <- err
-				} else {
-					out <- msg
+			msg := &Message{}
+			err := in.Decode(msg)
+			if err != nil {
+				select {
+				case errChan <- err:
+				case <-done:
 				}
+				return
+			}
+			if observe != nil {
+				observe(msg)
+			}
+			select {
+			case out <- msg:
 			case <-done:
-				close(out)
-				close(errChan)
 				return
 			}
 		}
@@ -36,86 +43,83 @@ func inAgent(in io.Reader, done chan struct{}, buffer int) (out chan *Message, e
 	return
 }
 
-// outAgent receives outgoing messages, marshals them and writes them to a writer
-// it uses marshalAgent and writeAgent to make it pretty and efficient
-func outAgent(w io.Writer, in chan *Message, done chan struct{}, buffer int) chan error {
-	// Create the marshaller
-	binChan, binErrChan := marshalAgent(in, done, buffer)
+// outgoing is a message handed to a connection's writer, the result of its writing being reported on done.
+// Without a message, it is a barrier reported once everything queued before it has been written.
+type outgoing struct {
+	ctx      context.Context
+	msg      *Message
+	priority Priority
+	done     chan error
 
-	// Create the writer
-	wErrChan := writeAgent(w, binChan, done)
-
-	// Merge the two error chan
-	errChan := make(chan error)
-	go func(bec, wec, ec chan error, done chan struct{}) {
-		for {
-			select {
-			case err := <-bec:
-				ec <- err
-			case err := <-wec:
-				ec <- err
-			case <-done:
-				return
-			}
-		}
-	}(binErrChan, wErrChan, errChan, done)
+	// at is when it was handed over
+	at time.Time
 
-	// Return the channels
-	return errChan
+	// sig is the signal of a system message, set by the writer
+	sig *systemSig
 }
 
-// marshalAgent marshals messages
-func marshalAgent(in chan *Message, done chan struct{}, buffer int) (out chan []byte, errChan chan error) {
-	// Create the return channels
-	out = make(chan []byte, buffer)
-	errChan = make(chan error)
-
-	// Launch the goroutine
-	go func(in chan *Message, done chan struct{}, out chan []byte, errChan chan error) {
+// outAgent is the single writer of a connection: it writes the outgoing messages one at a time, reporting the result of each.
+// The messages of higher priority are written first, those of a given priority in order.
+// A message whose context has expired while queued isn't written.
+//
+// Once a SHUTDOWN has been written, the data messages still queued belong to the association it ended: they fail with
+// ErrConnectionClosed instead of being written, until a STARTUP is written.
+//
+// It stops once done is closed, the messages still queued are then left to their senders.
+// If observe isn't nil, it is called for every message written or failed, before the result is reported.
+func outAgent(w io.Writer, in lanes, done chan struct{}, observe func(o *outgoing, n int64, err error)) {
+	go func() {
+		enc := NewEncoder(w)
+		shut := false
 		for {
-			select {
-
-			case msg := <-in:
-				buf := &bytes.Buffer{}
-				_, err := msg.WriteTo(buf)
-				if err != nil {
-					errChan <- err
-				} else {
-					out <- buf.Bytes()
-				}
-			case <-done:
-				close(out)
-				close(errChan)
+			o := in.next(done)
+			if o == nil {
 				return
 			}
-		}
-	}(in, done, out, errChan)
-
-	// Return the channels
-	return
-}
-
-// writeAgent writes incoming []byte to a given io.Writer
-func writeAgent(w io.Writer, in chan []byte, done chan struct{}) chan error {
-	// Create the error return channel
-	errChan := make(chan error)
-
-	// Launch the goroutine
-	go func(w io.Writer, in chan []byte, done chan struct{}, errChan chan error) {
-		for {
-			select {
-			case b := <-in:
-				_, err := w.Write(b)
-				if err != nil {
-					errChan <- err
+			if o.msg == nil {
+				o.done <- nil
+				continue
+			}
+			var (
+				n   int64
+				err = o.ctx.Err()
+				sig = signalOf(o.msg)
+			)
+			o.sig = sig
+			if typ := o.msg.Typ(); err == nil && shut && (typ == Operator || typ == Operational) {
+				err = ErrConnectionClosed
+			}
+			if err == nil {
+				n, err = enc.encode(o.msg)
+			}
+			if err == nil && sig != nil {
+				switch {
+				case sig.equals(shutdown):
+					shut = true
+				case sig.equals(startup):
+					shut = false
 				}
-			case <-done:
-				close(errChan)
-				return
 			}
+			if observe != nil {
+				observe(o, n, err)
+			}
+			o.done <- err
 		}
-	}(w, in, done, errChan)
+	}()
+}
 
-	// Return
-	return errChan
+// signalOf returns the signal of a system message, nil for any other message
+func signalOf(msg *Message) *systemSig {
+	if msg.Typ() != system {
+		return nil
+	}
+	p, err := msg.Payload()
+	if err != nil {
+		return nil
+	}
+	ss := &systemSig{}
+	if ss.UnmarshalBinary(p) != nil {
+		return nil
+	}
+	return ss
 }
@@ -0,0 +1,138 @@
+package fmtp
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aabizri/fmtp/clock"
+)
+
+func TestOutAgent(t *testing.T) {
+	var (
+		buf      = &bytes.Buffer{}
+		in       = newLanes(2)
+		done     = make(chan struct{})
+		observed []error
+	)
+	defer close(done)
+	outAgent(buf, in, done, func(o *outgoing, n int64, err error) {
+		observed = append(observed, err)
+	})
+
+	// A message whose context has expired is not written
+	expired, cancel := context.WithCancel(context.Background())
+	cancel()
+	first := &outgoing{ctx: expired, msg: mustMessage(NewOperatorMessageString("late")), done: make(chan error, 1)}
+	second := &outgoing{ctx: context.Background(), msg: mustMessage(NewOperatorMessageString("on time")), done: make(chan error, 1)}
+	in[PriorityNormal] <- first
+	in[PriorityNormal] <- second
+	if err := <-first.done; err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	if err := <-second.done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the second one has been written, and both have been observed
+	msg := &Message{}
+	if _, err := msg.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := msg.Payload(); string(p) != "on time" || buf.Len() != 0 {
+		t.Errorf("unexpected message written %q, %d bytes remaining", p, buf.Len())
+	}
+	if len(observed) != 2 || observed[0] != context.Canceled || observed[1] != nil {
+		t.Errorf("unexpected observations %v", observed)
+	}
+}
+
+func TestOutAgentPriorities(t *testing.T) {
+	var (
+		buf  = &bytes.Buffer{}
+		in   = newLanes(4)
+		done = make(chan struct{})
+		all  []*outgoing
+	)
+	defer close(done)
+
+	// Queue bulk traffic first, then a HEARTBEAT and an Operator message, before the writer is started
+	queue := func(msg *Message, priority Priority) {
+		o := &outgoing{ctx: context.Background(), msg: msg, priority: priority, done: make(chan error, 1)}
+		in[priority] <- o
+		all = append(all, o)
+	}
+	queue(mustMessage(NewOperationalMessage(bytes.NewReader([]byte("bulk 1")))), PriorityLow)
+	queue(mustMessage(NewOperationalMessage(bytes.NewReader([]byte("bulk 2")))), PriorityLow)
+	queue(mustMessage(NewOperatorMessageString("operator")), priorityOf(Operator))
+	queue(mustMessage(newSystemMessage(heartbeat)), priorityOf(system))
+	outAgent(buf, in, done, nil)
+	for _, o := range all {
+		if err := <-o.done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The HEARTBEAT goes first, and the bulk traffic last, in order
+	want := []string{"03", "operator", "bulk 1", "bulk 2"}
+	for i, w := range want {
+		msg := &Message{}
+		if _, err := msg.ReadFrom(buf); err != nil {
+			t.Fatal(err)
+		}
+		if p, _ := msg.Payload(); string(p) != w {
+			t.Errorf("message %d: expected %q, got %q", i, w, p)
+		}
+	}
+}
+
+func TestSendPriority(t *testing.T) {
+	operational := mustMessage(NewOperationalMessage(bytes.NewReader(nil)))
+	tests := []struct {
+		msg  *Message
+		opts []SendOption
+		want Priority
+	}{
+		{operational, nil, PriorityLow},
+		{mustMessage(NewOperatorMessageString("")), nil, PriorityNormal},
+		{mustMessage(newSystemMessage(shutdown)), nil, PriorityHigh},
+		{operational, []SendOption{WithPriority(PriorityHigh)}, PriorityHigh},
+	}
+	for i, test := range tests {
+		got, err := sendPriority(test.msg, test.opts)
+		if err != nil || got != test.want {
+			t.Errorf("%d: expected %s, got %s (%v)", i, test.want, got, err)
+		}
+	}
+	if _, err := sendPriority(operational, []SendOption{WithPriority(Priority(numPriorities))}); err == nil {
+		t.Error("expected an error for an unknown priority")
+	}
+}
+
+// latencies records the latency of the messages sent
+type latencies struct {
+	nopMetrics
+	got chan time.Duration
+}
+
+func (l latencies) MessageSent(_ ID, _ Typ, _ int, latency time.Duration) {
+	l.got <- latency
+}
+
+// TestSendLatency checks that the time a message spent queued is measured with the client's clock
+func TestSendLatency(t *testing.T) {
+	fc := clock.NewFake(time.Now())
+	m := latencies{got: make(chan time.Duration, 1)}
+	conn := newFakeClient(t, "A", fc, SetMetrics(m)).NewConn(nil)
+
+	msg := mustMessage(newSystemMessage(heartbeat))
+	if err := conn.enqueue(context.Background(), msg, PriorityHigh, make(chan error, 1)); err != nil {
+		t.Fatal(err)
+	}
+	fc.Advance(time.Second)
+	conn.written(<-conn.out[PriorityHigh], 7, nil)
+	if latency := <-m.got; latency != time.Second {
+		t.Errorf("expected a latency of 1s, got %v", latency)
+	}
+}
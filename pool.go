@@ -0,0 +1,71 @@
+// in pool.go are the buffer pools used to send and receive messages without allocating
+
+package fmtp
+
+import (
+	"bytes"
+	"sync"
+)
+
+// bufClasses are the sizes of the pooled buffers, so that a small message doesn't hold a buffer sized for the largest one
+var bufClasses = [...]int{512, 4096, maxLength}
+
+// bufPools holds a pool per buffer class
+var bufPools [len(bufClasses)]sync.Pool
+
+func init() {
+	for i := range bufPools {
+		size := bufClasses[i]
+		bufPools[i].New = func() interface{} {
+			b := make([]byte, size)
+			return &b
+		}
+	}
+}
+
+// getBuf returns a pooled buffer of at least n bytes, n being at most maxLength
+func getBuf(n int) *[]byte {
+	for i, size := range bufClasses {
+		if n <= size {
+			return bufPools[i].Get().(*[]byte)
+		}
+	}
+	panic("getBuf: buffer larger than the maximum message length requested")
+}
+
+// putBuf gives a buffer back to its pool
+func putBuf(b *[]byte) {
+	for i, size := range bufClasses {
+		if cap(*b) == size {
+			*b = (*b)[:size]
+			bufPools[i].Put(b)
+			return
+		}
+	}
+}
+
+// lentBody is a message body held in a pooled buffer, which is given back once it is closed.
+// It is lent to the handler, and closed once the handler returns.
+type lentBody struct {
+	bytes.Reader
+	b   []byte
+	buf *[]byte
+}
+
+// newLentBody returns a body of n bytes in a pooled buffer, to be filled through b
+func newLentBody(n int) *lentBody {
+	buf := getBuf(n)
+	lb := &lentBody{b: (*buf)[:n], buf: buf}
+	lb.Reset(lb.b)
+	return lb
+}
+
+// Close gives the buffer back to the pool, after which the body is empty
+func (lb *lentBody) Close() error {
+	if lb.buf != nil {
+		putBuf(lb.buf)
+		lb.buf, lb.b = nil, nil
+		lb.Reset(nil)
+	}
+	return nil
+}
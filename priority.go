@@ -0,0 +1,113 @@
+package fmtp
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Priority is the priority of an outbound message: a connection's writer always writes the queued messages of higher priority first.
+type Priority uint8
+
+// The following constants define the priorities, each being a separate lane of the connection's writer
+const (
+	// PriorityLow is the default for Operational messages, which are bulk traffic
+	PriorityLow Priority = iota
+
+	// PriorityNormal is the default for Operator messages
+	PriorityNormal
+
+	// PriorityHigh is the priority of system and identification messages, so that heartbeats and SHUTDOWNs aren't delayed by data
+	PriorityHigh
+
+	// numPriorities is the number of lanes
+	numPriorities = int(PriorityHigh) + 1
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "Low"
+	case PriorityNormal:
+		return "Normal"
+	case PriorityHigh:
+		return "High"
+	default:
+		return "Unknown Priority"
+	}
+}
+
+// priorityOf returns the default priority of a message type
+func priorityOf(typ Typ) Priority {
+	switch typ {
+	case Operational:
+		return PriorityLow
+	case Operator:
+		return PriorityNormal
+	default:
+		return PriorityHigh
+	}
+}
+
+// sendOptions are the options of a Send
+type sendOptions struct {
+	priority    Priority
+	hasPriority bool
+}
+
+// SendOption is an option of Send
+type SendOption func(*sendOptions)
+
+// WithPriority sets the priority of the message sent, overriding the default of its type
+func WithPriority(p Priority) SendOption {
+	return func(so *sendOptions) {
+		so.priority = p
+		so.hasPriority = true
+	}
+}
+
+// sendPriority returns the priority of a message sent with the given options
+func sendPriority(msg *Message, opts []SendOption) (Priority, error) {
+	so := &sendOptions{}
+	for _, opt := range opts {
+		opt(so)
+	}
+	if !so.hasPriority {
+		return priorityOf(msg.Typ()), nil
+	}
+	if so.priority > PriorityHigh {
+		return 0, errors.Errorf("Send: unknown priority %d", so.priority)
+	}
+	return so.priority, nil
+}
+
+// lanes are the queues of a connection's writer, one per priority
+type lanes [numPriorities]chan *outgoing
+
+// newLanes returns lanes each holding up to size messages
+func newLanes(size int) lanes {
+	var l lanes
+	for i := range l {
+		l[i] = make(chan *outgoing, size)
+	}
+	return l
+}
+
+// next returns the queued message of highest priority, waiting for one if none is, or nil once done is closed
+func (l lanes) next(done chan struct{}) *outgoing {
+	for p := numPriorities - 1; p >= 0; p-- {
+		select {
+		case o := <-l[p]:
+			return o
+		default:
+		}
+	}
+	select {
+	case o := <-l[PriorityHigh]:
+		return o
+	case o := <-l[PriorityNormal]:
+		return o
+	case o := <-l[PriorityLow]:
+		return o
+	case <-done:
+		return nil
+	}
+}
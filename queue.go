@@ -0,0 +1,578 @@
+// queue.go implements the store-and-forward outbound queues
+//
+// Each remote party has its own queue, messages are appended to it while the association is down, and flushed
+// in order once it is established.
+// When durable, a queue is backed by an append-only file made of records:
+// 	- a put record ('P'), followed by the enqueue time (int64, unix nanoseconds), the typ (uint8),
+// 	the body length (uint16) and the body, all big endian.
+// 	- a pop record ('D'), indicating that the oldest message has been removed from the queue.
+// The file is compacted once enough messages have been removed.
+
+package fmtp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrQueueFull is returned when a message can't be queued as the queue's limits have been reached
+	ErrQueueFull = errors.New("queue full")
+
+	// ErrQueueDisabled is returned when queueing a message on a client without queues
+	ErrQueueDisabled = errors.New("queueing is not enabled on this client")
+)
+
+// DropPolicy defines what happens when a message is queued while the queue is full
+type DropPolicy uint8
+
+// The following constants define the available drop policies
+const (
+	// DropOldest discards the oldest queued messages to make room for the new one
+	DropOldest DropPolicy = iota
+
+	// RejectNew refuses the new message, ErrQueueFull is returned
+	RejectNew
+)
+
+// QueueOptions configures the store-and-forward queues of a client
+type QueueOptions struct {
+	// Dir is the directory where the queue files are stored, one per remote ID.
+	// If empty, the queues are only kept in memory.
+	Dir string
+
+	// Sync indicates whether the queue file should be synced to stable storage after every message queued
+	Sync bool
+
+	// MaxMessages is the maximum number of messages in a queue, 0 means unlimited
+	MaxMessages int
+
+	// MaxBytes is the maximum combined size of the message bodies in a queue, 0 means unlimited
+	MaxBytes int
+
+	// MaxAge is the maximum time a message may wait in a queue, older messages are discarded. 0 means unlimited
+	MaxAge time.Duration
+
+	// Policy is what happens when MaxMessages or MaxBytes would be exceeded
+	Policy DropPolicy
+}
+
+// SetQueue enables the store-and-forward outbound queues on a client, see (*Client).Enqueue
+func SetQueue(opts QueueOptions) ClientSetter {
+	return func(c *Client) error {
+		if opts.Dir != "" {
+			err := os.MkdirAll(opts.Dir, 0700)
+			if err != nil {
+				return errors.Wrap(err, "SetQueue: error while creating queue directory")
+			}
+		}
+		c.queueOpts = &opts
+		c.queues = map[ID]*queue{}
+		return nil
+	}
+}
+
+// Enqueue queues a message for the given remote party.
+// The queued messages are sent in order once an association is established with the remote party,
+// and immediately if there currently is one.
+// Only Operational and Operator messages may be queued. The message body is consumed.
+func (c *Client) Enqueue(id ID, msg *Message) error {
+	// Get the queue
+	q, err := c.queue(id)
+	if err != nil {
+		return err
+	}
+
+	// Check the message type
+	typ := msg.Typ()
+	if typ != Operational && typ != Operator {
+		return errors.Errorf("Enqueue: cannot queue a message of typ %s", typ)
+	}
+
+	// Read the body
+	defer msg.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(msg.Body, MaxBodyLen+1))
+	if err != nil {
+		return err
+	} else if len(body) > MaxBodyLen {
+		return errors.New("Enqueue: cannot queue message as body is larger than MaxBodyLen")
+	}
+
+	// Push it
+	err = q.push(queueEntry{at: c.clock.Now(), typ: typ, body: body})
+	if err != nil {
+		return err
+	}
+
+	// If we are associated, flush now
+	c.currentConnsMu.RLock()
+	conn := c.currentConns[id]
+	c.currentConnsMu.RUnlock()
+	if conn != nil && conn.State() == DataReady {
+		return conn.flushQueue()
+	}
+
+	return nil
+}
+
+// QueueLen returns the number of messages queued for the given remote party
+func (c *Client) QueueLen(id ID) int {
+	q, err := c.queue(id)
+	if err != nil {
+		return 0
+	}
+	return q.len()
+}
+
+// queue returns the queue for the given remote party, opening it if needed
+func (c *Client) queue(id ID) (*queue, error) {
+	if c.queueOpts == nil {
+		return nil, ErrQueueDisabled
+	}
+
+	c.queuesMu.Lock()
+	defer c.queuesMu.Unlock()
+	if c.queues == nil {
+		return nil, ErrClientClosed
+	}
+	if q, ok := c.queues[id]; ok {
+		return q, nil
+	}
+
+	// Create it
+	path := ""
+	if c.queueOpts.Dir != "" {
+		path = filepath.Join(c.queueOpts.Dir, url.PathEscape(string(id))+".fmtpq")
+	}
+	q, err := openQueue(path, *c.queueOpts)
+	if err != nil {
+		return nil, err
+	}
+	c.queues[id] = q
+	return q, nil
+}
+
+// closeQueues closes every queue, after which messages can't be queued anymore
+func (c *Client) closeQueues() error {
+	c.queuesMu.Lock()
+	defer c.queuesMu.Unlock()
+
+	var first error
+	for _, q := range c.queues {
+		if err := q.close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	if c.queueOpts != nil {
+		c.queues = nil
+	}
+	return first
+}
+
+// flushQueue starts sending the messages queued for the remote party, unless they are already being sent.
+// They are sent from a goroutine of their own, so that the agent isn't blocked meanwhile.
+func (conn *Conn) flushQueue() error {
+	q, err := conn.client.queue(conn.remote)
+	if err == ErrQueueDisabled {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if q.startFlush(conn) {
+		go q.flush(conn)
+	}
+	return nil
+}
+
+// flush sends the queued messages over conn, then over the connection it has been asked to flush to meanwhile, if any
+func (q *queue) flush(conn *Conn) {
+	for ; conn != nil; conn = q.endFlush() {
+		err := conn.sendQueued(q)
+		if err != nil && err != ErrConnectionClosed {
+			conn.log().Errorf("error while flushing queue: %v", err)
+			conn.handleErr(err)
+		}
+	}
+}
+
+// sendQueued hands the queued messages to the writer one at a time, in order, each being removed from the queue once written.
+// It returns once the queue is empty, the association is lost or an error happens.
+func (conn *Conn) sendQueued(q *queue) error {
+	for conn.State() == DataReady {
+		e, ok := q.peek(conn.client.clock.Now())
+		if !ok {
+			return nil
+		}
+
+		// Send it
+		msg, err := NewMessage(e.typ, bytes.NewReader(e.body))
+		if err != nil {
+			return err
+		}
+		err = conn.send(context.Background(), msg)
+		if err != nil {
+			return err
+		}
+
+		// Now that it has been sent, remove it
+		err = q.pop(e.seq)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queueEntry is a queued message
+type queueEntry struct {
+	at   time.Time
+	typ  Typ
+	body []byte
+
+	// seq identifies the entry within the queue, it isn't persisted
+	seq uint64
+}
+
+const (
+	putRecord = 'P'
+	popRecord = 'D'
+
+	// putRecordLen is the length of a put record, excluding the body
+	putRecordLen = 1 + 8 + 1 + 2
+
+	// compactThreshold is the number of pop records after which a queue file is compacted
+	compactThreshold = 1024
+)
+
+// queue is a store-and-forward queue for a single remote party
+type queue struct {
+	opts QueueOptions
+
+	// mu guards the fields below
+	mu      sync.Mutex
+	entries []queueEntry
+	size    int
+
+	// seq is the sequence number of the last entry added
+	seq uint64
+
+	// flushing is set while a flusher is running, next being the connection it has been asked to flush to meanwhile
+	flushing bool
+	next     *Conn
+
+	// closed is set once the queue has been closed
+	closed bool
+
+	// path and file are the backing file, nil if the queue is in-memory only
+	path string
+	file *os.File
+
+	// pops is the number of pop records in the file
+	pops int
+}
+
+// openQueue opens a queue, replaying its backing file if there is one
+func openQueue(path string, opts QueueOptions) (*queue, error) {
+	q := &queue{opts: opts, path: path}
+	if path == "" {
+		return q, nil
+	}
+
+	// Open the file
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "openQueue: error while opening queue file")
+	}
+
+	// Replay it
+	valid, err := q.replay(bufio.NewReader(f))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// Drop a partially written trailing record, if any
+	err = f.Truncate(valid)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "openQueue: error while truncating queue file")
+	}
+	_, err = f.Seek(valid, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	q.file = f
+
+	// Compact it now, as we don't need the history
+	err = q.compactLocked()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// replay reads the records in r, returning the offset of the end of the last complete record
+func (q *queue) replay(r io.Reader) (int64, error) {
+	var offset int64
+	hdr := make([]byte, putRecordLen)
+	for {
+		// Read the record kind
+		_, err := io.ReadFull(r, hdr[:1])
+		if err == io.EOF {
+			return offset, nil
+		} else if err != nil {
+			return offset, errors.Wrap(err, "replay: error while reading queue file")
+		}
+
+		switch hdr[0] {
+		case popRecord:
+			if len(q.entries) != 0 {
+				q.size -= len(q.entries[0].body)
+				q.entries = q.entries[1:]
+			}
+			q.pops++
+			offset++
+		case putRecord:
+			_, err = io.ReadFull(r, hdr[1:])
+			if err == io.ErrUnexpectedEOF || err == io.EOF {
+				return offset, nil
+			} else if err != nil {
+				return offset, errors.Wrap(err, "replay: error while reading queue file")
+			}
+			e := queueEntry{
+				at:   time.Unix(0, int64(binary.BigEndian.Uint64(hdr[1:9]))),
+				typ:  Typ(hdr[9]),
+				body: make([]byte, binary.BigEndian.Uint16(hdr[10:12])),
+			}
+			_, err = io.ReadFull(r, e.body)
+			if err == io.ErrUnexpectedEOF || err == io.EOF {
+				return offset, nil
+			} else if err != nil {
+				return offset, errors.Wrap(err, "replay: error while reading queue file")
+			}
+			q.seq++
+			e.seq = q.seq
+			q.entries = append(q.entries, e)
+			q.size += len(e.body)
+			offset += int64(putRecordLen + len(e.body))
+		default:
+			return offset, errors.Errorf("replay: corrupted queue file, unknown record kind %q at offset %d", hdr[0], offset)
+		}
+	}
+}
+
+// marshalPutRecord returns the put record for an entry
+func marshalPutRecord(e queueEntry) []byte {
+	b := make([]byte, putRecordLen, putRecordLen+len(e.body))
+	b[0] = putRecord
+	binary.BigEndian.PutUint64(b[1:9], uint64(e.at.UnixNano()))
+	b[9] = byte(e.typ)
+	binary.BigEndian.PutUint16(b[10:12], uint16(len(e.body)))
+	return append(b, e.body...)
+}
+
+// len returns the number of queued messages
+func (q *queue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
+
+// push appends an entry to the queue, applying the limits
+func (q *queue) push(e queueEntry) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrClientClosed
+	}
+
+	// Check the limits
+	for q.full(len(e.body)) {
+		if q.opts.Policy == RejectNew || len(q.entries) == 0 {
+			return ErrQueueFull
+		}
+		err := q.popLocked()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Persist it
+	if q.file != nil {
+		_, err := q.file.Write(marshalPutRecord(e))
+		if err != nil {
+			return errors.Wrap(err, "push: error while writing to queue file")
+		}
+		if q.opts.Sync {
+			err = q.file.Sync()
+			if err != nil {
+				return errors.Wrap(err, "push: error while syncing queue file")
+			}
+		}
+	}
+
+	// Add it
+	q.seq++
+	e.seq = q.seq
+	q.entries = append(q.entries, e)
+	q.size += len(e.body)
+	return nil
+}
+
+// full reports whether adding a body of the given size would exceed the limits
+func (q *queue) full(bodyLen int) bool {
+	return (q.opts.MaxMessages > 0 && len(q.entries)+1 > q.opts.MaxMessages) ||
+		(q.opts.MaxBytes > 0 && q.size+bodyLen > q.opts.MaxBytes)
+}
+
+// peek returns the oldest entry, discarding the ones older than MaxAge at the given time
+func (q *queue) peek(now time.Time) (queueEntry, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.entries) != 0 {
+		e := q.entries[0]
+		if q.opts.MaxAge == 0 || now.Sub(e.at) <= q.opts.MaxAge {
+			return e, true
+		}
+		if err := q.popLocked(); err != nil {
+			return queueEntry{}, false
+		}
+	}
+	return queueEntry{}, false
+}
+
+// pop removes the oldest entry, if it is still the one with the given sequence number
+func (q *queue) pop(seq uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.entries) == 0 || q.entries[0].seq != seq {
+		return nil
+	}
+	return q.popLocked()
+}
+
+func (q *queue) popLocked() error {
+	if len(q.entries) == 0 {
+		return nil
+	}
+	if q.closed {
+		return ErrClientClosed
+	}
+
+	// Persist it
+	if q.file != nil {
+		_, err := q.file.Write([]byte{popRecord})
+		if err != nil {
+			return errors.Wrap(err, "pop: error while writing to queue file")
+		}
+		q.pops++
+	}
+
+	// Remove it
+	q.size -= len(q.entries[0].body)
+	q.entries[0] = queueEntry{}
+	q.entries = q.entries[1:]
+
+	// Compact if needed
+	if q.pops >= compactThreshold {
+		return q.compactLocked()
+	}
+	return nil
+}
+
+// compactLocked rewrites the queue file with only the remaining entries
+func (q *queue) compactLocked() error {
+	if q.file == nil || q.pops == 0 {
+		return nil
+	}
+
+	// Write the remaining entries to a temporary file
+	tmpPath := q.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "compact: error while creating temporary queue file")
+	}
+	w := bufio.NewWriter(tmp)
+	for _, e := range q.entries {
+		_, err = w.Write(marshalPutRecord(e))
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return errors.Wrap(err, "compact: error while writing temporary queue file")
+	}
+
+	// Replace the old one
+	err = os.Rename(tmpPath, q.path)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return errors.Wrap(err, "compact: error while replacing queue file")
+	}
+	q.file.Close()
+	q.file = tmp
+	q.pops = 0
+	return nil
+}
+
+// startFlush reports whether a flusher should be started for conn, asking the running one to flush to it afterwards otherwise
+func (q *queue) startFlush(conn *Conn) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.flushing {
+		q.next = conn
+		return false
+	}
+	q.flushing = true
+	return true
+}
+
+// endFlush returns the connection the flusher has been asked to flush to meanwhile, or nil once it is done
+func (q *queue) endFlush() *Conn {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	conn := q.next
+	q.next = nil
+	if conn == nil {
+		q.flushing = false
+	}
+	return conn
+}
+
+// close closes the queue file, the queued messages are kept there
+func (q *queue) close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	if q.file == nil {
+		return nil
+	}
+	err := q.file.Close()
+	q.file = nil
+	return err
+}
@@ -0,0 +1,258 @@
+package fmtp
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aabizri/fmtp/clock"
+)
+
+// entry returns a queue entry with the given body
+func entry(at time.Time, body string) queueEntry {
+	return queueEntry{at: at, typ: Operator, body: []byte(body)}
+}
+
+// expectEntries checks the bodies of the queued entries
+func expectEntries(t *testing.T, q *queue, want ...string) {
+	t.Helper()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.entries) != len(want) {
+		t.Fatalf("expected %d entries, got %d", len(want), len(q.entries))
+	}
+	for i, e := range q.entries {
+		if string(e.body) != want[i] {
+			t.Errorf("entry %d: expected %q, got %q", i, want[i], e.body)
+		}
+	}
+}
+
+// fileSize returns the size of a file
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+// mustOpenQueue opens a queue, failing the test otherwise
+func mustOpenQueue(t *testing.T, path string, opts QueueOptions) *queue {
+	t.Helper()
+	q, err := openQueue(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.close() })
+	return q
+}
+
+func TestQueueReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "B.fmtpq")
+	at := time.Unix(0, 1234567890)
+	q := mustOpenQueue(t, path, QueueOptions{})
+	for _, body := range []string{"one", "two", "three"} {
+		if err := q.push(entry(at, body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e, _ := q.peek(at)
+	if err := q.pop(e.seq); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The remaining entries are replayed, with their time and type
+	q = mustOpenQueue(t, path, QueueOptions{})
+	expectEntries(t, q, "two", "three")
+	if e, _ := q.peek(at); !e.at.Equal(at) || e.typ != Operator {
+		t.Errorf("unexpected entry replayed: %+v", e)
+	}
+}
+
+func TestQueueTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "B.fmtpq")
+	q := mustOpenQueue(t, path, QueueOptions{})
+	q.push(entry(time.Now(), "one"))
+	q.push(entry(time.Now(), "two"))
+	q.close()
+	valid := fileSize(t, path)
+
+	// A record was being written when we stopped
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(marshalPutRecord(entry(time.Now(), "three"))[:putRecordLen+2])
+	f.Close()
+
+	// It is dropped, and the file usable again
+	q = mustOpenQueue(t, path, QueueOptions{})
+	expectEntries(t, q, "one", "two")
+	if size := fileSize(t, path); size != valid {
+		t.Errorf("expected the file to be truncated to %d bytes, got %d", valid, size)
+	}
+	q.push(entry(time.Now(), "four"))
+	q.close()
+	q = mustOpenQueue(t, path, QueueOptions{})
+	expectEntries(t, q, "one", "two", "four")
+}
+
+func TestQueueCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "B.fmtpq")
+	q := mustOpenQueue(t, path, QueueOptions{})
+	for i := 0; i < compactThreshold+1; i++ {
+		if err := q.push(entry(time.Now(), "x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Once enough entries have been removed, only the remaining one is left in the file
+	for i := 0; i < compactThreshold; i++ {
+		e, _ := q.peek(time.Now())
+		if err := q.pop(e.seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if size, want := fileSize(t, path), int64(putRecordLen+1); size != want {
+		t.Errorf("expected a compacted file of %d bytes, got %d", want, size)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("expected the temporary file to be gone, got %v", err)
+	}
+
+	q.close()
+	q = mustOpenQueue(t, path, QueueOptions{})
+	expectEntries(t, q, "x")
+}
+
+func TestQueueLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		opts QueueOptions
+		err  error
+		want []string
+	}{
+		{"DropOldest messages", QueueOptions{MaxMessages: 2, Policy: DropOldest}, nil, []string{"bb", "ccc"}},
+		{"RejectNew messages", QueueOptions{MaxMessages: 2, Policy: RejectNew}, ErrQueueFull, []string{"a", "bb"}},
+		{"DropOldest bytes", QueueOptions{MaxBytes: 5, Policy: DropOldest}, nil, []string{"bb", "ccc"}},
+		{"RejectNew bytes", QueueOptions{MaxBytes: 5, Policy: RejectNew}, ErrQueueFull, []string{"a", "bb"}},
+		{"too large", QueueOptions{MaxBytes: 2, Policy: DropOldest}, ErrQueueFull, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := mustOpenQueue(t, filepath.Join(t.TempDir(), "B.fmtpq"), test.opts)
+			q.push(entry(time.Now(), "a"))
+			q.push(entry(time.Now(), "bb"))
+			if err := q.push(entry(time.Now(), "ccc")); err != test.err {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+			expectEntries(t, q, test.want...)
+
+			// The file agrees
+			q.close()
+			expectEntries(t, mustOpenQueue(t, q.path, test.opts), test.want...)
+		})
+	}
+}
+
+func TestQueueMaxAge(t *testing.T) {
+	fc := clock.NewFake(time.Now())
+	q := mustOpenQueue(t, "", QueueOptions{MaxAge: time.Minute})
+	q.push(entry(fc.Now(), "old"))
+	fc.Advance(30 * time.Second)
+	q.push(entry(fc.Now(), "new"))
+
+	// The old one expires first
+	fc.Advance(45 * time.Second)
+	if e, ok := q.peek(fc.Now()); !ok || string(e.body) != "new" {
+		t.Errorf("expected the new entry, got %q", e.body)
+	}
+	expectEntries(t, q, "new")
+
+	// Then the new one
+	fc.Advance(time.Minute)
+	if _, ok := q.peek(fc.Now()); ok {
+		t.Error("expected every entry to have expired")
+	}
+	expectEntries(t, q)
+}
+
+// TestQueuePopAfterDrop checks that an entry dropped while being sent doesn't make the next one be removed instead
+func TestQueuePopAfterDrop(t *testing.T) {
+	q := mustOpenQueue(t, "", QueueOptions{MaxMessages: 2, Policy: DropOldest})
+	q.push(entry(time.Now(), "a"))
+	q.push(entry(time.Now(), "b"))
+	sent, _ := q.peek(time.Now())
+	q.push(entry(time.Now(), "c"))
+	if err := q.pop(sent.seq); err != nil {
+		t.Fatal(err)
+	}
+	expectEntries(t, q, "b", "c")
+}
+
+func TestEnqueue(t *testing.T) {
+	dir := t.TempDir()
+	c := newFakeClient(t, "A", clock.NewFake(time.Now()), SetQueue(QueueOptions{Dir: dir}))
+	b := newFakeClient(t, "B", clock.NewFake(time.Now()))
+	rec := make(chan string, 3)
+	h := HandlerFunc(func(_ *Conn, msg *Message) {
+		p, _ := msg.Payload()
+		rec <- string(p)
+	})
+	enqueue := func(text string) {
+		t.Helper()
+		msg, _ := NewOperatorMessageString(text)
+		if err := c.Enqueue("B", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-rec:
+			if got != want {
+				t.Fatalf("expected %q, got %q", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %q, got nothing", want)
+		}
+	}
+
+	// Queued while not associated, sent once associated
+	enqueue("one")
+	enqueue("two")
+	ca, _, err := connectPipe(t, c, b, h, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.Associate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expect("one")
+	expect("two")
+
+	// Sent immediately while associated
+	enqueue("three")
+	expect("three")
+	for deadline := time.Now().Add(5 * time.Second); c.QueueLen("B") != 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected an empty queue, got %d messages", c.QueueLen("B"))
+		}
+	}
+
+	// Once closed, nothing can be queued anymore
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	msg, _ := NewOperatorMessageString("too late")
+	if err := c.Enqueue("B", msg); err != ErrClientClosed {
+		t.Errorf("expected %v, got %v", ErrClientClosed, err)
+	}
+}
@@ -0,0 +1,130 @@
+package fmtp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrUnknownRemote is returned when addressing a remote party with which there is no connection
+var ErrUnknownRemote = errors.New("no connection with this remote party")
+
+// ConnStatus is a snapshot of the status of a connection
+type ConnStatus struct {
+	// RemoteID is the ID of the remote party
+	RemoteID ID
+
+	// RemoteAddr is the address of the remote party, nil if unknown
+	RemoteAddr net.Addr
+
+	// Inbound is true if the connection has been accepted, false if it has been dialled
+	Inbound bool
+
+	// State is the state of the connection
+	State State
+
+	// Since is when the connection entered its current state
+	Since time.Time
+}
+
+// Status returns a snapshot of the status of the connection
+func (conn *Conn) Status() ConnStatus {
+	conn.stateMu.RLock()
+	state, since := conn.state, conn.stateSince
+	conn.stateMu.RUnlock()
+
+	return ConnStatus{
+		RemoteID:   conn.remote,
+		RemoteAddr: conn.RemoteAddr(),
+		Inbound:    conn.inbound,
+		State:      state,
+		Since:      since,
+	}
+}
+
+// Conn returns the established connection with the given remote party, dialled or accepted, if any
+func (c *Client) Conn(id ID) (*Conn, bool) {
+	c.currentConnsMu.RLock()
+	defer c.currentConnsMu.RUnlock()
+	conn, ok := c.currentConns[id]
+	return conn, ok
+}
+
+// Conns returns the status of every established connection, sorted by remote ID
+func (c *Client) Conns() []ConnStatus {
+	c.currentConnsMu.RLock()
+	conns := make([]*Conn, 0, len(c.currentConns))
+	for _, conn := range c.currentConns {
+		conns = append(conns, conn)
+	}
+	c.currentConnsMu.RUnlock()
+
+	statuses := make([]ConnStatus, len(conns))
+	for i, conn := range conns {
+		statuses[i] = conn.Status()
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].RemoteID < statuses[j].RemoteID
+	})
+	return statuses
+}
+
+// SendTo sends a message to the given remote party, over its established connection, associating it if needed
+// If there is no connection with the remote party, ErrUnknownRemote is returned.
+func (c *Client) SendTo(ctx context.Context, id ID, msg *Message, opts ...SendOption) error {
+	conn, ok := c.Conn(id)
+	if !ok {
+		return errors.Wrapf(ErrUnknownRemote, "SendTo %s", id)
+	}
+	return conn.Send(ctx, msg, opts...)
+}
+
+// Broadcast sends a message to every remote party whose connection status satisfies the filter, concurrently.
+// If filter is nil, the message is sent to every remote party with an established connection, associating them if needed.
+// The message's body is read once, and a copy is sent to each remote party with the given options.
+//
+// It returns the result of the sending for each remote party the message was sent to.
+func (c *Client) Broadcast(ctx context.Context, msg *Message, filter func(ConnStatus) bool, opts ...SendOption) (map[ID]error, error) {
+	// Read the body once
+	b, err := msg.Payload()
+	if err != nil {
+		return nil, errors.Wrap(err, "Broadcast: error while reading the message body")
+	}
+
+	// Select the recipients, and create their copies before sending any
+	copies := make(map[ID]*Message)
+	for _, status := range c.Conns() {
+		if filter != nil && !filter(status) {
+			continue
+		}
+		cpy, err := NewMessage(msg.Typ(), bytes.NewReader(b))
+		if err != nil {
+			return nil, errors.Wrap(err, "Broadcast: error while copying the message")
+		}
+		copies[status.RemoteID] = cpy
+	}
+
+	// Send to each of them
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results = make(map[ID]error, len(copies))
+	)
+	for id, cpy := range copies {
+		wg.Add(1)
+		go func(id ID, cpy *Message) {
+			defer wg.Done()
+			err := c.SendTo(ctx, id, cpy, opts...)
+			mu.Lock()
+			results[id] = err
+			mu.Unlock()
+		}(id, cpy)
+	}
+	wg.Wait()
+	return results, nil
+}
@@ -0,0 +1,123 @@
+package fmtp_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aabizri/fmtp"
+	"github.com/aabizri/fmtp/fmtptest"
+	"github.com/pkg/errors"
+)
+
+// star connects A and C to B's server, returning the pair and C's connection and recorder
+func star(t *testing.T) (*fmtptest.Pair, *fmtp.Conn, *fmtptest.Recorder) {
+	p := fmtptest.NewPair(t, fmtptest.PairOptions{})
+
+	c, err := fmtp.NewClient("C", fmtp.SetLogger(fmtp.NewNopLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), fmtptest.Timeout)
+	defer cancel()
+	link, err := p.Listener.Dial(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &fmtptest.Recorder{}
+	conn := c.NewConn(rec)
+	conn.SetUnderlying(link)
+	if err := conn.Init(ctx, "", "B"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	// Wait for it to be registered on B's side
+	for {
+		if _, ok := p.B.Conn("C"); ok {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("connection not registered on the server")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	return p, conn, rec
+}
+
+func TestConns(t *testing.T) {
+	p, _, _ := star(t)
+
+	got := p.B.Conns()
+	if len(got) != 2 || got[0].RemoteID != "A" || got[1].RemoteID != "C" {
+		t.Fatalf("expected the connections with A and C, got %v", got)
+	}
+	for _, st := range got {
+		if !st.Inbound || st.State != fmtp.Ready {
+			t.Errorf("expected %s to be inbound and %s, got %v", st.RemoteID, fmtp.Ready, st)
+		}
+	}
+
+	got = p.A.Conns()
+	if len(got) != 1 || got[0].RemoteID != "B" || got[0].Inbound {
+		t.Errorf("expected the outbound connection with B, got %v", got)
+	}
+}
+
+func TestSendTo(t *testing.T) {
+	p, _, recC := star(t)
+	ctx, cancel := context.WithTimeout(context.Background(), fmtptest.Timeout)
+	defer cancel()
+
+	msg, _ := fmtp.NewOperatorMessageString("to C")
+	if err := p.B.SendTo(ctx, "C", msg); err != nil {
+		t.Fatal(err)
+	}
+	recC.ExpectBodies(t, "to C")
+	p.RecA.ExpectNone(t, 20*time.Millisecond)
+
+	msg, _ = fmtp.NewOperatorMessageString("to D")
+	if err := p.B.SendTo(ctx, "D", msg); errors.Cause(err) != fmtp.ErrUnknownRemote {
+		t.Errorf("expected %v, got %v", fmtp.ErrUnknownRemote, err)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	p, _, recC := star(t)
+	ctx, cancel := context.WithTimeout(context.Background(), fmtptest.Timeout)
+	defer cancel()
+
+	// To everyone
+	msg, _ := fmtp.NewOperatorMessageString("to all")
+	results, err := p.B.Broadcast(ctx, msg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results["A"] != nil || results["C"] != nil {
+		t.Errorf("expected a success for A and C, got %v", results)
+	}
+	p.RecA.ExpectBodies(t, "to all")
+	recC.ExpectBodies(t, "to all")
+
+	// To those satisfying the filter
+	msg, _ = fmtp.NewOperatorMessageString("to C")
+	results, err = p.B.Broadcast(ctx, msg, func(st fmtp.ConnStatus) bool { return st.RemoteID == "C" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := results["A"]; ok || len(results) != 1 {
+		t.Errorf("expected to send to C only, got %v", results)
+	}
+	recC.ExpectBodies(t, "to all", "to C")
+
+	// The options are applied to every copy
+	msg, _ = fmtp.NewOperatorMessageString("unknown priority")
+	results, err = p.B.Broadcast(ctx, msg, nil, fmtp.WithPriority(fmtp.Priority(9)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results["A"] == nil || results["C"] == nil {
+		t.Errorf("expected the priority to be rejected for A and C, got %v", results)
+	}
+}
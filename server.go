@@ -2,9 +2,12 @@ package fmtp
 
 import (
 	"context"
-	"log"
+	"crypto/tls"
 	"net"
+	"sync"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 // ListeningPort is the port a server should listen to.
@@ -14,7 +17,13 @@ const ListeningPort = "8500"
 // ExpectedPrefix is the prefix of FMTP systems from which FMTP systems IPv6 addresses are derived
 const ExpectedPrefix = "2001:4b50::/32"
 
+// ErrServerClosed is returned by the Server's Serve and ListenAndServe methods after a call to Shutdown or Close.
+var ErrServerClosed = errors.New("server closed")
+
 // A Handler receives and processes an FMTP message.
+//
+// The message's Body is lent to the handler, and closed once ServeFMTP returns so that its buffer can be reused.
+// A handler keeping the content for later must copy it.
 type Handler interface {
 	ServeFMTP(conn *Conn, msg *Message)
 }
@@ -41,16 +50,30 @@ type Server struct {
 	Ts time.Duration
 	Tr time.Duration
 
-	// AcceptTCP is called when a new TCP connection is inbound
+	// TLSConfig optionally provides a TLS configuration for use by ListenAndServe.
+	// For mutual TLS, set ClientAuth to tls.RequireAndVerifyClientCert and ClientCAs accordingly.
+	TLSConfig *tls.Config
+
+	// AcceptTCP is called when a new connection is inbound, with its remote address
 	// If AcceptTCP is nil, every incoming connections are accepted
 	AcceptTCP func(remoteAddr net.Addr) bool
 
 	// NotifyConn is called when a connection was successfuly established
 	NotifyConn func(remoteAddr net.Addr, remoteID ID)
 
-	// Done
+	// mu guards the fields below
+	mu sync.Mutex
+
+	// Done is closed when the server is shutting down
 	done chan struct{}
 
+	// listeners and conns track the active listeners and connections
+	listeners map[net.Listener]struct{}
+	conns     map[*Conn]struct{}
+
+	// idle is closed once no connection is tracked anymore, see idleChan
+	idle chan struct{}
+
 	// Client
 	c *Client
 }
@@ -62,16 +85,15 @@ func (c *Client) NewServer(addr string, h Handler) *Server {
 
 // ListenAndServe listens to an IP Address, and handles functions
 func (srv *Server) ListenAndServe() error {
-	// Resolve the address
-	laddr, err := net.ResolveTCPAddr("tcp", srv.Addr)
+	// First, bind to the given address
+	l, err := net.Listen("tcp", srv.Addr)
 	if err != nil {
 		return err
 	}
 
-	// First, bind to the given address
-	l, err := net.ListenTCP("tcp", laddr)
-	if err != nil {
-		return err
+	// If we have a TLS configuration, serve over TLS
+	if srv.TLSConfig != nil {
+		l = tls.NewListener(l, srv.TLSConfig)
 	}
 
 	// Now launch serve on it
@@ -79,23 +101,62 @@ func (srv *Server) ListenAndServe() error {
 	return srv.Serve(l)
 }
 
+// ListenAndServeTLS acts identically to ListenAndServe, except that it serves over TLS
+// using the given certificate and key files, in addition to the server's TLSConfig if set.
+func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	// Load the certificate
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	// Set it in a copy of the configuration
+	cfg := &tls.Config{}
+	if srv.TLSConfig != nil {
+		cfg = srv.TLSConfig.Clone()
+	}
+	cfg.Certificates = append(cfg.Certificates, cert)
+
+	// Bind to the given address
+	l, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+
+	// Now launch serve on it
+	tl := tls.NewListener(l, cfg)
+	defer tl.Close()
+	return srv.Serve(tl)
+}
+
 // logf logs server errors
 func (srv *Server) logf(format string, params ...interface{}) {
-	log.Printf(format, params...)
+	srv.c.logger.Errorf(format, params...)
 }
 
 // Serve serves incoming connections on a net.Listener
-func (srv *Server) Serve(l *net.TCPListener) error {
+//
+// The protocol requires TCP, but any net.Listener may be used, such as a Unix socket listener, a TLS listener
+// or an in-memory one for testing.
+//
+// Serve always returns a non-nil error. After Shutdown or Close, the returned error is ErrServerClosed.
+func (srv *Server) Serve(l net.Listener) error {
+	// Track the listener, refusing it if we are already shutting down
+	if !srv.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer srv.trackListener(l, false)
+
 	var tempDelay time.Duration
 	for {
 		// We accept the next connection
-		rw, e := l.AcceptTCP() //rw, e
+		rw, e := l.Accept()
 
 		// Check for errors
 		if e != nil {
 			select {
-			case <-srv.done:
-				return nil
+			case <-srv.getDoneChan():
+				return ErrServerClosed
 			default:
 			}
 			if ne, ok := e.(net.Error); ok && ne.Temporary() {
@@ -107,7 +168,7 @@ func (srv *Server) Serve(l *net.TCPListener) error {
 				if max := 1 * time.Second; tempDelay > max {
 					tempDelay = max
 				}
-				srv.c.logger.Error("Accept error: %v; retrying in %v", e, tempDelay)
+				srv.c.logger.Errorf("Accept error: %v; retrying in %v", e, tempDelay)
 				time.Sleep(tempDelay)
 				continue
 			}
@@ -120,48 +181,243 @@ func (srv *Server) Serve(l *net.TCPListener) error {
 		if srv.AcceptTCP != nil {
 			ok := srv.AcceptTCP(rw.RemoteAddr())
 			if !ok {
-				// TODO: Do something if there's an error
 				err := rw.Close()
-				_ = err
+				if err != nil {
+					srv.logf("error while closing refused connection: %v", err)
+				}
+				continue
 			}
 		}
 
-		// We have a new TCP conn, so we register it
-		go srv.registerTCPConn(rw)
+		// We have a new conn, so we register it
+		go srv.registerConn(rw)
 	}
 }
 
-// registerTCPConn registers a new TCP connection, accepting the connection
-func (srv *Server) registerTCPConn(tcp *net.TCPConn) {
+// registerConn registers a new incoming connection, accepting the connection
+func (srv *Server) registerConn(rw net.Conn) {
 	// Create a new connection
 	conn := srv.c.NewConn(srv.Handler)
 
 	// Set the current transport as the underlying one
-	conn.SetUnderlying(tcp)
+	conn.SetUnderlying(rw)
+
+	// Track it until it is done
+	if !srv.trackConn(conn, true) {
+		rw.Close()
+		return
+	}
+	defer srv.trackConn(conn, false)
 
 	// Launch process of incoming connection
 	err := conn.recv(context.Background())
 	if err != nil {
-		tcp.Write([]byte("ERROR: ILLEGAL\n"))
-		tcp.Close()
+		rw.Write([]byte("ERROR: ILLEGAL\n"))
+		rw.Close()
+		return
 	}
 
 	// Notify that a connection has been made
 	if srv.NotifyConn != nil {
 		go srv.NotifyConn(conn.RemoteAddr(), conn.RemoteID())
 	}
+
+	// Wait for the connection to end
+	<-conn.closed
+}
+
+// getDoneChan returns the channel closed when the server is shutting down
+func (srv *Server) getDoneChan() chan struct{} {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.getDoneChanLocked()
+}
+
+func (srv *Server) getDoneChanLocked() chan struct{} {
+	if srv.done == nil {
+		srv.done = make(chan struct{})
+	}
+	return srv.done
+}
+
+// closeDoneChanLocked closes the done channel, if not already done
+func (srv *Server) closeDoneChanLocked() {
+	ch := srv.getDoneChanLocked()
+	select {
+	case <-ch:
+	default:
+		close(ch)
+	}
+}
+
+// shuttingDownLocked reports whether the server is shutting down
+func (srv *Server) shuttingDownLocked() bool {
+	select {
+	case <-srv.getDoneChanLocked():
+		return true
+	default:
+		return false
+	}
+}
+
+// trackListener adds or removes a listener to the set of tracked listeners
+// It reports false if the listener can't be added as the server is shutting down
+func (srv *Server) trackListener(l net.Listener, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.listeners == nil {
+		srv.listeners = make(map[net.Listener]struct{})
+	}
+	if add {
+		if srv.shuttingDownLocked() {
+			return false
+		}
+		srv.listeners[l] = struct{}{}
+	} else {
+		delete(srv.listeners, l)
+	}
+	return true
+}
+
+// trackConn adds or removes a connection to the set of tracked connections
+// It reports false if the connection can't be added as the server is shutting down
+func (srv *Server) trackConn(conn *Conn, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.conns == nil {
+		srv.conns = make(map[*Conn]struct{})
+	}
+	if add {
+		if srv.shuttingDownLocked() {
+			return false
+		}
+		srv.conns[conn] = struct{}{}
+	} else {
+		delete(srv.conns, conn)
+		if len(srv.conns) == 0 && srv.idle != nil {
+			close(srv.idle)
+			srv.idle = nil
+		}
+	}
+	return true
+}
+
+// idleChan returns a channel closed once no connection is tracked anymore
+func (srv *Server) idleChan() <-chan struct{} {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.conns) == 0 {
+		ch := make(chan struct{})
+		close(ch)
+		return ch
+	}
+	if srv.idle == nil {
+		srv.idle = make(chan struct{})
+	}
+	return srv.idle
+}
+
+// closeListenersLocked closes all the tracked listeners, returning the first error encountered
+func (srv *Server) closeListenersLocked() error {
+	var err error
+	for l := range srv.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// trackedConns returns a snapshot of the tracked connections
+func (srv *Server) trackedConns() []*Conn {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	conns := make([]*Conn, 0, len(srv.conns))
+	for conn := range srv.conns {
+		conns = append(conns, conn)
+	}
+	return conns
 }
 
 // Shutdown stops the server gracefully
+//
+// It first closes all listeners, stopping new connections from forming.
+// Then every connection is released concurrently: once the traffic queued over an association has been sent, a SHUTDOWN is sent and the connection disconnected.
+// Finally it waits for every connection to be done. If the context expires first, the connections still open are closed and the context's error is returned.
 func (srv *Server) Shutdown(ctx context.Context) error {
 	// Closes all open listeners (stopping new connections from forming)
-	// Send the Shutdown to all idle Connections
-	// Waits for every Connection, idle or associated, to close which can be forever
-	return nil
+	srv.mu.Lock()
+	srv.closeDoneChanLocked()
+	lerr := srv.closeListenersLocked()
+	srv.mu.Unlock()
+
+	// Release every connection concurrently, so that a slow remote party doesn't delay the others
+	var wg sync.WaitGroup
+	for _, conn := range srv.trackedConns() {
+		wg.Add(1)
+		go func(conn *Conn) {
+			defer wg.Done()
+			srv.shutdownConn(ctx, conn)
+		}(conn)
+	}
+	wg.Wait()
+
+	// Waits for every connection to be done, closing those still open if the context expires
+	select {
+	case <-srv.idleChan():
+	case <-ctx.Done():
+		for _, conn := range srv.trackedConns() {
+			conn.Close()
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return lerr
 }
 
-// Close stops the server
+// shutdownConn releases a connection gracefully, closing it if the context expires before it is done
+func (srv *Server) shutdownConn(ctx context.Context, conn *Conn) {
+	switch conn.State() {
+	case DataReady:
+		// Let the queued traffic go out before the SHUTDOWN
+		err := conn.drain(ctx)
+		if err == nil {
+			err = conn.Deassociate(ctx)
+		}
+		if err != nil {
+			srv.logf("error while deassociating from %s: %v", conn.RemoteID(), err)
+		}
+		fallthrough
+	case Ready, AssPending:
+		err := conn.Disconnect(ctx)
+		if err != nil {
+			srv.logf("error while disconnecting from %s: %v", conn.RemoteID(), err)
+		}
+	default:
+		// The identification is ongoing, there is nothing to wait for
+		conn.Close()
+		return
+	}
+
+	select {
+	case <-conn.closed:
+	case <-ctx.Done():
+		conn.Close()
+	}
+}
+
+// Close stops the server immediately
+//
+// It closes all listeners and all connections, associated or not, without sending anything to the remote parties.
 func (srv *Server) Close() error {
-	// Closes all active listeners and all connections, associated or not
-	return nil
+	srv.mu.Lock()
+	srv.closeDoneChanLocked()
+	err := srv.closeListenersLocked()
+	srv.mu.Unlock()
+
+	for _, conn := range srv.trackedConns() {
+		conn.Close()
+	}
+	return err
 }
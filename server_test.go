@@ -0,0 +1,133 @@
+package fmtp_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aabizri/fmtp"
+	"github.com/aabizri/fmtp/fmtptest"
+)
+
+// notified returns a function closing the returned channel, for ShutdownNotify
+func notified() (func(), <-chan struct{}) {
+	ch := make(chan struct{})
+	var once sync.Once
+	return func() { once.Do(func() { close(ch) }) }, ch
+}
+
+// TestShutdownDrains checks that the traffic queued when Shutdown is called is sent before the SHUTDOWN
+func TestShutdownDrains(t *testing.T) {
+	p := fmtptest.NewPair(t, fmtptest.PairOptions{})
+	notify, shutdown := notified()
+	p.ConnA.ShutdownNotify = notify
+	p.Associate(t)
+	expectState(t, p.ConnB, fmtp.DataReady)
+
+	// Queue messages on the server's side, behind a slow link
+	p.Link.Peer().SetDelay(10 * time.Millisecond)
+	const n = 10
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			msg, _ := fmtp.NewOperatorMessageString(fmt.Sprint(i))
+			errs <- p.ConnB.Send(context.Background(), msg)
+		}(i)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), fmtptest.Timeout)
+	defer cancel()
+	if _, err := p.RecA.Wait(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	expectErr(t, p.Server.Shutdown(ctx), nil)
+	for i := 0; i < n; i++ {
+		expectErr(t, <-errs, nil)
+	}
+	if _, err := p.RecA.Wait(ctx, n); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-shutdown:
+	default:
+		t.Error("SHUTDOWN not received")
+	}
+	expectState(t, p.ConnA, fmtp.Idle)
+}
+
+// TestShutdownSlowPeer checks that a peer not reading doesn't delay the release of the others, and is closed once the context expires
+func TestShutdownSlowPeer(t *testing.T) {
+	p := fmtptest.NewPair(t, fmtptest.PairOptions{})
+	notify, shutdown := notified()
+	p.ConnA.ShutdownNotify = notify
+	p.Associate(t)
+
+	// Connect a peer whose handler never returns, so that it stops reading
+	block := make(chan struct{})
+	t.Cleanup(func() { close(block) })
+	handled := make(chan struct{}, 1)
+	slow, err := fmtp.NewClient("C", fmtp.SetLogger(fmtp.NewNopLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), fmtptest.Timeout)
+	defer cancel()
+	link, err := p.Listener.Dial(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connC := slow.NewConn(fmtp.HandlerFunc(func(*fmtp.Conn, *fmtp.Message) {
+		handled <- struct{}{}
+		<-block
+	}))
+	connC.SetUnderlying(link)
+	expectErr(t, connC.Init(ctx, "", "B"), nil)
+	expectErr(t, connC.Associate(ctx), nil)
+	connB, ok := p.B.Conn("C")
+	if !ok {
+		t.Fatal("connection not registered on the server")
+	}
+	expectState(t, connB, fmtp.DataReady)
+
+	// Fill the link to the slow peer
+	for i := 0; i < 10; i++ {
+		go func() {
+			msg, _ := fmtp.NewOperatorMessageString("stuck")
+			connB.Send(context.Background(), msg)
+		}()
+	}
+	<-handled
+
+	sctx, scancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer scancel()
+	expectErr(t, p.Server.Shutdown(sctx), context.DeadlineExceeded)
+
+	// The fast peer has been released gracefully, the slow one closed
+	select {
+	case <-shutdown:
+	default:
+		t.Error("SHUTDOWN not received by the fast peer")
+	}
+	expectState(t, p.ConnA, fmtp.Idle)
+	expectState(t, connB, fmtp.Idle)
+}
+
+func TestServerClose(t *testing.T) {
+	p := fmtptest.NewPair(t, fmtptest.PairOptions{})
+	notify, shutdown := notified()
+	p.ConnA.ShutdownNotify = notify
+	p.Associate(t)
+
+	expectErr(t, p.Server.Close(), nil)
+	expectState(t, p.ConnA, fmtp.Idle)
+	select {
+	case <-shutdown:
+		t.Error("SHUTDOWN received on Close")
+	default:
+	}
+
+	// The server doesn't serve anymore
+	expectErr(t, p.Server.Serve(fmtptest.NewListener()), fmtp.ErrServerClosed)
+}
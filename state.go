@@ -0,0 +1,246 @@
+package fmtp
+
+import (
+	"github.com/pkg/errors"
+)
+
+// State is the state of an FMTP connection, as described in section 5.3 of the FMTP v2.0 specification.
+//
+// The specification distinguishes SYSTEM_ID_PENDING (responder awaiting the remote identification) from
+// ID_PENDING (awaiting a response to the transmitted identification), both are represented here by IDPending.
+type State uint8
+
+// The following constants define the states an FMTP connection can be in
+const (
+	// Idle means no protocol instance exists
+	Idle State = iota
+
+	// ConnPending means the TCP connection is being established, it is applicable to the initiator only
+	ConnPending
+
+	// IDPending means the TCP connection is established, and the identification exchange is ongoing
+	IDPending
+
+	// Ready means the identification has been completed, an association can now be established
+	Ready
+
+	// AssPending means a STARTUP has been sent, and the remote STARTUP is awaited
+	AssPending
+
+	// DataReady means the association is established, messages can be exchanged
+	DataReady
+)
+
+func (s State) String() string {
+	switch s {
+	case Idle:
+		return "IDLE"
+	case ConnPending:
+		return "CONNECTION_PENDING"
+	case IDPending:
+		return "ID_PENDING"
+	case Ready:
+		return "READY"
+	case AssPending:
+		return "ASSOCIATION_PENDING"
+	case DataReady:
+		return "DATA_READY"
+	default:
+		return "Unknown State"
+	}
+}
+
+// ErrIllegalEvent is returned when an event is not allowed in the current state of a connection
+var ErrIllegalEvent = errors.New("illegal event for the current connection state")
+
+// an event is what makes a connection change state
+type event uint8
+
+const (
+	// connectEvt is the local request to establish a connection (MT-CON rq)
+	connectEvt event = iota
+
+	// acceptEvt is an incoming TCP connection being accepted by a responder
+	acceptEvt
+
+	// tcpUpEvt is the TCP connection being established by the initiator
+	tcpUpEvt
+
+	// idAcceptEvt is the identification exchange succeeding
+	idAcceptEvt
+
+	// startupSentEvt is a STARTUP being sent by the local party (MT-ASSOC rq)
+	startupSentEvt
+
+	// startupRecvEvt is a STARTUP being received from the remote party (R_startup)
+	startupRecvEvt
+
+	// assFailedEvt is a pending association failing before the remote STARTUP has been received
+	assFailedEvt
+
+	// shutdownSentEvt is a SHUTDOWN being sent by the local party (MT-STOP rq)
+	shutdownSentEvt
+
+	// shutdownRecvEvt is a SHUTDOWN being received from the remote party (R_shutdown)
+	shutdownRecvEvt
+
+	// trTimeoutEvt is the tr timer expiring, as nothing has been received over the association (Tr_timeout)
+	trTimeoutEvt
+
+	// heartbeatRecvEvt is a HEARTBEAT being received from the remote party (R_heartbeat)
+	heartbeatRecvEvt
+
+	// dataSentEvt is an Operator or Operational message being sent (MT-DATA rq)
+	dataSentEvt
+
+	// dataRecvEvt is an Operator or Operational message being received (R_data)
+	dataRecvEvt
+
+	// disconnectEvt is the connection being released, for whatever reason
+	disconnectEvt
+)
+
+func (ev event) String() string {
+	switch ev {
+	case connectEvt:
+		return "connect"
+	case acceptEvt:
+		return "accept"
+	case tcpUpEvt:
+		return "tcp established"
+	case idAcceptEvt:
+		return "identification accepted"
+	case startupSentEvt:
+		return "STARTUP sent"
+	case startupRecvEvt:
+		return "STARTUP received"
+	case assFailedEvt:
+		return "association failed"
+	case shutdownSentEvt:
+		return "SHUTDOWN sent"
+	case shutdownRecvEvt:
+		return "SHUTDOWN received"
+	case trTimeoutEvt:
+		return "tr timeout"
+	case heartbeatRecvEvt:
+		return "HEARTBEAT received"
+	case dataSentEvt:
+		return "data sent"
+	case dataRecvEvt:
+		return "data received"
+	case disconnectEvt:
+		return "disconnect"
+	default:
+		return "unknown event"
+	}
+}
+
+// transitions lists the legal transitions for each state
+// disconnectEvt is legal in every state and always leads to Idle, so it isn't listed here
+var transitions = map[State]map[event]State{
+	Idle: {
+		connectEvt: ConnPending,
+		acceptEvt:  IDPending,
+	},
+	ConnPending: {
+		tcpUpEvt: IDPending,
+	},
+	IDPending: {
+		idAcceptEvt: Ready,
+	},
+	Ready: {
+		startupSentEvt:   AssPending,
+		startupRecvEvt:   DataReady,
+		heartbeatRecvEvt: Ready,
+		shutdownRecvEvt:  Ready,
+	},
+	AssPending: {
+		startupRecvEvt:  DataReady,
+		assFailedEvt:    Ready,
+		shutdownSentEvt: Ready,
+		shutdownRecvEvt: Ready,
+		trTimeoutEvt:    Ready,
+	},
+	DataReady: {
+		startupRecvEvt:   DataReady,
+		heartbeatRecvEvt: DataReady,
+		dataSentEvt:      DataReady,
+		dataRecvEvt:      DataReady,
+		shutdownSentEvt:  Ready,
+		shutdownRecvEvt:  Ready,
+		trTimeoutEvt:     Ready,
+	},
+}
+
+// next returns the state reached from s when ev happens
+func (s State) next(ev event) (State, error) {
+	if ev == disconnectEvt {
+		return Idle, nil
+	}
+	to, ok := transitions[s][ev]
+	if !ok {
+		return s, errors.Wrapf(ErrIllegalEvent, "%s in state %s", ev, s)
+	}
+	return to, nil
+}
+
+// State returns the current state of the connection
+func (conn *Conn) State() State {
+	conn.stateMu.RLock()
+	defer conn.stateMu.RUnlock()
+	return conn.state
+}
+
+// stateChanged returns the current state along with a channel which is closed on the next state change
+func (conn *Conn) stateChanged() (State, <-chan struct{}) {
+	conn.stateMu.Lock()
+	defer conn.stateMu.Unlock()
+	if conn.stateCh == nil {
+		conn.stateCh = make(chan struct{})
+	}
+	return conn.state, conn.stateCh
+}
+
+// transition makes the connection change state following the given event
+// If the event is illegal in the current state, the state is left untouched and an error is returned
+func (conn *Conn) transition(ev event) error {
+	return conn.transitionCause(ev, nil)
+}
+
+// transitionCause is transition, along with the cause of the event, which is reported in the lifecycle events
+func (conn *Conn) transitionCause(ev event, cause error) error {
+	conn.stateMu.Lock()
+	from := conn.state
+	to, err := from.next(ev)
+	if err != nil {
+		conn.stateMu.Unlock()
+		return err
+	}
+	conn.state = to
+	if from != to {
+		conn.stateSince = conn.client.clock.Now()
+	}
+	if from != to && conn.stateCh != nil {
+		close(conn.stateCh)
+		conn.stateCh = nil
+	}
+	conn.stateMu.Unlock()
+
+	if from != to {
+		conn.log().With(Fields{FieldState: to.String()}).Debugf("state changed from %s on %s", from, ev)
+
+		// Record the associations established & lost
+		if to == DataReady || from == DataReady {
+			conn.client.metrics.AssociationChanged(conn.remote, to == DataReady)
+		}
+
+		// Emit the lifecycle events
+		conn.emitTransition(from, to, ev, cause)
+	}
+
+	// Notify the user
+	if from != to && conn.StateNotify != nil {
+		conn.StateNotify(from, to)
+	}
+	return nil
+}
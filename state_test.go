@@ -0,0 +1,133 @@
+package fmtp
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// waitState waits for a connection to reach a state
+func waitState(t *testing.T, conn *Conn, want State) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		st, changed := conn.stateChanged()
+		if st == want {
+			return
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			t.Fatalf("expected state %s, still %s", want, st)
+		}
+	}
+}
+
+func TestLegalTransitions(t *testing.T) {
+	tests := []struct {
+		from State
+		ev   event
+		to   State
+	}{
+		{Idle, connectEvt, ConnPending},
+		{Idle, acceptEvt, IDPending},
+		{ConnPending, tcpUpEvt, IDPending},
+		{IDPending, idAcceptEvt, Ready},
+		{Ready, startupSentEvt, AssPending},
+		{Ready, startupRecvEvt, DataReady},
+		{AssPending, startupRecvEvt, DataReady},
+		{AssPending, assFailedEvt, Ready},
+		{DataReady, dataRecvEvt, DataReady},
+		{DataReady, heartbeatRecvEvt, DataReady},
+		{DataReady, shutdownRecvEvt, Ready},
+		{DataReady, trTimeoutEvt, Ready},
+		{DataReady, disconnectEvt, Idle},
+		{IDPending, disconnectEvt, Idle},
+	}
+	for _, test := range tests {
+		to, err := test.from.next(test.ev)
+		if err != nil || to != test.to {
+			t.Errorf("%s on %s: expected %s, got %s (%v)", test.from, test.ev, test.to, to, err)
+		}
+	}
+}
+
+func TestIllegalTransitions(t *testing.T) {
+	tests := []struct {
+		from State
+		ev   event
+	}{
+		// Data before the association is established
+		{Ready, dataRecvEvt},
+		{Ready, dataSentEvt},
+		{AssPending, dataRecvEvt},
+		{IDPending, dataRecvEvt},
+
+		// Association events before the identification is complete
+		{Idle, startupRecvEvt},
+		{ConnPending, startupRecvEvt},
+		{IDPending, startupRecvEvt},
+		{IDPending, heartbeatRecvEvt},
+
+		// Out of order connection events
+		{Idle, idAcceptEvt},
+		{ConnPending, idAcceptEvt},
+		{Ready, connectEvt},
+		{DataReady, acceptEvt},
+
+		// tr is only armed while associated or associating
+		{Ready, trTimeoutEvt},
+		{Ready, shutdownSentEvt},
+	}
+	for _, test := range tests {
+		to, err := test.from.next(test.ev)
+		if errors.Cause(err) != ErrIllegalEvent {
+			t.Errorf("%s on %s: expected %v, got %v", test.from, test.ev, ErrIllegalEvent, err)
+		}
+		if to != test.from {
+			t.Errorf("%s on %s: state changed to %s", test.from, test.ev, to)
+		}
+	}
+}
+
+// TestTransitionsComplete checks that every event not listed in the transitions map is illegal
+func TestTransitionsComplete(t *testing.T) {
+	for s := Idle; s <= DataReady; s++ {
+		for ev := connectEvt; ev < disconnectEvt; ev++ {
+			want, legal := transitions[s][ev]
+			to, err := s.next(ev)
+			switch {
+			case legal && (err != nil || to != want):
+				t.Errorf("%s on %s: expected %s, got %s (%v)", s, ev, want, to, err)
+			case !legal && errors.Cause(err) != ErrIllegalEvent:
+				t.Errorf("%s on %s: expected %v, got %v", s, ev, ErrIllegalEvent, err)
+			}
+		}
+	}
+}
+
+func TestDataBeforeStartup(t *testing.T) {
+	a, _ := NewClient("A", SetLogger(NewNopLogger()))
+	b, _ := NewClient("B", SetLogger(NewNopLogger()))
+	ca, cb, err := connectPipe(t, a, b, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := cb.State(); st != Ready {
+		t.Fatalf("expected state %s, got %s", Ready, st)
+	}
+
+	// Send data without associating first, bypassing the agent
+	msg, _ := NewOperatorMessageString("too early")
+	if err := ca.send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// The receiver ignores it, the connection staying up
+	if err := ca.Associate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, cb, DataReady)
+}
@@ -2,13 +2,15 @@ package fmtp
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
 
 	"github.com/pkg/errors"
 )
 
 // establishTCPConn is a helper function to establish a TCP connection
-func establishTCPConn(ctx context.Context, dialer *net.Dialer, address string) (*net.TCPConn, error) {
+// If tlsConfig isn't nil, TLS is negotiated over the TCP connection before returning.
+func establishTCPConn(ctx context.Context, dialer *net.Dialer, tlsConfig *tls.Config, address string) (net.Conn, error) {
 	// Establish TCP connection
 	conn, err := dialer.DialContext(ctx, "tcp", address)
 	if err != nil {
@@ -27,5 +29,30 @@ func establishTCPConn(ctx context.Context, dialer *net.Dialer, address string) (
 		return nil, errors.Wrap(err, "establishTCPConn: error while setting keep-alive")
 	}
 
-	return tcpConn, nil
+	// If there is no TLS to negotiate, we're done
+	if tlsConfig == nil {
+		return tcpConn, nil
+	}
+
+	// Default to the host we're dialing as the server name
+	cfg := tlsConfig
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			tcpConn.Close()
+			return nil, errors.Wrap(err, "establishTCPConn: error while extracting host from address")
+		}
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+
+	// Negotiate TLS
+	tlsConn := tls.Client(tcpConn, cfg)
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		tcpConn.Close()
+		return nil, errors.Wrap(err, "establishTCPConn: error during TLS handshake")
+	}
+
+	return tlsConn, nil
 }
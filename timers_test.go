@@ -0,0 +1,156 @@
+package fmtp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aabizri/fmtp/clock"
+)
+
+// newFakeClient creates a client whose timers follow the given fake clock
+func newFakeClient(t *testing.T, id ID, fc *clock.Fake, setters ...ClientSetter) *Client {
+	setters = append([]ClientSetter{SetClock(fc), SetLogger(NewNopLogger())}, setters...)
+	c, err := NewClient(id, setters...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// expectErr waits for an error to be notified, the real-time timeout only guards against a hang
+func expectErr(t *testing.T, errs <-chan error, want error) {
+	t.Helper()
+	select {
+	case err := <-errs:
+		if err != want {
+			t.Fatalf("expected %v, got %v", want, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected %v, got nothing", want)
+	}
+}
+
+func TestTiExpiry(t *testing.T) {
+	fc := clock.NewFake(time.Now())
+	a := newFakeClient(t, "A", fc)
+
+	// The remote party never answers
+	p1, p2 := net.Pipe()
+	defer p2.Close()
+	go io.Copy(ioutil.Discard, p2)
+
+	conn := a.NewConn(nil)
+	conn.SetUnderlying(p1)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- conn.Init(context.Background(), "", "B")
+	}()
+
+	// Once Ti is armed, nothing happens until it has fully elapsed
+	fc.BlockUntil(1)
+	fc.Advance(DefaultTi - time.Nanosecond)
+	select {
+	case err := <-errs:
+		t.Fatalf("Init returned before Ti expired: %v", err)
+	default:
+	}
+	fc.Advance(time.Nanosecond)
+	expectErr(t, errs, ErrConnectionDeadlineExceeded)
+	if st := conn.State(); st != Idle {
+		t.Errorf("expected state %s, got %s", Idle, st)
+	}
+}
+
+func TestTrExpiry(t *testing.T) {
+	// Only A follows the fake clock, with a Ts longer than Tr so that it never sends a HEARTBEAT
+	fc := clock.NewFake(time.Now())
+	a := newFakeClient(t, "A", fc, SetTimers(0, time.Hour, 0))
+	b, _ := NewClient("B", SetLogger(NewNopLogger()))
+
+	received := make(chan struct{}, 1)
+	ca, cb, err := connectPipe(t, a, b, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.SetHandler(HandlerFunc(func(*Conn, *Message) {
+		received <- struct{}{}
+	}))
+	errs := make(chan error, 1)
+	ca.ErrorNotify = func(err error) { errs <- err }
+
+	// Once associated, ts and tr are armed
+	if err := ca.Associate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	fc.BlockUntil(2)
+
+	// Receiving a message just before the expiry resets tr
+	fc.Advance(DefaultTr - time.Second)
+	msg, _ := NewOperatorMessageString("keepalive")
+	if err := cb.Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	<-received
+	fc.Advance(time.Second)
+	if st := ca.State(); st != DataReady {
+		t.Fatalf("association shut down even though a message was received: %s", st)
+	}
+
+	// Then nothing is received for Tr, the association is shut down
+	fc.Advance(DefaultTr - time.Second)
+	expectErr(t, errs, ErrAssociationTimeoutExceeded)
+	if st := ca.State(); st != Ready {
+		t.Errorf("expected state %s, got %s", Ready, st)
+	}
+}
+
+func TestTsHeartbeat(t *testing.T) {
+	// Only A follows the fake clock, with a long Tr as B doesn't send anything in fake time
+	fc := clock.NewFake(time.Now())
+	a := newFakeClient(t, "A", fc, SetTimers(0, 0, time.Hour))
+	pm := NewPrometheusMetrics()
+	b, _ := NewClient("B", SetLogger(NewNopLogger()), SetMetrics(pm))
+
+	ca, cb, err := connectPipe(t, a, b, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.Associate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	fc.BlockUntil(2)
+
+	// Every Ts a HEARTBEAT is sent, and ts re-armed
+	for i := 1; i <= 3; i++ {
+		fc.Advance(DefaultTs)
+		fc.BlockUntil(2)
+	}
+
+	// Wait for the remote party to have received them all
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		buf := &bytes.Buffer{}
+		pm.WriteTo(buf)
+		if strings.Contains(buf.String(), "\n"+metricHeartbeatsRecv+`{remote="A"} 3`+"\n") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 3 heartbeats received, got:\n%s", buf)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Both ends are still associated
+	if st := ca.State(); st != DataReady {
+		t.Errorf("expected state %s, got %s", DataReady, st)
+	}
+	if st := cb.State(); st != DataReady {
+		t.Errorf("expected state %s, got %s", DataReady, st)
+	}
+}
@@ -0,0 +1,69 @@
+package fmtp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+
+	"github.com/pkg/errors"
+)
+
+// ErrCertificateIDMismatch is returned when the certificate presented by the remote party doesn't match its FMTP ID
+var ErrCertificateIDMismatch = errors.New("remote certificate doesn't match the remote ID")
+
+// SetTLSConfig sets the TLS configuration used when dialing.
+// When set, every connection established by the client is run over TLS.
+// For mutual TLS, the client certificate should be set in cfg.Certificates.
+func SetTLSConfig(cfg *tls.Config) ClientSetter {
+	return func(c *Client) error {
+		c.tlsConfig = cfg
+		return nil
+	}
+}
+
+// SetCertificateIDCheck enables or disables the verification that the certificate presented by the remote party
+// matches the FMTP ID it presents during identification.
+// The ID matches if it is equal to either the certificate's subject common name or one of its DNS subject alternative names.
+//
+// It applies to both dialed and accepted connections, and requires the connections to run over TLS.
+// For accepted connections, the server's TLS configuration should require client certificates.
+func SetCertificateIDCheck(enabled bool) ClientSetter {
+	return func(c *Client) error {
+		c.certIDCheck = enabled
+		return nil
+	}
+}
+
+// checkCertificateID verifies that the certificate presented by the remote party matches the given ID, if enabled
+func (conn *Conn) checkCertificateID(id ID) error {
+	if !conn.client.certIDCheck {
+		return nil
+	}
+
+	// Retrieve the TLS connection state
+	type connectionStater interface {
+		ConnectionState() tls.ConnectionState
+	}
+	cs, ok := conn.tcp.(connectionStater)
+	if !ok {
+		return errors.Wrap(ErrCertificateIDMismatch, "underlying connection isn't a TLS connection")
+	}
+	state := cs.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return errors.Wrap(ErrCertificateIDMismatch, "no certificate presented by the remote party")
+	}
+
+	return certificateMatchesID(state.PeerCertificates[0], id)
+}
+
+// certificateMatchesID checks whether a certificate's subject matches the ID
+func certificateMatchesID(cert *x509.Certificate, id ID) error {
+	if cert.Subject.CommonName == string(id) {
+		return nil
+	}
+	for _, name := range cert.DNSNames {
+		if name == string(id) {
+			return nil
+		}
+	}
+	return errors.Wrapf(ErrCertificateIDMismatch, "certificate subject %q doesn't match ID %q", cert.Subject.CommonName, id)
+}
@@ -0,0 +1,170 @@
+package fmtp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// testPKI is a certificate authority generated for the tests
+type testPKI struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "FMTP test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testPKI{cert: cert, key: key, pool: pool}
+}
+
+// issue issues a certificate for the given common name, valid for 127.0.0.1 as well
+func (pki *testPKI) issue(t *testing.T, cn string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, pki.cert, &key.PublicKey, pki.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// serveTLS launches a TLS server for the given ID, requiring client certificates
+func serveTLS(t *testing.T, pki *testPKI, id ID, certCN string, setters ...ClientSetter) (*Server, string) {
+	c, err := NewClient(id, setters...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := c.NewServer("127.0.0.1:0", nil)
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{pki.issue(t, certCN)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pki.pool,
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(tls.NewListener(l, cfg))
+	t.Cleanup(func() { srv.Close() })
+	return srv, l.Addr().String()
+}
+
+func TestTLSDial(t *testing.T) {
+	pki := newTestPKI(t)
+
+	tests := []struct {
+		name string
+		// common names of the server and client certificates
+		serverCN, clientCN string
+		// whether the certificate ID check is enabled server-side and client-side
+		serverCheck, clientCheck bool
+		// expected error
+		err error
+	}{
+		{"matching", "SERVER", "CLIENT", true, true, nil},
+		{"no check", "foo", "bar", false, false, nil},
+		{"client rejects server", "OTHER", "CLIENT", false, true, ErrConnectionRejectedByLocal},
+		{"server rejects client", "SERVER", "OTHER", true, false, ErrConnectionRejectedByRemote},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, addr := serveTLS(t, pki, "SERVER", test.serverCN, SetCertificateIDCheck(test.serverCheck))
+
+			c, err := NewClient("CLIENT",
+				SetTLSConfig(&tls.Config{
+					Certificates: []tls.Certificate{pki.issue(t, test.clientCN)},
+					RootCAs:      pki.pool,
+				}),
+				SetCertificateIDCheck(test.clientCheck),
+				SetTimers(time.Second, 0, 0),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := c.Connect(ctx, addr, "SERVER")
+			if errors.Cause(err) != test.err {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			if _, ok := conn.tcp.(*tls.Conn); !ok {
+				t.Errorf("expected a TLS connection, got %T", conn.tcp)
+			}
+			if conn.State() != Ready {
+				t.Errorf("expected state %s, got %s", Ready, conn.State())
+			}
+		})
+	}
+}
+
+func TestCertificateIDCheckWithoutTLS(t *testing.T) {
+	c, err := NewClient("LOCAL", SetCertificateIDCheck(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	conn := c.NewConn(nil)
+	conn.SetUnderlying(p1)
+
+	err = conn.checkCertificateID("REMOTE")
+	if errors.Cause(err) != ErrCertificateIDMismatch {
+		t.Errorf("expected %v, got %v", ErrCertificateIDMismatch, err)
+	}
+}
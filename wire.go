@@ -0,0 +1,130 @@
+package fmtp
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ErrUnexpectedTyp is returned when decoding a message which isn't of the expected type
+var ErrUnexpectedTyp = errors.New("unexpected message type")
+
+// SystemSignal is the signal carried by a SYSTEM message
+type SystemSignal uint8
+
+// The following constants define the signals carried by SYSTEM messages
+const (
+	// SignalShutdown ends an association
+	SignalShutdown SystemSignal = iota
+
+	// SignalStartup requests or accepts an association
+	SignalStartup
+
+	// SignalHeartbeat keeps an association alive
+	SignalHeartbeat
+)
+
+func (sig SystemSignal) String() string {
+	switch sig {
+	case SignalShutdown:
+		return "SHUTDOWN"
+	case SignalStartup:
+		return "STARTUP"
+	case SignalHeartbeat:
+		return "HEARTBEAT"
+	default:
+		return "Unknown SystemSignal"
+	}
+}
+
+// systemSig returns the wire form of the signal
+func (sig SystemSignal) systemSig() (*systemSig, error) {
+	switch sig {
+	case SignalShutdown:
+		return shutdown, nil
+	case SignalStartup:
+		return startup, nil
+	case SignalHeartbeat:
+		return heartbeat, nil
+	default:
+		return nil, errors.Errorf("unknown system signal %d", sig)
+	}
+}
+
+// The following functions and methods give access to the messages exchanged by the protocol itself,
+// which are otherwise handled by Conn. They are meant for tools working at the wire level, such as simulators.
+
+// NewIDRequestMessage returns the identification request sent by sender to receiver when establishing a connection
+func NewIDRequestMessage(sender, receiver ID) (*Message, error) {
+	return newIDRequestMessage(sender, receiver)
+}
+
+// NewIDResponseMessage returns an identification response, either ACCEPT or REJECT
+func NewIDResponseMessage(accept bool) (*Message, error) {
+	return newIDResponseMessage(accept)
+}
+
+// NewSystemMessage returns a SYSTEM message carrying the given signal
+func NewSystemMessage(sig SystemSignal) (*Message, error) {
+	ss, err := sig.systemSig()
+	if err != nil {
+		return nil, err
+	}
+	return newSystemMessage(ss)
+}
+
+// IDRequest decodes an identification request.
+// If the message isn't an identification message, ErrUnexpectedTyp is returned.
+func (msg *Message) IDRequest() (sender, receiver ID, err error) {
+	b, err := msg.payloadOf(identification)
+	if err != nil {
+		return "", "", err
+	}
+	idr := &idRequest{}
+	err = idr.UnmarshalBinary(b)
+	if err != nil {
+		return "", "", err
+	}
+	return idr.Sender, idr.Receiver, nil
+}
+
+// IDResponse decodes an identification response, reporting whether it is an ACCEPT.
+// If the message isn't an identification message, ErrUnexpectedTyp is returned.
+func (msg *Message) IDResponse() (accept bool, err error) {
+	b, err := msg.payloadOf(identification)
+	if err != nil {
+		return false, err
+	}
+	idr := &idResponse{}
+	err = idr.UnmarshalBinary(b)
+	if err != nil {
+		return false, err
+	}
+	return idr.OK, nil
+}
+
+// SystemSignal decodes the signal carried by a SYSTEM message.
+// If the message isn't a SYSTEM message, ErrUnexpectedTyp is returned.
+func (msg *Message) SystemSignal() (SystemSignal, error) {
+	b, err := msg.payloadOf(system)
+	if err != nil {
+		return 0, err
+	}
+	ss := &systemSig{}
+	err = ss.UnmarshalBinary(b)
+	if err != nil {
+		return 0, err
+	}
+	for _, sig := range []SystemSignal{SignalShutdown, SignalStartup, SignalHeartbeat} {
+		if known, _ := sig.systemSig(); ss.equals(known) {
+			return sig, nil
+		}
+	}
+	return 0, errors.Errorf("unknown system signal %q", ss[:])
+}
+
+// payloadOf returns the payload of a message, checking its type
+func (msg *Message) payloadOf(typ Typ) ([]byte, error) {
+	if msg.header == nil || msg.header.typ != typ {
+		return nil, ErrUnexpectedTyp
+	}
+	return msg.Payload()
+}
@@ -0,0 +1,154 @@
+package fmtp_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aabizri/fmtp"
+	"github.com/aabizri/fmtp/clock"
+	"github.com/aabizri/fmtp/fmtptest"
+)
+
+// TestConcurrentSends checks that messages sent concurrently are written whole, one after the other
+func TestConcurrentSends(t *testing.T) {
+	p := fmtptest.NewPair(t, fmtptest.PairOptions{ClientA: []fmtp.ClientSetter{fmtp.SetWriteQueueSize(4)}})
+	p.Associate(t)
+
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf("%02d", i) + string(bytes.Repeat([]byte{'X'}, 4096))
+			msg, err := fmtp.NewOperatorMessageString(body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if err := p.ConnA.Send(context.Background(), msg); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), fmtptest.Timeout)
+	defer cancel()
+	got, err := p.RecB.Wait(ctx, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, r := range got {
+		if len(r.Body) != 2+4096 {
+			t.Fatalf("message of %d bytes received", len(r.Body))
+		}
+		seen[string(r.Body[:2])] = true
+	}
+	if len(seen) != n {
+		t.Errorf("expected %d distinct messages, got %d", n, len(seen))
+	}
+}
+
+func TestSendAfterClose(t *testing.T) {
+	p := fmtptest.NewPair(t, fmtptest.PairOptions{})
+	p.Associate(t)
+	p.ConnA.Close()
+
+	msg, _ := fmtp.NewOperatorMessageString("too late")
+	if err := p.ConnA.Send(context.Background(), msg); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+// TestNoDataAfterShutdown checks that the data still queued once a SHUTDOWN is written isn't sent after it
+func TestNoDataAfterShutdown(t *testing.T) {
+	p := fmtptest.NewPair(t, fmtptest.PairOptions{})
+	var (
+		mu         sync.Mutex
+		atShutdown = -1
+	)
+	p.ConnB.ShutdownNotify = func() {
+		mu.Lock()
+		defer mu.Unlock()
+		atShutdown = len(p.RecB.Messages())
+	}
+	p.Associate(t)
+
+	// Build a backlog on the Low lane, behind a slow link
+	p.Link.SetDelay(20 * time.Millisecond)
+	const n = 10
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			msg, _ := fmtp.NewOperationalMessage(strings.NewReader("bulk"))
+			errs <- p.ConnA.Send(context.Background(), msg)
+		}()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), fmtptest.Timeout)
+	defer cancel()
+	if _, err := p.RecB.Wait(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ConnA.Deassociate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The messages not written before the SHUTDOWN have failed
+	sent := 0
+	for i := 0; i < n; i++ {
+		switch err := <-errs; err {
+		case nil:
+			sent++
+		case fmtp.ErrConnectionClosed:
+		default:
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	if sent == n {
+		t.Fatal("expected the backlog to be failed")
+	}
+
+	// Nothing is received after the SHUTDOWN
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if atShutdown != sent {
+		t.Errorf("expected the %d messages sent to precede the SHUTDOWN, %d did", sent, atShutdown)
+	}
+	if got := len(p.RecB.Messages()); got != sent {
+		t.Errorf("expected %d messages received, got %d", sent, got)
+	}
+}
+
+// TestSlowLinkDoesntStallAgent checks that while the writer is stuck on a slow link, the connection still receives
+func TestSlowLinkDoesntStallAgent(t *testing.T) {
+	fc := clock.NewFake(time.Now())
+	p := fmtptest.NewPair(t, fmtptest.PairOptions{ClientA: []fmtp.ClientSetter{fmtp.SetClock(fc), fmtp.SetWriteQueueSize(1)}})
+	p.Associate(t)
+	fc.BlockUntil(2)
+
+	// Every lane of A's writer fills up behind a write taking far longer than the test
+	p.Link.SetDelay(2 * time.Second)
+	for i := 0; i < 4; i++ {
+		go func() {
+			msg, _ := fmtp.NewOperatorMessageString("stuck")
+			p.ConnA.Send(context.Background(), msg)
+		}()
+	}
+	fc.Advance(fmtp.DefaultTs)
+
+	// A still handles what it receives
+	p.SendB(t, "ping")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := p.RecA.Wait(ctx, 1); err != nil {
+		t.Fatalf("nothing received while the writer is stuck: %v", err)
+	}
+}